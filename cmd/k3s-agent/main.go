@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"k3s-local-agent/internal/config"
 	"k3s-local-agent/internal/controlplane"
 	"k3s-local-agent/internal/k3s"
+	"k3s-local-agent/internal/metrics"
 	"k3s-local-agent/internal/monitor"
 	"k3s-local-agent/pkg/logger"
 
@@ -35,6 +40,19 @@ type K3sAgentConfig struct {
 	ControlPlaneKey    string
 	AgentID            string
 	SendToControlPlane bool
+	ClientCertFile     string // Client certificate for mutual TLS with the control plane
+	ClientKeyFile      string
+	ControlPlaneCA     string // CA bundle verifying the control plane
+	QueueDir           string // Buffers monitoring data while the control plane is unreachable
+	QueueSize          int
+	BatchSize          int           // Monitoring samples per upload; 0 sends each sample on its own
+	BatchMaxAge        time.Duration // Longest a sample waits for its batch
+	DeltaSnapshots     bool          // Send cluster snapshots with only changed nodes and pods
+	FullSnapshotEvery  time.Duration // Longest interval between full snapshots in delta mode
+	CommandChannel     bool          // Poll the control plane for commands in monitoring mode
+	CommandWait        time.Duration
+	// Address serving /metrics in monitoring mode; empty disables it
+	MetricsAddr string
 }
 
 func main() {
@@ -56,6 +74,18 @@ func main() {
 		controlPlaneKey    = flag.String("control-plane-key", "", "Control plane API key")
 		agentID            = flag.String("agent-id", "", "Agent ID for control plane")
 		sendToControlPlane = flag.Bool("send-to-control-plane", false, "Send data to control plane")
+		clientCert         = flag.String("control-plane-cert", "", "Client certificate for mutual TLS with the control plane")
+		clientKey          = flag.String("control-plane-key-file", "", "Private key file for -control-plane-cert")
+		controlPlaneCA     = flag.String("control-plane-ca", "", "CA bundle used to verify the control plane (default: system roots)")
+		queueDir           = flag.String("queue-dir", "data/k3s-agent/queue", "Directory buffering monitoring data while the control plane is unreachable (empty disables)")
+		queueSize          = flag.Int("queue-size", 500, "Maximum buffered monitoring payloads before the oldest are dropped")
+		batchSize          = flag.Int("batch-size", 0, "Monitoring samples per compressed batch upload (0 sends each sample on its own)")
+		batchMaxAge        = flag.Duration("batch-max-age", 5*time.Minute, "Longest a monitoring sample waits before its batch is sent")
+		deltaSnapshots     = flag.Bool("delta", false, "Send cluster snapshots with only added, changed and removed nodes and pods")
+		fullSnapshotEvery  = flag.Duration("full-snapshot-interval", 10*time.Minute, "Longest interval between full snapshots in -delta mode")
+		commandChannel     = flag.Bool("command-channel", false, "Poll the control plane for commands in monitoring mode")
+		commandWait        = flag.Duration("command-wait", 30*time.Second, "How long the control plane may hold each command poll open")
+		metricsAddr        = flag.String("metrics-addr", ":9101", "Address for the Prometheus /metrics endpoint in monitoring mode (empty disables)")
 		help               = flag.Bool("help", false, "Show help information")
 	)
 	flag.Parse()
@@ -66,7 +96,7 @@ func main() {
 	}
 
 	// Setup configuration
-	cfg := setupK3sAgentConfig(*outputFile, *logFile, *namespace, *monitorMode, *checkInterval, *schedulePod, *podName, *image, *cpuRequest, *memoryRequest, *prettyPrint, *controlPlaneURL, *controlPlaneKey, *agentID, *sendToControlPlane)
+	cfg := setupK3sAgentConfig(*outputFile, *logFile, *namespace, *monitorMode, *checkInterval, *schedulePod, *podName, *image, *cpuRequest, *memoryRequest, *prettyPrint, *controlPlaneURL, *controlPlaneKey, *agentID, *sendToControlPlane, *clientCert, *clientKey, *controlPlaneCA, *queueDir, *queueSize, *batchSize, *batchMaxAge, *deltaSnapshots, *fullSnapshotEvery, *commandChannel, *commandWait, *metricsAddr)
 
 	// Setup logger
 	log := logger.New()
@@ -88,6 +118,7 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to create K3s resource monitor", err)
 	}
+	k3sMonitor.SetAgentID(cfg.AgentID)
 
 	// Create control plane client if configured
 	var controlPlaneClient *controlplane.ControlPlaneClient
@@ -97,13 +128,34 @@ func main() {
 			APIKey:  cfg.ControlPlaneKey,
 			AgentID: cfg.AgentID,
 			Timeout: 30 * time.Second,
+			TLS: &controlplane.TLSConfig{
+				CertFile: cfg.ClientCertFile,
+				KeyFile:  cfg.ClientKeyFile,
+				CAFile:   cfg.ControlPlaneCA,
+			},
+			QueueDir:  cfg.QueueDir,
+			QueueSize: cfg.QueueSize,
+		}
+		if cfg.BatchSize > 0 {
+			controlPlaneConfig.Batch = &controlplane.BatchConfig{
+				MaxSamples: cfg.BatchSize,
+				MaxAge:     cfg.BatchMaxAge,
+			}
+		}
+		if cfg.DeltaSnapshots {
+			controlPlaneConfig.Delta = &controlplane.DeltaConfig{
+				FullInterval: cfg.FullSnapshotEvery,
+			}
 		}
 
-		controlPlaneClient = controlplane.NewControlPlaneClient(controlPlaneConfig, log)
+		controlPlaneClient, err = controlplane.NewControlPlaneClient(controlPlaneConfig, log)
+		if err != nil {
+			log.Fatal("Failed to create control plane client", err)
+		}
 
 		// Test connection to control plane
 		if err := controlPlaneClient.TestConnection(); err != nil {
-			log.Warn("Failed to connect to control plane", "error", err)
+			log.Warn("Failed to connect to control plane", "kind", controlplane.ErrorKind(err), "error", err)
 		} else {
 			log.Info("Successfully connected to control plane")
 		}
@@ -119,10 +171,18 @@ func main() {
 		// Run in capture mode
 		runK3sCaptureMode(cfg, log, k3sMonitor, controlPlaneClient)
 	}
+
+	// Send any partially filled monitoring batch before exiting; monitoring mode
+	// returns here on SIGINT or SIGTERM
+	if controlPlaneClient != nil {
+		if err := controlPlaneClient.Close(); err != nil {
+			log.Warn("Failed to send pending monitoring batch", "error", err)
+		}
+	}
 }
 
 // Setup K3s agent configuration
-func setupK3sAgentConfig(outputFile, logFile, namespace string, monitorMode bool, checkInterval time.Duration, scheduleWorkload bool, podName, image, cpuRequest, memoryRequest string, prettyPrint bool, controlPlaneURL, controlPlaneKey, agentID string, sendToControlPlane bool) *K3sAgentConfig {
+func setupK3sAgentConfig(outputFile, logFile, namespace string, monitorMode bool, checkInterval time.Duration, scheduleWorkload bool, podName, image, cpuRequest, memoryRequest string, prettyPrint bool, controlPlaneURL, controlPlaneKey, agentID string, sendToControlPlane bool, clientCert, clientKey, controlPlaneCA, queueDir string, queueSize, batchSize int, batchMaxAge time.Duration, deltaSnapshots bool, fullSnapshotEvery time.Duration, commandChannel bool, commandWait time.Duration, metricsAddr string) *K3sAgentConfig {
 	// Generate default output file name if not provided
 	if outputFile == "" {
 		timestamp := time.Now().Format("20060102_150405")
@@ -168,19 +228,47 @@ func setupK3sAgentConfig(outputFile, logFile, namespace string, monitorMode bool
 		ControlPlaneKey:    controlPlaneKey,
 		AgentID:            agentID,
 		SendToControlPlane: sendToControlPlane,
+		ClientCertFile:     clientCert,
+		ClientKeyFile:      clientKey,
+		ControlPlaneCA:     controlPlaneCA,
+		QueueDir:           queueDir,
+		QueueSize:          queueSize,
+		BatchSize:          batchSize,
+		BatchMaxAge:        batchMaxAge,
+		DeltaSnapshots:     deltaSnapshots,
+		FullSnapshotEvery:  fullSnapshotEvery,
+		CommandChannel:     commandChannel,
+		CommandWait:        commandWait,
+		MetricsAddr:        metricsAddr,
 	}
 }
 
-// Run in K3s monitoring mode - continuous monitoring
+// Run in K3s monitoring mode - continuous monitoring until interrupted
 func runK3sMonitoringMode(cfg *K3sAgentConfig, log logger.Logger, k3sMonitor *monitor.K3sResourceMonitor, controlPlaneClient *controlplane.ControlPlaneClient) {
 	log.Info("Running K3s agent in monitoring mode...")
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.MetricsAddr != "" {
+		metrics.Serve(cfg.MetricsAddr, log)
+	}
+
 	stopCh := make(chan struct{})
 	defer close(stopCh)
 
 	// Start cluster monitoring in background
 	go k3sMonitor.MonitorCluster(cfg.CheckInterval, stopCh)
 
+	// Receive commands from the control plane over outbound long polls
+	if cfg.CommandChannel && controlPlaneClient != nil {
+		commandChannel := controlplane.NewCommandChannel(controlPlaneClient, &controlplane.CommandChannelConfig{
+			Wait: cfg.CommandWait,
+		}, log)
+		registerK3sCommandHandlers(commandChannel, log, k3sMonitor, controlPlaneClient)
+		go commandChannel.Run(stopCh)
+	}
+
 	// Main monitoring loop
 	for {
 		// Capture current state
@@ -188,10 +276,72 @@ func runK3sMonitoringMode(cfg *K3sAgentConfig, log logger.Logger, k3sMonitor *mo
 
 		// Wait for next check
 		log.Info("Waiting for next check...", "interval", cfg.CheckInterval)
-		time.Sleep(cfg.CheckInterval)
+		timer := time.NewTimer(cfg.CheckInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Info("Shutting down K3s monitoring")
+			return
+		case <-timer.C:
+		}
 	}
 }
 
+// registerK3sCommandHandlers handles the commands a K3s agent can act on
+func registerK3sCommandHandlers(commandChannel *controlplane.CommandChannel, log logger.Logger, k3sMonitor *monitor.K3sResourceMonitor, controlPlaneClient *controlplane.ControlPlaneClient) {
+	commandChannel.Handle(controlplane.CommandScheduleWorkload, func(command controlplane.Command) (interface{}, error) {
+		var request controlplane.ScheduleWorkloadRequest
+		if err := json.Unmarshal(command.Payload, &request); err != nil {
+			return nil, fmt.Errorf("invalid schedule_workload payload: %w", err)
+		}
+		cpuRequest, err := resource.ParseQuantity(request.CPURequest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU request: %w", err)
+		}
+		memoryRequest, err := resource.ParseQuantity(request.MemoryRequest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory request: %w", err)
+		}
+		return k3sMonitor.ScheduleWorkload(request.PodName, request.Image, cpuRequest, memoryRequest)
+	})
+
+	commandChannel.Handle(controlplane.CommandCollectDiagnostics, func(command controlplane.Command) (interface{}, error) {
+		k3sData, err := k3sMonitor.GetAllK3sResources()
+		if err != nil {
+			return nil, fmt.Errorf("failed to collect K3s data: %w", err)
+		}
+		diagnostics := map[string]interface{}{
+			"cluster":       k3sData,
+			"control_plane": controlPlaneClient.GetStatus(),
+			"timestamp":     time.Now(),
+		}
+		if delta := controlPlaneClient.GetDeltaStatus(); delta != nil {
+			diagnostics["delta"] = delta
+		}
+		if recommendation, err := k3sMonitor.GetSchedulingRecommendation(); err == nil {
+			diagnostics["scheduling_recommendation"] = recommendation
+		}
+		return diagnostics, nil
+	})
+
+	// Resync sends current monitoring data at once, as a full snapshot in delta mode
+	commandChannel.Handle(controlplane.CommandResync, func(command controlplane.Command) (interface{}, error) {
+		controlPlaneClient.RequestResync()
+		k3sData, err := k3sMonitor.GetAllK3sResources()
+		if err != nil {
+			return nil, fmt.Errorf("failed to collect K3s data: %w", err)
+		}
+		if err := controlPlaneClient.SendMonitoringData(k3sData); err != nil && !errors.Is(err, controlplane.ErrQueued) {
+			return nil, err
+		}
+		log.Info("Resynced monitoring data at the control plane's request")
+		return map[string]interface{}{
+			"nodes": len(k3sData.NodeMetrics),
+			"pods":  len(k3sData.PodMetrics),
+		}, nil
+	})
+}
+
 // Run in K3s scheduling mode - schedule a test workload
 func runK3sSchedulingMode(cfg *K3sAgentConfig, log logger.Logger, k3sMonitor *monitor.K3sResourceMonitor, controlPlaneClient *controlplane.ControlPlaneClient) {
 	log.Info("Running K3s agent in scheduling mode...")
@@ -228,7 +378,7 @@ func runK3sSchedulingMode(cfg *K3sAgentConfig, log logger.Logger, k3sMonitor *mo
 	// Send scheduling decision to control plane
 	if controlPlaneClient != nil {
 		if err := controlPlaneClient.SendSchedulingDecision(decision); err != nil {
-			log.Error("Failed to send scheduling decision to control plane", "error", err)
+			log.Error("Failed to send scheduling decision to control plane", "kind", controlplane.ErrorKind(err), "error", err)
 		}
 	}
 
@@ -303,12 +453,23 @@ func captureK3sData(cfg *K3sAgentConfig, log logger.Logger, k3sMonitor *monitor.
 		if err != nil {
 			log.Error("Failed to get K3s data for control plane", "error", err)
 		} else {
-			if err := controlPlaneClient.SendMonitoringData(k3sData); err != nil {
-				log.Error("Failed to send data to control plane", "error", err)
+			if err := controlPlaneClient.SendMonitoringData(k3sData); errors.Is(err, controlplane.ErrQueued) {
+				log.Warn("Control plane delivery failed, data buffered for later delivery",
+					"queued", controlPlaneClient.QueuedPayloads(),
+					"kind", controlplane.ErrorKind(err))
+			} else if err != nil {
+				log.Error("Failed to send data to control plane", "kind", controlplane.ErrorKind(err), "error", err)
 			} else {
 				log.Info("Data sent to control plane successfully")
 			}
 		}
+
+		// Record the connection state so authentication failures can be told from outages
+		if statusJSON, err := json.MarshalIndent(controlPlaneClient.GetStatus(), "", "  "); err == nil {
+			fmt.Fprintf(file, "CONTROL PLANE STATUS:\n")
+			fmt.Fprintf(file, "=====================\n")
+			fmt.Fprintf(file, "%s\n\n", statusJSON)
+		}
 	}
 
 	// Write footer
@@ -385,6 +546,9 @@ func writeK3sHeader(file *os.File, cfg *K3sAgentConfig) {
 	if cfg.SendToControlPlane {
 		fmt.Fprintf(file, "Control Plane: %s\n", cfg.ControlPlaneURL)
 		fmt.Fprintf(file, "Agent ID: %s\n", cfg.AgentID)
+		if cfg.MonitorMode {
+			fmt.Fprintf(file, "Command Channel: %t\n", cfg.CommandChannel)
+		}
 	}
 	fmt.Fprintf(file, "Output File: %s\n", cfg.OutputFile)
 	fmt.Fprintf(file, "Log File: %s\n", cfg.LogFile)
@@ -449,6 +613,30 @@ func printHelp() {
 	fmt.Println("        Agent ID for control plane (auto-generated if not provided)")
 	fmt.Println("  -send-to-control-plane")
 	fmt.Println("        Send monitoring data to control plane")
+	fmt.Println("  -control-plane-cert string")
+	fmt.Println("        Client certificate for mutual TLS with the control plane (re-read when rotated)")
+	fmt.Println("  -control-plane-key-file string")
+	fmt.Println("        Private key file for -control-plane-cert")
+	fmt.Println("  -control-plane-ca string")
+	fmt.Println("        CA bundle used to verify the control plane (default: system roots)")
+	fmt.Println("  -queue-dir string")
+	fmt.Println("        Directory buffering monitoring data while the control plane is unreachable (default: data/k3s-agent/queue, empty disables)")
+	fmt.Println("  -queue-size int")
+	fmt.Println("        Maximum buffered monitoring payloads before the oldest are dropped (default: 500)")
+	fmt.Println("  -batch-size int")
+	fmt.Println("        Monitoring samples per gzip-compressed batch upload (default: 0, sends each sample on its own)")
+	fmt.Println("  -batch-max-age duration")
+	fmt.Println("        Longest a monitoring sample waits before its batch is sent (default: 5m)")
+	fmt.Println("  -delta")
+	fmt.Println("        Send cluster snapshots with only added, changed and removed nodes and pods (not with -batch-size)")
+	fmt.Println("  -full-snapshot-interval duration")
+	fmt.Println("        Longest interval between full snapshots in -delta mode (default: 10m)")
+	fmt.Println("  -command-channel")
+	fmt.Println("        Poll the control plane for commands in monitoring mode (schedule_workload, collect_diagnostics, resync)")
+	fmt.Println("  -command-wait duration")
+	fmt.Println("        How long the control plane may hold each command poll open (default: 30s)")
+	fmt.Println("  -metrics-addr string")
+	fmt.Println("        Address for the Prometheus /metrics endpoint in monitoring mode (default: :9101, empty disables)")
 	fmt.Println("  -help")
 	fmt.Println("        Show this help information")
 	fmt.Println()
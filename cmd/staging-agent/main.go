@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"k3s-local-agent/internal/config"
@@ -20,10 +21,32 @@ type StagingAgentConfig struct {
 	AgentID          string
 	ControlPlaneURL  string
 	ControlPlanePort int
+	ControlPlaneKey  string
 	KindClusterName  string
 	LocalNamespace   string
 	AgentPort        int
 	SyncInterval     time.Duration
+	DataDir          string
+	GCOnShutdown     bool
+	GCDryRun         bool
+	ProxyCapture     int
+	ProxyTLS         bool
+	ProxyCertFile    string
+	ProxyKeyFile     string
+	ProxyAPIToken    string
+	ProxySecretsDir  string
+	AuthTokens       []string
+	AuthTokenFile    string
+	HMACSecret       string
+	HMACSecretFile   string
+	ClientCertFile   string
+	ClientKeyFile    string
+	ControlPlaneCA   string
+	ReceiverCertFile string
+	ReceiverKeyFile  string
+	ReceiverClientCA string
+	CommandChannel   bool
+	CommandWait      time.Duration
 	PrettyPrint      bool
 	MonitorMode      bool
 	CheckInterval    time.Duration
@@ -37,10 +60,32 @@ func main() {
 		agentID          = flag.String("agent-id", "", "Agent ID (default: auto-generated)")
 		controlPlaneURL  = flag.String("control-plane-url", "http://localhost:8080", "Control plane URL")
 		controlPlanePort = flag.Int("control-plane-port", 8080, "Control plane port")
+		controlPlaneKey  = flag.String("control-plane-key", "", "Control plane API key")
 		kindClusterName  = flag.String("kind-cluster", "staging-cluster", "Kind cluster name")
 		localNamespace   = flag.String("namespace", "staging", "Local namespace for staging pods")
 		agentPort        = flag.Int("agent-port", 8082, "Agent port for receiving pod data")
 		syncInterval     = flag.Duration("sync-interval", 30*time.Second, "Sync interval for staging pods")
+		dataDir          = flag.String("data-dir", "data/staging", "Directory for persisted staging state (empty disables persistence)")
+		gcOnShutdown     = flag.Bool("gc-on-shutdown", false, "Remove all agent-owned pods, routes and tunnels on graceful shutdown")
+		gcDryRun         = flag.Bool("gc-dry-run", false, "List what garbage collection would remove without deleting anything")
+		proxyCapture     = flag.Int("proxy-capture", 0, "Number of proxied requests to keep per proxy for inspection and replay (0 disables)")
+		proxyTLS         = flag.Bool("proxy-tls", false, "Serve the HTTP proxy over HTTPS with certificates from a local CA")
+		proxyCert        = flag.String("proxy-cert", "", "Certificate file for the HTTPS proxy instead of the local CA")
+		proxyKey         = flag.String("proxy-key", "", "Private key file for -proxy-cert")
+		proxyAPIToken    = flag.String("proxy-api-token", "", "Bearer token for the proxy's traffic and fault APIs from other hosts (default: loopback only)")
+		proxySecretsDir  = flag.String("proxy-secrets-dir", "", "Directory holding the auth secrets proxy policies may name (empty disables auth injection)")
+		authToken        = flag.String("auth-token", "", "Comma-separated bearer tokens the control plane must send to the agent port")
+		authTokenFile    = flag.String("auth-token-file", "", "File with one accepted bearer token per line, re-read when it changes")
+		hmacSecret       = flag.String("hmac-secret", "", "Shared secret the control plane must sign agent port requests with")
+		hmacSecretFile   = flag.String("hmac-secret-file", "", "File holding the HMAC secret, re-read when it changes")
+		clientCert       = flag.String("control-plane-cert", "", "Client certificate for mutual TLS with the control plane")
+		clientKey        = flag.String("control-plane-key-file", "", "Private key file for -control-plane-cert")
+		controlPlaneCA   = flag.String("control-plane-ca", "", "CA bundle used to verify the control plane (default: system roots)")
+		receiverCert     = flag.String("receiver-cert", "", "Server certificate for HTTPS on the agent port")
+		receiverKey      = flag.String("receiver-key", "", "Private key file for -receiver-cert")
+		receiverClientCA = flag.String("receiver-client-ca", "", "CA bundle that control plane client certificates must chain to (requires -receiver-cert)")
+		commandChannel   = flag.Bool("command-channel", false, "Poll the control plane for commands instead of exposing the agent port through a tunnel")
+		commandWait      = flag.Duration("command-wait", 30*time.Second, "How long the control plane may hold each command poll open")
 		prettyPrint      = flag.Bool("pretty", false, "Pretty print JSON output")
 		monitorMode      = flag.Bool("monitor", false, "Run in monitoring mode")
 		checkInterval    = flag.Duration("interval", 60*time.Second, "Check interval for monitoring mode")
@@ -54,7 +99,7 @@ func main() {
 	}
 
 	// Setup configuration
-	cfg := setupStagingAgentConfig(*outputFile, *logFile, *agentID, *controlPlaneURL, *controlPlanePort, *kindClusterName, *localNamespace, *agentPort, *syncInterval, *prettyPrint, *monitorMode, *checkInterval)
+	cfg := setupStagingAgentConfig(*outputFile, *logFile, *agentID, *controlPlaneURL, *controlPlanePort, *controlPlaneKey, *kindClusterName, *localNamespace, *agentPort, *syncInterval, *dataDir, *gcOnShutdown, *gcDryRun, *proxyCapture, *proxyTLS, *proxyCert, *proxyKey, *proxyAPIToken, *proxySecretsDir, *authToken, *authTokenFile, *hmacSecret, *hmacSecretFile, *clientCert, *clientKey, *controlPlaneCA, *receiverCert, *receiverKey, *receiverClientCA, *commandChannel, *commandWait, *prettyPrint, *monitorMode, *checkInterval)
 
 	// Setup logger
 	log := logger.New()
@@ -76,10 +121,32 @@ func main() {
 		AgentID:          cfg.AgentID,
 		ControlPlaneURL:  cfg.ControlPlaneURL,
 		ControlPlanePort: cfg.ControlPlanePort,
+		ControlPlaneKey:  cfg.ControlPlaneKey,
 		KindClusterName:  cfg.KindClusterName,
 		LocalNamespace:   cfg.LocalNamespace,
 		AgentPort:        cfg.AgentPort,
 		SyncInterval:     cfg.SyncInterval,
+		DataDir:          cfg.DataDir,
+		GCOnShutdown:     cfg.GCOnShutdown,
+		GCDryRun:         cfg.GCDryRun,
+		ProxyCaptureSize: cfg.ProxyCapture,
+		ProxyTLS:         cfg.ProxyTLS,
+		ProxyCertFile:    cfg.ProxyCertFile,
+		ProxyKeyFile:     cfg.ProxyKeyFile,
+		ProxyAPIToken:    cfg.ProxyAPIToken,
+		ProxySecretsDir:  cfg.ProxySecretsDir,
+		AuthTokens:       cfg.AuthTokens,
+		AuthTokenFile:    cfg.AuthTokenFile,
+		HMACSecret:       cfg.HMACSecret,
+		HMACSecretFile:   cfg.HMACSecretFile,
+		ClientCertFile:   cfg.ClientCertFile,
+		ClientKeyFile:    cfg.ClientKeyFile,
+		ControlPlaneCA:   cfg.ControlPlaneCA,
+		ReceiverCertFile: cfg.ReceiverCertFile,
+		ReceiverKeyFile:  cfg.ReceiverKeyFile,
+		ReceiverClientCA: cfg.ReceiverClientCA,
+		CommandChannel:   cfg.CommandChannel,
+		CommandWait:      cfg.CommandWait,
 	}
 
 	stagingAgent, err := staging.NewLocalStagingAgent(stagingConfig, log)
@@ -97,7 +164,7 @@ func main() {
 }
 
 // Setup staging agent configuration
-func setupStagingAgentConfig(outputFile, logFile, agentID, controlPlaneURL string, controlPlanePort int, kindClusterName, localNamespace string, agentPort int, syncInterval time.Duration, prettyPrint, monitorMode bool, checkInterval time.Duration) *StagingAgentConfig {
+func setupStagingAgentConfig(outputFile, logFile, agentID, controlPlaneURL string, controlPlanePort int, controlPlaneKey, kindClusterName, localNamespace string, agentPort int, syncInterval time.Duration, dataDir string, gcOnShutdown, gcDryRun bool, proxyCapture int, proxyTLS bool, proxyCert, proxyKey, proxyAPIToken, proxySecretsDir, authToken, authTokenFile, hmacSecret, hmacSecretFile, clientCert, clientKey, controlPlaneCA, receiverCert, receiverKey, receiverClientCA string, commandChannel bool, commandWait time.Duration, prettyPrint, monitorMode bool, checkInterval time.Duration) *StagingAgentConfig {
 	// Generate default output file name if not provided
 	if outputFile == "" {
 		timestamp := time.Now().Format("20060102_150405")
@@ -117,22 +184,56 @@ func setupStagingAgentConfig(outputFile, logFile, agentID, controlPlaneURL strin
 		}
 	}
 
+	// Reuse the agent ID from persisted state so restarts keep ownership of their pods
+	if agentID == "" && dataDir != "" {
+		agentID = staging.LoadPersistedAgentID(dataDir)
+	}
+
 	// Generate default agent ID if not provided
 	if agentID == "" {
 		hostname, _ := os.Hostname()
 		agentID = fmt.Sprintf("staging-agent-%s-%d", hostname, time.Now().Unix())
 	}
 
+	var authTokens []string
+	for _, token := range strings.Split(authToken, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			authTokens = append(authTokens, token)
+		}
+	}
+
 	return &StagingAgentConfig{
 		OutputFile:       outputFile,
 		LogFile:          logFile,
 		AgentID:          agentID,
 		ControlPlaneURL:  controlPlaneURL,
 		ControlPlanePort: controlPlanePort,
+		ControlPlaneKey:  controlPlaneKey,
 		KindClusterName:  kindClusterName,
 		LocalNamespace:   localNamespace,
 		AgentPort:        agentPort,
 		SyncInterval:     syncInterval,
+		DataDir:          dataDir,
+		GCOnShutdown:     gcOnShutdown,
+		GCDryRun:         gcDryRun,
+		ProxyCapture:     proxyCapture,
+		ProxyTLS:         proxyTLS || proxyCert != "",
+		ProxyCertFile:    proxyCert,
+		ProxyKeyFile:     proxyKey,
+		ProxyAPIToken:    proxyAPIToken,
+		ProxySecretsDir:  proxySecretsDir,
+		AuthTokens:       authTokens,
+		AuthTokenFile:    authTokenFile,
+		HMACSecret:       hmacSecret,
+		HMACSecretFile:   hmacSecretFile,
+		ClientCertFile:   clientCert,
+		ClientKeyFile:    clientKey,
+		ControlPlaneCA:   controlPlaneCA,
+		ReceiverCertFile: receiverCert,
+		ReceiverKeyFile:  receiverKey,
+		ReceiverClientCA: receiverClientCA,
+		CommandChannel:   commandChannel,
+		CommandWait:      commandWait,
 		PrettyPrint:      prettyPrint,
 		MonitorMode:      monitorMode,
 		CheckInterval:    checkInterval,
@@ -243,11 +344,44 @@ func writeStagingHeader(file *os.File, cfg *StagingAgentConfig) {
 	fmt.Fprintf(file, "Kind Cluster: %s\n", cfg.KindClusterName)
 	fmt.Fprintf(file, "Local Namespace: %s\n", cfg.LocalNamespace)
 	fmt.Fprintf(file, "Agent Port: %d\n", cfg.AgentPort)
+	fmt.Fprintf(file, "Data Dir: %s\n", cfg.DataDir)
+	fmt.Fprintf(file, "GC On Shutdown: %t (dry run: %t)\n", cfg.GCOnShutdown, cfg.GCDryRun)
+	fmt.Fprintf(file, "Proxy Capture: %d\n", cfg.ProxyCapture)
+	fmt.Fprintf(file, "Proxy TLS: %t\n", cfg.ProxyTLS)
+	fmt.Fprintf(file, "Proxy API: %s\n", proxyAPISummary(cfg))
+	fmt.Fprintf(file, "Proxy Secrets Dir: %s\n", cfg.ProxySecretsDir)
+	fmt.Fprintf(file, "Receiver Auth: %s\n", receiverAuthSummary(cfg))
+	fmt.Fprintf(file, "Receiver TLS: %t (client certificates: %t)\n", cfg.ReceiverCertFile != "", cfg.ReceiverClientCA != "")
+	fmt.Fprintf(file, "Control Plane Client Certificate: %t\n", cfg.ClientCertFile != "")
+	fmt.Fprintf(file, "Command Channel: %t (wait: %v)\n", cfg.CommandChannel, cfg.CommandWait)
 	fmt.Fprintf(file, "Output File: %s\n", cfg.OutputFile)
 	fmt.Fprintf(file, "Log File: %s\n", cfg.LogFile)
 	fmt.Fprintf(file, "\n")
 }
 
+// proxyAPISummary describes who may use the proxy's traffic and fault APIs without revealing the token
+func proxyAPISummary(cfg *StagingAgentConfig) string {
+	if cfg.ProxyAPIToken != "" {
+		return "loopback or bearer token"
+	}
+	return "loopback only"
+}
+
+// receiverAuthSummary names the configured pod receiver checks without revealing any keys
+func receiverAuthSummary(cfg *StagingAgentConfig) string {
+	var methods []string
+	if len(cfg.AuthTokens) > 0 || cfg.AuthTokenFile != "" {
+		methods = append(methods, "bearer")
+	}
+	if cfg.HMACSecret != "" || cfg.HMACSecretFile != "" {
+		methods = append(methods, "hmac")
+	}
+	if len(methods) == 0 {
+		return "disabled"
+	}
+	return strings.Join(methods, "+")
+}
+
 // Write staging status
 func writeStagingStatus(file *os.File, status *staging.StagingStatus, prettyPrint bool) {
 	fmt.Fprintf(file, "STAGING STATUS\n")
@@ -367,6 +501,8 @@ func printStagingHelp() {
 	fmt.Println("        Control plane URL (default: http://localhost:8080)")
 	fmt.Println("  -control-plane-port int")
 	fmt.Println("        Control plane port (default: 8080)")
+	fmt.Println("  -control-plane-key string")
+	fmt.Println("        Control plane API key, sent as a bearer token")
 	fmt.Println("  -kind-cluster string")
 	fmt.Println("        Kind cluster name (default: staging-cluster)")
 	fmt.Println("  -namespace string")
@@ -375,6 +511,48 @@ func printStagingHelp() {
 	fmt.Println("        Agent port for receiving pod data (default: 8082)")
 	fmt.Println("  -sync-interval duration")
 	fmt.Println("        Sync interval for staging pods (default: 30s)")
+	fmt.Println("  -data-dir string")
+	fmt.Println("        Directory for persisted staging state (default: data/staging)")
+	fmt.Println("  -gc-on-shutdown")
+	fmt.Println("        Remove all agent-owned pods, routes and tunnels on graceful shutdown")
+	fmt.Println("  -gc-dry-run")
+	fmt.Println("        List what garbage collection would remove without deleting anything")
+	fmt.Println("  -proxy-capture int")
+	fmt.Println("        Number of proxied requests to keep per proxy for inspection and replay (default: 0, disabled)")
+	fmt.Println("  -proxy-tls")
+	fmt.Println("        Serve the HTTP proxy over HTTPS with certificates from a local CA")
+	fmt.Println("  -proxy-cert string")
+	fmt.Println("        Certificate file for the HTTPS proxy instead of the local CA")
+	fmt.Println("  -proxy-key string")
+	fmt.Println("        Private key file for -proxy-cert")
+	fmt.Println("  -proxy-api-token string")
+	fmt.Println("        Bearer token for the proxy's traffic and fault APIs from other hosts (default: loopback only)")
+	fmt.Println("  -proxy-secrets-dir string")
+	fmt.Println("        Directory holding the auth secrets proxy policies may name (default: none, auth injection disabled)")
+	fmt.Println("  -auth-token string")
+	fmt.Println("        Comma-separated bearer tokens the control plane must send to the agent port")
+	fmt.Println("  -auth-token-file string")
+	fmt.Println("        File with one accepted bearer token per line, re-read when it changes")
+	fmt.Println("  -hmac-secret string")
+	fmt.Println("        Shared secret the control plane must sign agent port requests with")
+	fmt.Println("  -hmac-secret-file string")
+	fmt.Println("        File holding the HMAC secret, re-read when it changes")
+	fmt.Println("  -control-plane-cert string")
+	fmt.Println("        Client certificate for mutual TLS with the control plane (re-read when rotated)")
+	fmt.Println("  -control-plane-key-file string")
+	fmt.Println("        Private key file for -control-plane-cert")
+	fmt.Println("  -control-plane-ca string")
+	fmt.Println("        CA bundle used to verify the control plane (default: system roots)")
+	fmt.Println("  -receiver-cert string")
+	fmt.Println("        Server certificate for HTTPS on the agent port (re-read when rotated)")
+	fmt.Println("  -receiver-key string")
+	fmt.Println("        Private key file for -receiver-cert")
+	fmt.Println("  -receiver-client-ca string")
+	fmt.Println("        CA bundle that control plane client certificates must chain to (requires -receiver-cert)")
+	fmt.Println("  -command-channel")
+	fmt.Println("        Poll the control plane for commands instead of exposing the agent port through a tunnel")
+	fmt.Println("  -command-wait duration")
+	fmt.Println("        How long the control plane may hold each command poll open (default: 30s)")
 	fmt.Println("  -pretty")
 	fmt.Println("        Pretty print JSON output")
 	fmt.Println("  -monitor")
@@ -390,4 +568,5 @@ func printStagingHelp() {
 	fmt.Println("  go run cmd/staging-agent/main.go -monitor -interval 30s")
 	fmt.Println("  go run cmd/staging-agent/main.go -control-plane-url http://staging-control.example.com")
 	fmt.Println("  go run cmd/staging-agent/main.go -kind-cluster my-staging-cluster")
+	fmt.Println("  go run cmd/staging-agent/main.go -monitor -command-channel")
 }
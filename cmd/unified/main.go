@@ -10,6 +10,7 @@ import (
 
 	"k3s-local-agent/internal/agent"
 	"k3s-local-agent/internal/config"
+	"k3s-local-agent/internal/metrics"
 	"k3s-local-agent/internal/monitor"
 	"k3s-local-agent/pkg/logger"
 )
@@ -24,6 +25,7 @@ type UnifiedConfig struct {
 	PrettyPrint      bool
 	MonitorMode      bool
 	CheckInterval    time.Duration
+	MetricsAddr      string // Address serving /metrics in monitoring mode; empty disables it
 }
 
 func main() {
@@ -37,6 +39,7 @@ func main() {
 		prettyPrint   = flag.Bool("pretty", false, "Pretty print JSON output")
 		monitorMode   = flag.Bool("monitor", false, "Run in monitoring mode")
 		checkInterval = flag.Duration("interval", 30*time.Second, "Check interval for monitoring mode")
+		metricsAddr   = flag.String("metrics-addr", ":9100", "Address for the Prometheus /metrics endpoint in monitoring mode (empty disables)")
 		help          = flag.Bool("help", false, "Show help information")
 	)
 	flag.Parse()
@@ -47,7 +50,7 @@ func main() {
 	}
 
 	// Setup configuration
-	cfg := setupUnifiedConfig(*outputFile, *logFile, *waitTime, *healthOnly, *resourcesOnly, *prettyPrint, *monitorMode, *checkInterval)
+	cfg := setupUnifiedConfig(*outputFile, *logFile, *waitTime, *healthOnly, *resourcesOnly, *prettyPrint, *monitorMode, *checkInterval, *metricsAddr)
 
 	// Setup logger
 	log := logger.New()
@@ -77,7 +80,7 @@ func main() {
 }
 
 // Setup unified configuration
-func setupUnifiedConfig(outputFile, logFile string, waitTime time.Duration, healthOnly, resourcesOnly, prettyPrint, monitorMode bool, checkInterval time.Duration) *UnifiedConfig {
+func setupUnifiedConfig(outputFile, logFile string, waitTime time.Duration, healthOnly, resourcesOnly, prettyPrint, monitorMode bool, checkInterval time.Duration, metricsAddr string) *UnifiedConfig {
 	// Generate default output file name if not provided
 	if outputFile == "" {
 		timestamp := time.Now().Format("20060102_150405")
@@ -106,6 +109,7 @@ func setupUnifiedConfig(outputFile, logFile string, waitTime time.Duration, heal
 		PrettyPrint:      prettyPrint,
 		MonitorMode:      monitorMode,
 		CheckInterval:    checkInterval,
+		MetricsAddr:      metricsAddr,
 	}
 }
 
@@ -144,6 +148,10 @@ func runCaptureMode(cfg *UnifiedConfig, log logger.Logger, resourceMonitor monit
 func runMonitoringMode(cfg *UnifiedConfig, log logger.Logger, resourceMonitor monitor.ResourceMonitor) {
 	log.Info("Running in monitoring mode...")
 
+	if cfg.MetricsAddr != "" {
+		metrics.Serve(cfg.MetricsAddr, log)
+	}
+
 	for {
 		// Capture current state
 		captureData(cfg, log, resourceMonitor)
@@ -331,6 +339,8 @@ func printHelp() {
 	fmt.Println("        Run in monitoring mode (continuous)")
 	fmt.Println("  -interval duration")
 	fmt.Println("        Check interval for monitoring mode (default: 30s)")
+	fmt.Println("  -metrics-addr string")
+	fmt.Println("        Address for the Prometheus /metrics endpoint in monitoring mode (default: :9100, empty disables)")
 	fmt.Println("  -help")
 	fmt.Println("        Show this help information")
 	fmt.Println()
@@ -0,0 +1,177 @@
+package controlplane
+
+import (
+	"net/url"
+	"time"
+
+	"k3s-local-agent/internal/k3s"
+)
+
+// Control plane API paths. api/openapi.yaml documents every endpoint and the request and
+// response types in this package mirror its schemas.
+const (
+	pathPing               = "/api/v1/ping"
+	pathHealth             = "/api/v1/health"
+	pathMonitoring         = "/api/v1/monitoring"
+	pathMonitoringBatch    = "/api/v1/monitoring/batch"
+	pathMonitoringSnapshot = "/api/v1/monitoring/snapshot"
+	pathScheduling         = "/api/v1/scheduling"
+	pathStagingStatus      = "/api/v1/staging/status"
+	pathRegister           = "/api/v1/register-local-agent"
+)
+
+// agentCommandsPath is polled for an agent's pending commands
+func agentCommandsPath(agentID string) string {
+	return "/api/v1/agents/" + url.PathEscape(agentID) + "/commands"
+}
+
+// commandResultPath acknowledges one command
+func commandResultPath(agentID, commandID string) string {
+	return agentCommandsPath(agentID) + "/" + url.PathEscape(commandID) + "/result"
+}
+
+// HealthCheck is posted to /api/v1/health
+type HealthCheck struct {
+	AgentID   string    `json:"agent_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Status    string    `json:"status"`
+	Version   string    `json:"version"`
+}
+
+// SchedulingReport is posted to /api/v1/scheduling
+type SchedulingReport struct {
+	AgentID   string                  `json:"agent_id"`
+	Timestamp time.Time               `json:"timestamp"`
+	Decision  *k3s.SchedulingDecision `json:"decision"`
+	Type      string                  `json:"type"` // Always "scheduling_decision"
+}
+
+// AgentRegistration is posted to /api/v1/register-local-agent when a staging agent starts
+type AgentRegistration struct {
+	Host          string            `json:"host"`     // Public URL of the pod receiver; empty on the command channel
+	Delivery      string            `json:"delivery"` // "push" or "command_channel"
+	AgentInfo     AgentInfo         `json:"agent_info"`
+	PodScheduling PodScheduling     `json:"pod_scheduling"`
+	Endpoints     map[string]string `json:"endpoints"` // Pod receiver paths by name
+	ClusterStatus string            `json:"cluster_status"`
+}
+
+// AgentInfo identifies a registering agent
+type AgentInfo struct {
+	AgentID   string    `json:"agent_id"`
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// PodScheduling describes what a registering agent runs and can run
+type PodScheduling struct {
+	CurrentPods   int                 `json:"current_pods"`
+	AvailablePods []StagingPodSummary `json:"available_pods"` // The agent's staging pods
+	Capabilities  AgentCapabilities   `json:"capabilities"`
+	Resources     AgentResources      `json:"resources"`
+	StagingConfig StagingSettings     `json:"staging_config"`
+}
+
+// AgentCapabilities lists the features a registering agent supports
+type AgentCapabilities struct {
+	StagingPods      bool `json:"staging_pods"`
+	KindCluster      bool `json:"kind_cluster"`
+	HTTPProxy        bool `json:"http_proxy"`
+	CloudflareTunnel bool `json:"cloudflare_tunnel"`
+	CommandChannel   bool `json:"command_channel"`
+	AutoScaling      bool `json:"auto_scaling"`
+}
+
+// AgentResources advertises the capacity available for staging pods
+type AgentResources struct {
+	CPUAvailable     string `json:"cpu_available"`
+	MemoryAvailable  string `json:"memory_available"`
+	StorageAvailable string `json:"storage_available"`
+	NetworkPorts     []int  `json:"network_ports"`
+}
+
+// StagingSettings describes how a registering agent runs staging pods
+type StagingSettings struct {
+	Namespace     string `json:"namespace"`
+	ClusterName   string `json:"cluster_name"`
+	SyncInterval  string `json:"sync_interval"`
+	AutoScale     bool   `json:"auto_scale"`
+	PodScheduling bool   `json:"pod_scheduling"`
+}
+
+// StagingStatusReport is posted to /api/v1/staging/status by a staging agent
+type StagingStatusReport struct {
+	AgentID           string                       `json:"agent_id"`
+	Status            string                       `json:"status"`
+	TotalPods         int                          `json:"total_pods"`
+	RunningPods       int                          `json:"running_pods"`
+	FailedPods        int                          `json:"failed_pods"`
+	StagingPods       map[string]StagingPodSummary `json:"staging_pods"` // By staging pod ID
+	StagingApps       map[string]StagingAppSummary `json:"staging_apps,omitempty"`
+	Deletions         []StagingDeletion            `json:"deletions,omitempty"` // Teardowns since the last accepted report
+	LastGC            *StagingGCReport             `json:"last_gc,omitempty"`
+	KindClusterStatus string                       `json:"kind_cluster_status"`
+	LastSync          time.Time                    `json:"last_sync"`
+	Timestamp         time.Time                    `json:"timestamp"`
+}
+
+// StagingPodSummary describes a staging pod and its state in the local kind cluster
+type StagingPodSummary struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Namespace     string    `json:"namespace"`
+	Image         string    `json:"image"`
+	Status        string    `json:"status"`
+	CPURequest    string    `json:"cpu_request"`
+	MemoryRequest string    `json:"memory_request"`
+	LocalStatus   string    `json:"local_status"` // "pending", "running", "failed", "completed", "not_created"
+	LocalMessage  string    `json:"local_message,omitempty"`
+	LocalIP       string    `json:"local_ip,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// StagingAppSummary describes an app bundle applied to the local kind cluster
+type StagingAppSummary struct {
+	ID             string               `json:"id"`
+	Name           string               `json:"name"`
+	Namespace      string               `json:"namespace"`
+	Resources      []StagingAppResource `json:"resources"`
+	Services       []string             `json:"services,omitempty"`
+	MissingSecrets []string             `json:"missing_secrets,omitempty"`
+	LocalStatus    string               `json:"local_status"` // "pending", "running", "failed"
+	LocalMessage   string               `json:"local_message,omitempty"`
+	AppliedAt      time.Time            `json:"applied_at"`
+	UpdatedAt      time.Time            `json:"updated_at"`
+}
+
+// StagingAppResource identifies an object applied as part of an app bundle
+type StagingAppResource struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// StagingDeletion reports the teardown of a staging pod
+type StagingDeletion struct {
+	StagingPodID       string    `json:"staging_pod_id"`
+	PodName            string    `json:"pod_name"`
+	Success            bool      `json:"success"`
+	PodDeleted         bool      `json:"pod_deleted"`
+	ProxyRemoved       bool      `json:"proxy_removed"`
+	RedirectionRemoved bool      `json:"redirection_removed"`
+	Errors             []string  `json:"errors,omitempty"`
+	DeletedAt          time.Time `json:"deleted_at"`
+}
+
+// StagingGCReport lists the resources a staging agent's garbage collector removed
+type StagingGCReport struct {
+	Trigger      string    `json:"trigger"` // "startup" or "shutdown"
+	DryRun       bool      `json:"dry_run"`
+	Pods         []string  `json:"pods,omitempty"`
+	AppResources []string  `json:"app_resources,omitempty"`
+	Proxies      []string  `json:"proxies,omitempty"`
+	Redirections []string  `json:"redirections,omitempty"`
+	Processes    []string  `json:"processes,omitempty"`
+	Errors       []string  `json:"errors,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
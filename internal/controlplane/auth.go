@@ -0,0 +1,337 @@
+package controlplane
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k3s-local-agent/pkg/logger"
+)
+
+const (
+	// Headers carried by HMAC-signed control plane requests
+	TimestampHeader = "X-Agent-Timestamp" // Unix seconds
+	NonceHeader     = "X-Agent-Nonce"     // Unique per request, rejected when seen twice
+	SignatureHeader = "X-Agent-Signature" // "sha256=" + hex HMAC of the signing string
+
+	defaultMaxClockSkew = 5 * time.Minute
+
+	// maxSignedBodySize bounds how much of a request body is buffered for signature checks
+	maxSignedBodySize = 32 << 20
+)
+
+// AuthConfig configures how the pod receiver authenticates the control plane.
+// When both tokens and an HMAC secret are configured, requests must pass both checks.
+type AuthConfig struct {
+	Tokens         []string      // Accepted bearer tokens
+	TokenFile      string        // File with one accepted token per line, re-read when it changes
+	HMACSecret     string        // Shared secret for signed request bodies
+	HMACSecretFile string        // File holding the HMAC secret, re-read when it changes
+	MaxClockSkew   time.Duration // Accepted timestamp drift for signed requests; defaults to 5 minutes
+}
+
+// Enabled reports whether any credential is configured
+func (config *AuthConfig) Enabled() bool {
+	return config != nil && (len(config.Tokens) > 0 || config.TokenFile != "" ||
+		config.HMACSecret != "" || config.HMACSecretFile != "")
+}
+
+// SigningString returns the bytes covered by a request signature
+func SigningString(timestamp, nonce, method, requestURI string, body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(timestamp + "\n" + nonce + "\n" + method + "\n" + requestURI + "\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// Sign computes the signature header value for a signing string
+func Sign(secret string, signingString []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(signingString)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest adds timestamp, nonce and signature headers to a request whose body is body
+func SignRequest(req *http.Request, body []byte, secret string) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceValue := hex.EncodeToString(nonce)
+
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonceValue)
+	req.Header.Set(SignatureHeader, Sign(secret, SigningString(timestamp, nonceValue, req.Method, req.URL.RequestURI(), body)))
+	return nil
+}
+
+// authenticator checks bearer tokens and request signatures on inbound control plane requests
+type authenticator struct {
+	tokens     []string
+	tokenFile  *fileSecret
+	secret     string
+	secretFile *fileSecret
+	maxSkew    time.Duration
+	nonces     map[string]time.Time // Seen nonce -> when it can be forgotten
+	logger     logger.Logger
+	mutex      sync.Mutex
+}
+
+// newAuthenticator validates the configuration and loads any key files once so mistakes fail at startup
+func newAuthenticator(config *AuthConfig, log logger.Logger) (*authenticator, error) {
+	if !config.Enabled() {
+		return nil, nil
+	}
+
+	a := &authenticator{
+		secret:  config.HMACSecret,
+		maxSkew: config.MaxClockSkew,
+		nonces:  make(map[string]time.Time),
+		logger:  log,
+	}
+	if a.maxSkew <= 0 {
+		a.maxSkew = defaultMaxClockSkew
+	}
+	for _, token := range config.Tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			a.tokens = append(a.tokens, token)
+		}
+	}
+
+	if config.TokenFile != "" {
+		a.tokenFile = &fileSecret{path: config.TokenFile}
+		if _, err := a.tokenFile.Get(); err != nil {
+			return nil, fmt.Errorf("failed to load token file: %w", err)
+		}
+	}
+	if config.HMACSecretFile != "" {
+		a.secretFile = &fileSecret{path: config.HMACSecretFile}
+		if _, err := a.secretFile.Get(); err != nil {
+			return nil, fmt.Errorf("failed to load HMAC secret file: %w", err)
+		}
+	}
+	return a, nil
+}
+
+// methods lists the checks every request must pass
+func (a *authenticator) methods() []string {
+	var methods []string
+	if len(a.tokens) > 0 || a.tokenFile != nil {
+		methods = append(methods, "bearer")
+	}
+	if a.secret != "" || a.secretFile != nil {
+		methods = append(methods, "hmac")
+	}
+	return methods
+}
+
+// wrap rejects requests that fail authentication, except on the health endpoint. Metrics stay
+// behind authentication because the pod receiver is published through the tunnel.
+func (a *authenticator) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err := a.authenticate(r); err != nil {
+			authFailures.Inc(err.reason)
+			a.logger.Warn("Rejected unauthenticated control plane request",
+				"remote_addr", r.RemoteAddr,
+				"forwarded_for", forwardedFor(r),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"reason", err.reason,
+				"error", err.err)
+			if len(a.tokens) > 0 || a.tokenFile != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="k3s-local-agent"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authError pairs a bounded metric label with the detailed cause
+type authError struct {
+	reason string
+	err    error
+}
+
+func (a *authenticator) authenticate(r *http.Request) *authError {
+	if len(a.tokens) > 0 || a.tokenFile != nil {
+		if err := a.checkToken(r); err != nil {
+			return err
+		}
+	}
+	if a.secret != "" || a.secretFile != nil {
+		if err := a.checkSignature(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkToken compares the bearer token against every accepted token in constant time
+func (a *authenticator) checkToken(r *http.Request) *authError {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return &authError{"missing_token", errors.New("no bearer token")}
+	}
+	token = strings.TrimSpace(token)
+
+	accepted := a.tokens
+	if a.tokenFile != nil {
+		value, err := a.tokenFile.Get()
+		if err != nil {
+			return &authError{"key_unavailable", err}
+		}
+		accepted = append(append([]string(nil), accepted...), parseTokens(value)...)
+	}
+
+	valid := false
+	for _, candidate := range accepted {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			valid = true
+		}
+	}
+	if !valid {
+		return &authError{"invalid_token", errors.New("bearer token not accepted")}
+	}
+	return nil
+}
+
+// checkSignature verifies the request signature, timestamp and nonce, restoring the body for the handler
+func (a *authenticator) checkSignature(r *http.Request) *authError {
+	timestamp := r.Header.Get(TimestampHeader)
+	nonce := r.Header.Get(NonceHeader)
+	signature := r.Header.Get(SignatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return &authError{"missing_signature", fmt.Errorf("%s, %s and %s are required", TimestampHeader, NonceHeader, SignatureHeader)}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return &authError{"invalid_timestamp", err}
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > a.maxSkew || skew < -a.maxSkew {
+		return &authError{"stale_timestamp", fmt.Errorf("timestamp is %s away from local time", skew.Round(time.Second))}
+	}
+
+	secret := a.secret
+	if a.secretFile != nil {
+		if secret, err = a.secretFile.Get(); err != nil {
+			return &authError{"key_unavailable", err}
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+	r.Body.Close()
+	if err != nil {
+		return &authError{"invalid_body", err}
+	}
+	if len(body) > maxSignedBodySize {
+		return &authError{"invalid_body", errors.New("request body too large")}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := Sign(secret, SigningString(timestamp, nonce, r.Method, r.URL.RequestURI(), body))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return &authError{"invalid_signature", errors.New("signature mismatch")}
+	}
+
+	// Nonces are only recorded for correctly signed requests, so callers without the key cannot fill the cache
+	if !a.rememberNonce(nonce, signedAt.Add(a.maxSkew)) {
+		return &authError{"replayed", errors.New("nonce already used")}
+	}
+	return nil
+}
+
+// rememberNonce records a nonce until it expires, returning false when it was already seen
+func (a *authenticator) rememberNonce(nonce string, expires time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	for seen, until := range a.nonces {
+		if now.After(until) {
+			delete(a.nonces, seen)
+		}
+	}
+	if _, exists := a.nonces[nonce]; exists {
+		return false
+	}
+	a.nonces[nonce] = expires
+	return true
+}
+
+// forwardedFor returns the client address reported by the tunnel or a reverse proxy, if any
+func forwardedFor(r *http.Request) string {
+	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
+		return ip
+	}
+	return r.Header.Get("X-Forwarded-For")
+}
+
+// parseTokens splits a token file into tokens, skipping blank lines and comments
+func parseTokens(value string) []string {
+	var tokens []string
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	return tokens
+}
+
+// fileSecret caches a key file, reloading it when its modification time changes so keys can be rotated
+type fileSecret struct {
+	path    string
+	modTime time.Time
+	value   string
+	mutex   sync.Mutex
+}
+
+// Get returns the trimmed file contents
+func (fs *fileSecret) Get() (string, error) {
+	info, err := os.Stat(fs.path)
+	if err != nil {
+		return "", err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.value != "" && info.ModTime().Equal(fs.modTime) {
+		return fs.value, nil
+	}
+
+	data, err := os.ReadFile(fs.path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("key file %s is empty", fs.path)
+	}
+
+	fs.value = value
+	fs.modTime = info.ModTime()
+	return value, nil
+}
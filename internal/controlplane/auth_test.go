@@ -0,0 +1,354 @@
+package controlplane
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"k3s-local-agent/pkg/logger"
+)
+
+const testSecret = "test-hmac-secret"
+
+// signedRequest builds a request signed at the given time with the given nonce
+func signedRequest(secret, method, target string, body []byte, signedAt time.Time, nonce string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, Sign(secret, SigningString(timestamp, nonce, method, req.URL.RequestURI(), body)))
+	return req
+}
+
+func newTestAuthenticator(t *testing.T, config *AuthConfig) *authenticator {
+	t.Helper()
+	a, err := newAuthenticator(config, logger.New())
+	if err != nil {
+		t.Fatalf("newAuthenticator: %v", err)
+	}
+	return a
+}
+
+func TestCheckToken(t *testing.T) {
+	a := newTestAuthenticator(t, &AuthConfig{Tokens: []string{"token-a", " token-b "}})
+
+	tests := []struct {
+		name          string
+		authorization string
+		reason        string // Empty when the request is accepted
+	}{
+		{"accepted", "Bearer token-a", ""},
+		{"trimmed configured token", "Bearer token-b", ""},
+		{"scheme is case-insensitive", "bearer token-a", ""},
+		{"missing header", "", "missing_token"},
+		{"wrong scheme", "Basic token-a", "missing_token"},
+		{"empty token", "Bearer  ", "missing_token"},
+		{"unknown token", "Bearer token-c", "invalid_token"},
+		{"prefix of a token", "Bearer token", "invalid_token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/v1/pods", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			assertAuthReason(t, a.checkToken(req), tt.reason)
+		})
+	}
+}
+
+func TestCheckTokenFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	writeKeyFile(t, path, "# comment\nold-token\n\n", time.Now().Add(-time.Hour))
+
+	a := newTestAuthenticator(t, &AuthConfig{Tokens: []string{"static"}, TokenFile: path})
+
+	check := func(token, reason string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/v1/pods", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		assertAuthReason(t, a.checkToken(req), reason)
+	}
+
+	check("old-token", "")
+	check("static", "")
+	check("# comment", "invalid_token")
+
+	// Rotating the file replaces its tokens but keeps the configured ones
+	writeKeyFile(t, path, "new-token\n", time.Now())
+	check("new-token", "")
+	check("old-token", "invalid_token")
+	check("static", "")
+
+	// A missing file fails closed rather than falling back to the configured tokens
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	check("static", "key_unavailable")
+}
+
+func TestNewAuthenticatorRejectsMissingKeyFiles(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	for _, config := range []*AuthConfig{{TokenFile: missing}, {HMACSecretFile: missing}} {
+		if _, err := newAuthenticator(config, logger.New()); err == nil {
+			t.Errorf("newAuthenticator(%+v) succeeded with a missing key file", config)
+		}
+	}
+
+	a, err := newAuthenticator(&AuthConfig{}, logger.New())
+	if err != nil || a != nil {
+		t.Errorf("newAuthenticator with no credentials = %v, %v; want nil, nil", a, err)
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"agent_id":"agent-1","pods":[]}`)
+
+	tests := []struct {
+		name   string
+		build  func() *http.Request
+		reason string
+	}{
+		{
+			name:  "valid",
+			build: func() *http.Request { return signedRequest(testSecret, "POST", "/api/v1/pods", body, now, "n-valid") },
+		},
+		{
+			name: "valid with query",
+			build: func() *http.Request {
+				return signedRequest(testSecret, "GET", "/api/v1/pods/status?full=1", nil, now, "n-query")
+			},
+		},
+		{
+			name: "within clock skew",
+			build: func() *http.Request {
+				return signedRequest(testSecret, "POST", "/api/v1/pods", body, now.Add(-4*time.Minute), "n-skew")
+			},
+		},
+		{
+			name: "missing headers",
+			build: func() *http.Request {
+				return httptest.NewRequest("POST", "/api/v1/pods", bytes.NewReader(body))
+			},
+			reason: "missing_signature",
+		},
+		{
+			name: "invalid timestamp",
+			build: func() *http.Request {
+				req := signedRequest(testSecret, "POST", "/api/v1/pods", body, now, "n-ts")
+				req.Header.Set(TimestampHeader, "yesterday")
+				return req
+			},
+			reason: "invalid_timestamp",
+		},
+		{
+			name: "timestamp too old",
+			build: func() *http.Request {
+				return signedRequest(testSecret, "POST", "/api/v1/pods", body, now.Add(-6*time.Minute), "n-old")
+			},
+			reason: "stale_timestamp",
+		},
+		{
+			name: "timestamp in the future",
+			build: func() *http.Request {
+				return signedRequest(testSecret, "POST", "/api/v1/pods", body, now.Add(6*time.Minute), "n-future")
+			},
+			reason: "stale_timestamp",
+		},
+		{
+			name: "wrong secret",
+			build: func() *http.Request {
+				return signedRequest("other-secret", "POST", "/api/v1/pods", body, now, "n-secret")
+			},
+			reason: "invalid_signature",
+		},
+		{
+			name: "tampered body",
+			build: func() *http.Request {
+				req := signedRequest(testSecret, "POST", "/api/v1/pods", body, now, "n-body")
+				req.Body = io.NopCloser(strings.NewReader(`{"agent_id":"agent-2","pods":[]}`))
+				return req
+			},
+			reason: "invalid_signature",
+		},
+		{
+			name: "tampered path",
+			build: func() *http.Request {
+				req := signedRequest(testSecret, "POST", "/api/v1/pods", body, now, "n-path")
+				req.URL.Path = "/api/v1/apps"
+				req.RequestURI = "/api/v1/apps"
+				return req
+			},
+			reason: "invalid_signature",
+		},
+		{
+			name: "tampered method",
+			build: func() *http.Request {
+				req := signedRequest(testSecret, "POST", "/api/v1/pods", body, now, "n-method")
+				req.Method = "DELETE"
+				return req
+			},
+			reason: "invalid_signature",
+		},
+		{
+			name: "tampered nonce",
+			build: func() *http.Request {
+				req := signedRequest(testSecret, "POST", "/api/v1/pods", body, now, "n-nonce")
+				req.Header.Set(NonceHeader, "n-other")
+				return req
+			},
+			reason: "invalid_signature",
+		},
+		{
+			name: "oversized body",
+			build: func() *http.Request {
+				req := signedRequest(testSecret, "POST", "/api/v1/pods", nil, now, "n-large")
+				req.Body = io.NopCloser(io.LimitReader(zeroReader{}, maxSignedBodySize+1))
+				return req
+			},
+			reason: "invalid_body",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAuthenticator(t, &AuthConfig{HMACSecret: testSecret})
+			assertAuthReason(t, a.checkSignature(tt.build()), tt.reason)
+		})
+	}
+}
+
+func TestCheckSignatureRestoresBody(t *testing.T) {
+	a := newTestAuthenticator(t, &AuthConfig{HMACSecret: testSecret})
+	body := []byte(`{"agent_id":"agent-1"}`)
+
+	req := signedRequest(testSecret, "POST", "/api/v1/pods", body, time.Now(), "n-restore")
+	assertAuthReason(t, a.checkSignature(req), "")
+
+	got, err := io.ReadAll(req.Body)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Errorf("body after check = %q, %v; want %q", got, err, body)
+	}
+}
+
+func TestNonceReplay(t *testing.T) {
+	a := newTestAuthenticator(t, &AuthConfig{HMACSecret: testSecret})
+	now := time.Now()
+	body := []byte(`{}`)
+
+	assertAuthReason(t, a.checkSignature(signedRequest(testSecret, "POST", "/api/v1/pods", body, now, "n-1")), "")
+	assertAuthReason(t, a.checkSignature(signedRequest(testSecret, "POST", "/api/v1/pods", body, now, "n-1")), "replayed")
+	assertAuthReason(t, a.checkSignature(signedRequest(testSecret, "POST", "/api/v1/pods", body, now, "n-2")), "")
+
+	// A badly signed request must not burn the nonce of a later valid one
+	assertAuthReason(t, a.checkSignature(signedRequest("wrong", "POST", "/api/v1/pods", body, now, "n-3")), "invalid_signature")
+	assertAuthReason(t, a.checkSignature(signedRequest(testSecret, "POST", "/api/v1/pods", body, now, "n-3")), "")
+}
+
+func TestRememberNonceExpiry(t *testing.T) {
+	a := newTestAuthenticator(t, &AuthConfig{HMACSecret: testSecret})
+
+	if !a.rememberNonce("expired", time.Now().Add(-time.Second)) {
+		t.Fatal("first use of a nonce was rejected")
+	}
+	if !a.rememberNonce("other", time.Now().Add(time.Minute)) {
+		t.Fatal("first use of a nonce was rejected")
+	}
+
+	// Expired nonces are forgotten so the cache stays bounded by the skew window
+	if _, exists := a.nonces["expired"]; exists {
+		t.Error("expired nonce was kept")
+	}
+	if a.rememberNonce("other", time.Now().Add(time.Minute)) {
+		t.Error("live nonce was accepted twice")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	a := newTestAuthenticator(t, &AuthConfig{Tokens: []string{"token-a"}, HMACSecret: testSecret})
+	handler := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	body := []byte(`{}`)
+	withToken := func(req *http.Request) *http.Request {
+		req.Header.Set("Authorization", "Bearer token-a")
+		return req
+	}
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"health is open", httptest.NewRequest("GET", "/health", nil), http.StatusNoContent},
+		{"metrics need credentials", httptest.NewRequest("GET", "/metrics", nil), http.StatusUnauthorized},
+		{"metrics with credentials", withToken(signedRequest(testSecret, "GET", "/metrics", nil, time.Now(), "m-1")), http.StatusNoContent},
+		{"token and signature", withToken(signedRequest(testSecret, "POST", "/api/v1/pods", body, time.Now(), "w-1")), http.StatusNoContent},
+		{"token without signature", withToken(httptest.NewRequest("POST", "/api/v1/pods", nil)), http.StatusUnauthorized},
+		{"signature without token", signedRequest(testSecret, "POST", "/api/v1/pods", body, time.Now(), "w-2"), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, tt.req)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestSignRequestVerifies(t *testing.T) {
+	a := newTestAuthenticator(t, &AuthConfig{HMACSecret: testSecret})
+	body := []byte(`{"agent_id":"agent-1"}`)
+
+	req := httptest.NewRequest("POST", "/api/v1/apps?dry_run=true", bytes.NewReader(body))
+	if err := SignRequest(req, body, testSecret); err != nil {
+		t.Fatal(err)
+	}
+	assertAuthReason(t, a.checkSignature(req), "")
+}
+
+func assertAuthReason(t *testing.T, err *authError, reason string) {
+	t.Helper()
+	switch {
+	case reason == "" && err != nil:
+		t.Errorf("rejected with %s: %v", err.reason, err.err)
+	case reason != "" && err == nil:
+		t.Errorf("accepted, want rejection with %s", reason)
+	case reason != "" && err.reason != reason:
+		t.Errorf("rejected with %s (%v), want %s", err.reason, err.err, reason)
+	}
+}
+
+func writeKeyFile(t *testing.T, path, content string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
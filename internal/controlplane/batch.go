@@ -0,0 +1,213 @@
+package controlplane
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k3s-local-agent/internal/k3s"
+	"k3s-local-agent/internal/monitor"
+)
+
+const (
+	defaultBatchSize   = 10
+	defaultBatchMaxAge = 5 * time.Minute
+)
+
+// BatchConfig enables batched monitoring uploads
+type BatchConfig struct {
+	MaxSamples int           // Samples collected before a batch is sent; defaults to 10
+	MaxAge     time.Duration // Longest the oldest sample waits before its batch is sent; defaults to 5 minutes
+}
+
+// MonitoringSample is one monitoring tick in a batch. The local system data is carried once
+// instead of both at the top level and inside the cluster data.
+type MonitoringSample struct {
+	Timestamp     time.Time              `json:"timestamp"`
+	LocalSystem   *monitor.ResourceData  `json:"local_system"`
+	ClusterHealth map[string]interface{} `json:"cluster_health"`
+	NodeMetrics   []k3s.NodeMetrics      `json:"node_metrics"`
+	PodMetrics    []k3s.PodMetrics       `json:"pod_metrics"`
+}
+
+// MonitoringBatch is the gzip-compressed body posted to /api/v1/monitoring/batch
+type MonitoringBatch struct {
+	AgentID     string             `json:"agent_id"`
+	AgentStatus string             `json:"agent_status"`
+	CreatedAt   time.Time          `json:"created_at"`
+	Samples     []MonitoringSample `json:"samples"`
+}
+
+// batcher accumulates samples until the batch is full or its oldest sample is too old
+type batcher struct {
+	maxSamples int
+	maxAge     time.Duration
+	samples    []MonitoringSample
+	generation uint64 // Numbers the pending batch; bumped each time a batch is taken
+	timer      *time.Timer
+	mutex      sync.Mutex
+}
+
+func newBatcher(config *BatchConfig) *batcher {
+	b := &batcher{
+		maxSamples: config.MaxSamples,
+		maxAge:     config.MaxAge,
+	}
+	if b.maxSamples <= 0 {
+		b.maxSamples = defaultBatchSize
+	}
+	if b.maxAge <= 0 {
+		b.maxAge = defaultBatchMaxAge
+	}
+	return b
+}
+
+// add appends a sample, arming the age timer for the first sample of a batch. The timer calls
+// onAge with the generation of the batch it was armed for. It returns true when the batch is full.
+func (b *batcher) add(sample MonitoringSample, onAge func(generation uint64)) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.samples = append(b.samples, sample)
+	if len(b.samples) == 1 {
+		generation := b.generation
+		b.timer = time.AfterFunc(b.maxAge, func() { onAge(generation) })
+	}
+	return len(b.samples) >= b.maxSamples
+}
+
+// take removes and returns the pending samples
+func (b *batcher) take() []MonitoringSample {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.takeLocked()
+}
+
+// takeGeneration removes and returns the pending samples only while generation is still the
+// pending batch; an age timer that fires after its batch was sent finds nothing to take
+func (b *batcher) takeGeneration(generation uint64) []MonitoringSample {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if generation != b.generation {
+		return nil
+	}
+	return b.takeLocked()
+}
+
+func (b *batcher) takeLocked() []MonitoringSample {
+	b.generation++
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	samples := b.samples
+	b.samples = nil
+	return samples
+}
+
+// newSample converts K3s resource data into a batch sample
+func newSample(k3sData *monitor.K3sResourceData) MonitoringSample {
+	timestamp := k3sData.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	return MonitoringSample{
+		Timestamp:     timestamp,
+		LocalSystem:   k3sData.LocalSystem,
+		ClusterHealth: k3sData.ClusterHealth,
+		NodeMetrics:   k3sData.NodeMetrics,
+		PodMetrics:    k3sData.PodMetrics,
+	}
+}
+
+// addSample buffers monitoring data, sending the batch once it is full
+func (c *ControlPlaneClient) addSample(k3sData *monitor.K3sResourceData) error {
+	if !c.batch.add(newSample(k3sData), c.flushOnAge) {
+		c.logger.Debug("Buffered monitoring sample for the next batch")
+		return nil
+	}
+	return c.Flush()
+}
+
+// flushOnAge sends a batch whose oldest sample reached the age limit, unless that batch was
+// already sent because it filled up
+func (c *ControlPlaneClient) flushOnAge(generation uint64) {
+	if err := c.sendSamples(c.batch.takeGeneration(generation)); err != nil && !errors.Is(err, ErrQueued) {
+		c.logger.Error("Failed to send monitoring batch", "error", err)
+	}
+}
+
+// Flush sends any pending batched samples. Like SendMonitoringData, it buffers the batch on disk
+// and returns an error wrapping ErrQueued when the control plane is unreachable or refuses the
+// agent's credentials.
+func (c *ControlPlaneClient) Flush() (err error) {
+	if c.batch == nil {
+		return nil
+	}
+	return c.sendSamples(c.batch.take())
+}
+
+// sendSamples sends one batch of samples, buffering it on disk when it cannot be delivered
+func (c *ControlPlaneClient) sendSamples(samples []MonitoringSample) (err error) {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	defer func(start time.Time) { RecordCall("monitoring_batch", start, err) }(time.Now())
+
+	payload, err := encodeBatch(&MonitoringBatch{
+		AgentID:     c.agentID,
+		AgentStatus: "healthy",
+		CreatedAt:   time.Now(),
+		Samples:     samples,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode monitoring batch: %w", err)
+	}
+
+	if err := c.drainQueue(); err != nil {
+		return c.enqueue(payload, entryBatch, err)
+	}
+
+	if err := c.sendBatchPayload(payload); err != nil {
+		if !payloadRejected(err) {
+			return c.enqueue(payload, entryBatch, err)
+		}
+		return err
+	}
+
+	c.logger.Info("Successfully sent monitoring batch to control plane",
+		"agent_id", c.agentID,
+		"samples", len(samples),
+		"bytes", len(payload))
+	return nil
+}
+
+// encodeBatch marshals and gzip-compresses a batch
+func encodeBatch(batch *MonitoringBatch) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(batch); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendBatchPayload delivers one compressed MonitoringBatch
+func (c *ControlPlaneClient) sendBatchPayload(payload []byte) error {
+	header := http.Header{"Content-Encoding": []string{"gzip"}}
+	respBody, err := c.deliver("monitoring_batch", "POST", pathMonitoringBatch, payload, header)
+	if err != nil {
+		return err
+	}
+	return c.checkResponse(pathMonitoringBatch, respBody)
+}
@@ -0,0 +1,81 @@
+package controlplane
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatcherFull(t *testing.T) {
+	b := newBatcher(&BatchConfig{MaxSamples: 3, MaxAge: time.Hour})
+	noop := func(uint64) {}
+
+	for i, wantFull := range []bool{false, false, true} {
+		if full := b.add(MonitoringSample{}, noop); full != wantFull {
+			t.Errorf("add %d full = %t, want %t", i, full, wantFull)
+		}
+	}
+	if samples := b.take(); len(samples) != 3 {
+		t.Errorf("take = %d samples, want 3", len(samples))
+	}
+	if samples := b.take(); len(samples) != 0 {
+		t.Errorf("second take = %d samples, want 0", len(samples))
+	}
+}
+
+func TestBatcherStaleAgeTimer(t *testing.T) {
+	b := newBatcher(&BatchConfig{MaxSamples: 2, MaxAge: time.Hour})
+
+	var armed []uint64
+	onAge := func(generation uint64) {}
+	record := func(sample MonitoringSample) {
+		b.mutex.Lock()
+		first := len(b.samples) == 0
+		generation := b.generation
+		b.mutex.Unlock()
+		b.add(sample, onAge)
+		if first {
+			armed = append(armed, generation)
+		}
+	}
+
+	// The first batch fills and is taken; its age timer may still fire afterwards
+	record(MonitoringSample{})
+	record(MonitoringSample{})
+	b.take()
+
+	// The first sample of the next batch must not be sent by the old timer
+	record(MonitoringSample{})
+	if samples := b.takeGeneration(armed[0]); samples != nil {
+		t.Errorf("stale timer took %d samples, want none", len(samples))
+	}
+	b.mutex.Lock()
+	pending, timer := len(b.samples), b.timer
+	b.mutex.Unlock()
+	if pending != 1 || timer == nil {
+		t.Fatalf("pending = %d, timer armed = %t; want the next batch untouched", pending, timer != nil)
+	}
+
+	// The next batch's own timer still sends it
+	if samples := b.takeGeneration(armed[1]); len(samples) != 1 {
+		t.Errorf("current timer took %d samples, want 1", len(samples))
+	}
+}
+
+func TestBatcherAgeTimerFires(t *testing.T) {
+	b := newBatcher(&BatchConfig{MaxSamples: 10, MaxAge: 10 * time.Millisecond})
+
+	fired := make(chan []MonitoringSample, 1)
+	b.add(MonitoringSample{}, func(generation uint64) {
+		fired <- b.takeGeneration(generation)
+	})
+	b.add(MonitoringSample{}, func(uint64) { t.Error("timer armed for a sample that was not the first") })
+
+	select {
+	case samples := <-fired:
+		if len(samples) != 2 {
+			t.Errorf("age flush took %d samples, want 2", len(samples))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("age timer did not fire")
+	}
+}
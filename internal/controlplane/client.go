@@ -1,31 +1,57 @@
 package controlplane
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"k3s-local-agent/internal/k3s"
 	"k3s-local-agent/internal/monitor"
 	"k3s-local-agent/pkg/logger"
 )
 
 type ControlPlaneClient struct {
-	baseURL string
-	apiKey  string
-	client  *http.Client
-	logger  logger.Logger
-	agentID string
+	baseURL   string
+	apiKey    string
+	client    *http.Client
+	logger    logger.Logger
+	agentID   string
+	retry     RetryPolicy
+	queue     *diskQueue    // Buffers monitoring payloads while the control plane is unreachable; nil disables
+	batch     *batcher      // Accumulates monitoring samples into batches; nil sends each sample directly
+	delta     *deltaTracker // Sends delta-encoded cluster snapshots instead of monitoring data; nil disables
+	drainLock sync.Mutex
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+
+	// Outcome of the most recent requests, for GetStatus
+	lastSuccess time.Time
+	lastError   *ControlPlaneError
+	lastErrorAt time.Time
+	statusMutex sync.Mutex
 }
 
 type ControlPlaneConfig struct {
-	BaseURL string
-	APIKey  string
-	AgentID string
-	Timeout time.Duration
+	BaseURL   string
+	APIKey    string
+	AgentID   string
+	Timeout   time.Duration
+	TLS       *TLSConfig   // Client certificate and CA bundle for mutual TLS; nil uses plain TLS settings
+	Retry     *RetryPolicy // Nil uses DefaultRetryPolicy
+	QueueDir  string       // Directory buffering monitoring payloads while offline; empty disables buffering
+	QueueSize int          // Maximum buffered payloads before the oldest are dropped; defaults to 500
+	Batch     *BatchConfig // Nil sends every monitoring sample on its own
+	Delta     *DeltaConfig // Send cluster snapshots with deltas instead of monitoring data; excludes Batch
 }
 
+// ErrQueued is returned, wrapped with the delivery error, when a payload was buffered for later delivery
+var ErrQueued = errors.New("control plane delivery failed, payload queued for later delivery")
+
 type MonitoringData struct {
 	AgentID     string                   `json:"agent_id"`
 	Timestamp   time.Time                `json:"timestamp"`
@@ -40,25 +66,89 @@ type ControlPlaneResponse struct {
 	Data    interface{} `json:"data,omitempty"`
 }
 
-func NewControlPlaneClient(config *ControlPlaneConfig, log logger.Logger) *ControlPlaneClient {
+func NewControlPlaneClient(config *ControlPlaneConfig, log logger.Logger) (*ControlPlaneClient, error) {
+	if config.Batch != nil && config.Delta != nil {
+		return nil, errors.New("batched uploads and delta snapshots cannot be combined")
+	}
+
 	timeout := config.Timeout
 	if timeout == 0 {
 		timeout = 30 * time.Second
 	}
 
-	return &ControlPlaneClient{
-		baseURL: config.BaseURL,
+	transport, err := newTransport(config.TLS, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure control plane TLS: %w", err)
+	}
+
+	retry := DefaultRetryPolicy()
+	if config.Retry != nil {
+		retry = *config.Retry
+	}
+
+	c := &ControlPlaneClient{
+		baseURL: strings.TrimSuffix(config.BaseURL, "/"),
 		apiKey:  config.APIKey,
 		client: &http.Client{
-			Timeout: timeout,
+			Timeout:   timeout,
+			Transport: transport,
 		},
 		logger:  log,
 		agentID: config.AgentID,
+		retry:   retry,
+		stopCh:  make(chan struct{}),
+	}
+	if config.Batch != nil {
+		c.batch = newBatcher(config.Batch)
+	}
+	if config.Delta != nil {
+		c.delta = newDeltaTracker(config.Delta)
+	}
+
+	if config.QueueDir != "" {
+		queue, err := newDiskQueue(config.QueueDir, config.QueueSize)
+		if err != nil {
+			return nil, err
+		}
+		c.queue = queue
+		queueDepth.Set(float64(queue.len()))
+		if pending := queue.len(); pending > 0 {
+			log.Info("Found buffered monitoring data from a previous run", "queued", pending)
+		}
+	}
+	return c, nil
+}
+
+// Close stops waiting on retries, so calls in progress return their last error, and makes a
+// final attempt to send any pending batch
+func (c *ControlPlaneClient) Close() error {
+	c.stopOnce.Do(func() { close(c.stopCh) })
+	return c.Flush()
+}
+
+// QueuedPayloads returns the number of monitoring payloads waiting for delivery
+func (c *ControlPlaneClient) QueuedPayloads() int {
+	if c.queue == nil {
+		return 0
 	}
+	return c.queue.len()
 }
 
-// SendMonitoringData sends monitoring data to the control plane
-func (c *ControlPlaneClient) SendMonitoringData(k3sData *monitor.K3sResourceData) error {
+// SendMonitoringData sends monitoring data to the control plane, after any buffered payloads.
+// When the control plane is unreachable or refuses the agent's credentials, the payload is buffered
+// and an error wrapping ErrQueued is returned.
+// In batching mode the data is added to the pending batch, which is sent once full or old enough;
+// in delta mode it is sent as a cluster snapshot.
+func (c *ControlPlaneClient) SendMonitoringData(k3sData *monitor.K3sResourceData) (err error) {
+	if c.batch != nil {
+		return c.addSample(k3sData)
+	}
+	if c.delta != nil {
+		return c.sendSnapshot(k3sData)
+	}
+
+	defer func(start time.Time) { RecordCall("monitoring", start, err) }(time.Now())
+
 	data := &MonitoringData{
 		AgentID:     c.agentID,
 		Timestamp:   time.Now(),
@@ -72,138 +162,256 @@ func (c *ControlPlaneClient) SendMonitoringData(k3sData *monitor.K3sResourceData
 		return fmt.Errorf("failed to marshal monitoring data: %w", err)
 	}
 
-	// Send to control plane
-	url := fmt.Sprintf("%s/api/v1/monitoring", c.baseURL)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+	// Older payloads go first so the control plane sees them in order
+	if err := c.drainQueue(); err != nil {
+		return c.enqueue(jsonData, entryMonitoring, err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
-	req.Header.Set("X-Agent-ID", c.agentID)
-
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+	if err := c.sendMonitoringPayload(jsonData); err != nil {
+		if !payloadRejected(err) {
+			return c.enqueue(jsonData, entryMonitoring, err)
+		}
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("control plane returned status: %d", resp.StatusCode)
+	c.logger.Info("Successfully sent monitoring data to control plane",
+		"agent_id", c.agentID,
+		"timestamp", data.Timestamp)
+
+	return nil
+}
+
+// sendMonitoringPayload delivers one encoded MonitoringData payload
+func (c *ControlPlaneClient) sendMonitoringPayload(payload []byte) error {
+	respBody, err := c.deliver("monitoring", "POST", pathMonitoring, payload, nil)
+	if err != nil {
+		return err
 	}
+	return c.checkResponse(pathMonitoring, respBody)
+}
 
+// checkResponse decodes the ControlPlaneResponse to a POST on path and reports an unsuccessful one
+// as a rejected *ControlPlaneError
+func (c *ControlPlaneClient) checkResponse(path string, respBody []byte) error {
 	var response ControlPlaneResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+	if err := json.Unmarshal(respBody, &response); err != nil {
 		return fmt.Errorf("failed to decode response: %w", err)
 	}
 
 	if !response.Success {
-		return fmt.Errorf("control plane error: %s", response.Message)
+		return c.recordError(newRejectedError("POST", path, response.Message))
 	}
-
-	c.logger.Info("Successfully sent monitoring data to control plane",
-		"agent_id", c.agentID,
-		"timestamp", data.Timestamp)
-
 	return nil
 }
 
-// SendHealthCheck sends a simple health check to the control plane
-func (c *ControlPlaneClient) SendHealthCheck() error {
-	data := map[string]interface{}{
-		"agent_id":  c.agentID,
-		"timestamp": time.Now(),
-		"status":    "healthy",
-		"version":   "1.0.0",
+// sendQueued delivers a buffered payload to the endpoint matching its kind
+func (c *ControlPlaneClient) sendQueued(name string, payload []byte) error {
+	if entryKind(name) == entryBatch {
+		return c.sendBatchPayload(payload)
 	}
+	return c.sendMonitoringPayload(payload)
+}
 
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("failed to marshal health check data: %w", err)
+// drainQueue delivers buffered payloads oldest first, stopping at the first failure that is not
+// specific to the payload. Payloads the control plane rejects as invalid are dropped so they
+// cannot block the queue; auth failures and missing endpoints keep every payload for later.
+func (c *ControlPlaneClient) drainQueue() error {
+	if c.queue == nil {
+		return nil
 	}
 
-	url := fmt.Sprintf("%s/api/v1/health", c.baseURL)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create health check request: %w", err)
+	c.drainLock.Lock()
+	defer c.drainLock.Unlock()
+
+	delivered := 0
+	defer func() {
+		queueDepth.Set(float64(c.queue.len()))
+		if delivered > 0 {
+			c.logger.Info("Delivered buffered monitoring data", "delivered", delivered, "remaining", c.queue.len())
+		}
+	}()
+
+	for {
+		name, payload, ok, err := c.queue.peek()
+		if err != nil {
+			c.logger.Error("Dropping unreadable buffered payload", "entry", name, "error", err)
+			c.queue.remove(name)
+			continue
+		}
+		if !ok {
+			return nil
+		}
+
+		if err := c.sendQueued(name, payload); err != nil {
+			if !payloadRejected(err) {
+				return err
+			}
+			c.logger.Error("Control plane rejected buffered payload, dropping it", "entry", name, "error", err)
+		} else {
+			delivered++
+		}
+		if err := c.queue.remove(name); err != nil {
+			return fmt.Errorf("failed to remove delivered payload: %w", err)
+		}
 	}
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
-	req.Header.Set("X-Agent-ID", c.agentID)
+// payloadRejected reports whether a delivery failed because of the payload itself, so sending it
+// again can never succeed: a "success": false reply or a 4xx response. Credential failures, a
+// missing endpoint and the 4xx statuses that ask the agent to retry later leave the payload
+// deliverable, as do outages and 5xx responses.
+func payloadRejected(err error) bool {
+	var cpErr *ControlPlaneError
+	if !errors.As(err, &cpErr) {
+		// The control plane answered 2xx with a body that could not be decoded
+		return true
+	}
+	switch cpErr.StatusCode {
+	case http.StatusOK:
+		return true
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	default:
+		return cpErr.StatusCode >= 400 && cpErr.StatusCode < 500
+	}
+}
 
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send health check: %w", err)
+// enqueue buffers a payload of the given kind after a delivery failure that was not specific to it
+func (c *ControlPlaneClient) enqueue(payload []byte, kind string, cause error) error {
+	if c.queue == nil {
+		return cause
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("health check failed with status: %d", resp.StatusCode)
+	dropped, err := c.queue.push(payload, kind)
+	if err != nil {
+		c.logger.Error("Failed to buffer monitoring data", "error", err)
+		return cause
+	}
+	queueDepth.Set(float64(c.queue.len()))
+	if dropped > 0 {
+		c.logger.Warn("Monitoring buffer full, dropped oldest payloads", "dropped", dropped)
 	}
 
-	c.logger.Info("Health check sent successfully", "agent_id", c.agentID)
-	return nil
+	c.logger.Warn("Failed to deliver monitoring data, buffered it", "queued", c.queue.len(), "kind", ErrorKind(cause), "error", cause)
+	return fmt.Errorf("%w: %w", ErrQueued, cause)
 }
 
-// SendSchedulingDecision sends pod scheduling decisions to the control plane
-func (c *ControlPlaneClient) SendSchedulingDecision(decision interface{}) error {
-	data := map[string]interface{}{
-		"agent_id":  c.agentID,
-		"timestamp": time.Now(),
-		"decision":  decision,
-		"type":      "scheduling_decision",
+// recordSuccess notes that the control plane answered a request
+func (c *ControlPlaneClient) recordSuccess() {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+	c.lastSuccess = time.Now()
+}
+
+// recordError keeps the most recent failure for GetStatus and returns it; requests cancelled
+// by the agent itself are not failures of the control plane
+func (c *ControlPlaneClient) recordError(err *ControlPlaneError) *ControlPlaneError {
+	if errors.Is(err, context.Canceled) {
+		return err
 	}
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+	c.lastError = err
+	c.lastErrorAt = time.Now()
+	return err
+}
 
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("failed to marshal scheduling decision: %w", err)
+// GetStatus describes the connection to the control plane, including the most recent error so
+// authentication failures can be told from outages
+func (c *ControlPlaneClient) GetStatus() map[string]interface{} {
+	c.statusMutex.Lock()
+	defer c.statusMutex.Unlock()
+
+	// An error response still means the control plane is up; only a missing response is an outage
+	reachable := !c.lastSuccess.IsZero() && c.lastSuccess.After(c.lastErrorAt)
+	if c.lastError != nil && c.lastError.StatusCode != 0 {
+		reachable = true
 	}
 
-	url := fmt.Sprintf("%s/api/v1/scheduling", c.baseURL)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create scheduling request: %w", err)
+	status := map[string]interface{}{
+		"url":             c.baseURL,
+		"reachable":       reachable,
+		"queued_payloads": c.QueuedPayloads(),
+	}
+	if !c.lastSuccess.IsZero() {
+		status["last_success"] = c.lastSuccess
+	}
+	if c.lastError != nil {
+		status["last_error"] = c.lastError
+		status["last_error_message"] = c.lastError.Error()
+		status["last_error_at"] = c.lastErrorAt
 	}
+	return status
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
-	req.Header.Set("X-Agent-ID", c.agentID)
+// SendHealthCheck sends a simple health check to the control plane
+func (c *ControlPlaneClient) SendHealthCheck() (err error) {
+	defer func(start time.Time) { RecordCall("health_check", start, err) }(time.Now())
+
+	check := &HealthCheck{
+		AgentID:   c.agentID,
+		Timestamp: time.Now(),
+		Status:    "healthy",
+		Version:   "1.0.0",
+	}
 
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send scheduling decision: %w", err)
+	if err := c.post("health_check", pathHealth, check); err != nil {
+		return fmt.Errorf("failed to send health check: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("scheduling decision failed with status: %d", resp.StatusCode)
+	c.logger.Info("Health check sent successfully", "agent_id", c.agentID)
+	return nil
+}
+
+// SendSchedulingDecision sends pod scheduling decisions to the control plane
+func (c *ControlPlaneClient) SendSchedulingDecision(decision *k3s.SchedulingDecision) (err error) {
+	defer func(start time.Time) { RecordCall("scheduling_decision", start, err) }(time.Now())
+
+	report := &SchedulingReport{
+		AgentID:   c.agentID,
+		Timestamp: time.Now(),
+		Decision:  decision,
+		Type:      "scheduling_decision",
+	}
+
+	if err := c.post("scheduling_decision", pathScheduling, report); err != nil {
+		return fmt.Errorf("failed to send scheduling decision: %w", err)
 	}
 
 	c.logger.Info("Scheduling decision sent successfully", "agent_id", c.agentID)
 	return nil
 }
 
-// TestConnection tests the connection to the control plane
-func (c *ControlPlaneClient) TestConnection() error {
-	url := fmt.Sprintf("%s/api/v1/ping", c.baseURL)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create ping request: %w", err)
-	}
+// SendStagingStatus reports a staging agent's status
+func (c *ControlPlaneClient) SendStagingStatus(status *StagingStatusReport) (err error) {
+	defer func(start time.Time) { RecordCall("staging_status", start, err) }(time.Now())
+	return c.post("staging_status", pathStagingStatus, status)
+}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
-	req.Header.Set("X-Agent-ID", c.agentID)
+// Register announces a staging agent and how the control plane can reach it
+func (c *ControlPlaneClient) Register(registration *AgentRegistration) (err error) {
+	defer func(start time.Time) { RecordCall("register", start, err) }(time.Now())
+	return c.post("register", pathRegister, registration)
+}
 
-	resp, err := c.client.Do(req)
+// post marshals a request body and delivers it with retries; any 2xx response is accepted
+func (c *ControlPlaneClient) post(operation, path string, request interface{}) error {
+	jsonData, err := json.Marshal(request)
 	if err != nil {
-		return fmt.Errorf("failed to ping control plane: %w", err)
+		return fmt.Errorf("failed to marshal %s request: %w", operation, err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("ping failed with status: %d", resp.StatusCode)
+	_, err = c.deliver(operation, "POST", path, jsonData, nil)
+	return err
+}
+
+// TestConnection tests the connection to the control plane with a single attempt
+func (c *ControlPlaneClient) TestConnection() (err error) {
+	defer func(start time.Time) { RecordCall("ping", start, err) }(time.Now())
+
+	if _, err := c.attempt("GET", pathPing, nil, nil); err != nil {
+		return fmt.Errorf("failed to ping control plane: %w", err)
 	}
 
 	c.logger.Info("Control plane connection test successful", "agent_id", c.agentID)
@@ -0,0 +1,324 @@
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"k3s-local-agent/pkg/logger"
+)
+
+const (
+	defaultCommandWait = 30 * time.Second
+
+	// pollGrace is how long past the long-poll wait a poll may take before it is abandoned
+	pollGrace = 15 * time.Second
+
+	// maxCompletedCommands bounds the results kept to answer redelivered commands
+	maxCompletedCommands = 256
+)
+
+// Command types sent over the command channel
+const (
+	CommandPods               = "pods"                // Payload is a PodUpdateRequest
+	CommandApps               = "apps"                // Payload is an AppUpdateRequest
+	CommandScheduleWorkload   = "schedule_workload"   // Payload is a ScheduleWorkloadRequest
+	CommandCollectDiagnostics = "collect_diagnostics" // No payload
+	CommandResync             = "resync"              // No payload
+)
+
+// Command is an instruction the control plane queued for this agent
+type Command struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	IssuedAt time.Time       `json:"issued_at"`
+}
+
+// ScheduleWorkloadRequest is the payload of a schedule_workload command
+type ScheduleWorkloadRequest struct {
+	PodName       string `json:"pod_name"`
+	Image         string `json:"image"`
+	CPURequest    string `json:"cpu_request"`
+	MemoryRequest string `json:"memory_request"`
+}
+
+// CommandBatch is the long-poll response body
+type CommandBatch struct {
+	Commands []Command `json:"commands"`
+}
+
+// CommandResult acknowledges a command, posted to /api/v1/agents/{agent_id}/commands/{id}/result
+type CommandResult struct {
+	CommandID   string      `json:"command_id"`
+	Type        string      `json:"type"`
+	Success     bool        `json:"success"`
+	Message     string      `json:"message,omitempty"`
+	Data        interface{} `json:"data,omitempty"`
+	CompletedAt time.Time   `json:"completed_at"`
+}
+
+// CommandHandler executes one command; the returned data is sent back in the result
+type CommandHandler func(command Command) (interface{}, error)
+
+// CommandChannelConfig configures the pull-based command channel
+type CommandChannelConfig struct {
+	Wait time.Duration // How long the control plane may hold a poll open; defaults to 30 seconds
+}
+
+// CommandChannel long-polls the control plane for commands and acknowledges each with its result.
+// Every connection is made by the agent, so it works behind NAT without a tunnel.
+type CommandChannel struct {
+	client     *ControlPlaneClient
+	httpClient *http.Client
+	wait       time.Duration
+	handlers   map[string]CommandHandler
+	completed  map[string]*CommandResult // Results by command ID, answered again on redelivery
+	order      []string                  // Completed command IDs, oldest first
+	connected  bool
+	lastPoll   time.Time
+	executed   int
+	failed     int
+	logger     logger.Logger
+	mutex      sync.RWMutex
+}
+
+// NewCommandChannel creates a command channel that polls through client's connection settings
+func NewCommandChannel(client *ControlPlaneClient, config *CommandChannelConfig, log logger.Logger) *CommandChannel {
+	wait := config.Wait
+	if wait <= 0 {
+		wait = defaultCommandWait
+	}
+
+	return &CommandChannel{
+		client: client,
+		// Polls are bounded by their own context rather than the client timeout
+		httpClient: &http.Client{Transport: client.client.Transport},
+		wait:       wait,
+		handlers:   make(map[string]CommandHandler),
+		completed:  make(map[string]*CommandResult),
+		logger:     log,
+	}
+}
+
+// Handle registers the handler for a command type
+func (cc *CommandChannel) Handle(commandType string, handler CommandHandler) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.handlers[commandType] = handler
+}
+
+// Run polls for commands and executes them in order until stopCh is closed
+func (cc *CommandChannel) Run(stopCh <-chan struct{}) {
+	cc.logger.Info("Command channel started", "wait", cc.wait)
+
+	failures := 0
+	for {
+		select {
+		case <-stopCh:
+			cc.logger.Info("Command channel stopped")
+			return
+		default:
+		}
+
+		commands, err := cc.poll(stopCh)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				continue
+			}
+			cc.setConnected(false)
+
+			failures++
+			wait := cc.client.retry.backoff(failures)
+			var cpErr *ControlPlaneError
+			if errors.As(err, &cpErr) && cpErr.RetryAfter > wait {
+				wait = cpErr.RetryAfter
+			}
+			cc.logger.Warn("Failed to poll control plane for commands",
+				"failures", failures,
+				"wait", wait,
+				"kind", ErrorKind(err),
+				"error", err)
+
+			select {
+			case <-time.After(wait):
+			case <-stopCh:
+			}
+			continue
+		}
+
+		if failures > 0 {
+			cc.logger.Info("Command channel reconnected", "failures", failures)
+		}
+		failures = 0
+		cc.setConnected(true)
+
+		for _, command := range commands {
+			cc.execute(command)
+		}
+	}
+}
+
+// poll waits for the next commands; an empty slice means the wait expired without any
+func (cc *CommandChannel) poll(stopCh <-chan struct{}) (commands []Command, err error) {
+	defer func(start time.Time) { RecordCall("command_poll", start, err) }(time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), cc.wait+pollGrace)
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	path := agentCommandsPath(cc.client.agentID) + "?wait=" + url.QueryEscape(cc.wait.String())
+	respBody, err := cc.client.send(ctx, cc.httpClient, "GET", path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cc.mutex.Lock()
+	cc.lastPoll = time.Now()
+	cc.mutex.Unlock()
+
+	// 204 No Content when the wait expired
+	if len(respBody) == 0 {
+		return nil, nil
+	}
+
+	var batch CommandBatch
+	if err := json.Unmarshal(respBody, &batch); err != nil {
+		return nil, fmt.Errorf("failed to decode commands: %w", err)
+	}
+	return batch.Commands, nil
+}
+
+// execute runs a command once and acknowledges it. A redelivered command, whose earlier
+// acknowledgement was lost, is answered with the stored result instead of running again.
+func (cc *CommandChannel) execute(command Command) {
+	cc.mutex.RLock()
+	result, done := cc.completed[command.ID]
+	handler := cc.handlers[command.Type]
+	cc.mutex.RUnlock()
+
+	if done {
+		cc.logger.Info("Command redelivered, resending its result", "command_id", command.ID, "type", command.Type)
+	} else {
+		cc.logger.Info("Executing control plane command", "command_id", command.ID, "type", command.Type)
+		result = cc.run(command, handler)
+		cc.remember(result)
+	}
+
+	if err := cc.acknowledge(result); err != nil {
+		// The control plane redelivers unacknowledged commands
+		cc.logger.Error("Failed to acknowledge command", "command_id", command.ID, "error", err)
+	}
+}
+
+// run calls the handler, turning errors and panics into a failed result
+func (cc *CommandChannel) run(command Command, handler CommandHandler) (result *CommandResult) {
+	start := time.Now()
+	result = &CommandResult{CommandID: command.ID, Type: command.Type}
+
+	defer func() {
+		if r := recover(); r != nil {
+			result.Success = false
+			result.Message = fmt.Sprintf("command handler panicked: %v", r)
+		}
+		result.CompletedAt = time.Now()
+
+		outcome := "success"
+		if !result.Success {
+			outcome = "error"
+			cc.logger.Error("Control plane command failed",
+				"command_id", command.ID,
+				"type", command.Type,
+				"error", result.Message)
+		}
+		commandsExecuted.Inc(command.Type, outcome)
+		commandDuration.ObserveDuration(start, command.Type)
+	}()
+
+	if handler == nil {
+		result.Message = fmt.Sprintf("unsupported command type %q", command.Type)
+		return result
+	}
+
+	data, err := handler(command)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	result.Success = true
+	result.Data = data
+	return result
+}
+
+// remember stores a result for redelivered commands, forgetting the oldest beyond the bound
+func (cc *CommandChannel) remember(result *CommandResult) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	if result.Success {
+		cc.executed++
+	} else {
+		cc.failed++
+	}
+	if result.CommandID == "" {
+		return
+	}
+	cc.completed[result.CommandID] = result
+	cc.order = append(cc.order, result.CommandID)
+	for len(cc.order) > maxCompletedCommands {
+		delete(cc.completed, cc.order[0])
+		cc.order = cc.order[1:]
+	}
+}
+
+// acknowledge posts a command result with retries
+func (cc *CommandChannel) acknowledge(result *CommandResult) (err error) {
+	defer func(start time.Time) { RecordCall("command_result", start, err) }(time.Now())
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to marshal command result: %w", err)
+	}
+
+	_, err = cc.client.deliver("command_result", "POST", commandResultPath(cc.client.agentID, result.CommandID), jsonData, nil)
+	return err
+}
+
+func (cc *CommandChannel) setConnected(connected bool) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.connected = connected
+}
+
+// GetStatus describes the command channel
+func (cc *CommandChannel) GetStatus() map[string]interface{} {
+	cc.mutex.RLock()
+	defer cc.mutex.RUnlock()
+
+	types := make([]string, 0, len(cc.handlers))
+	for commandType := range cc.handlers {
+		types = append(types, commandType)
+	}
+	sort.Strings(types)
+
+	return map[string]interface{}{
+		"connected":       cc.connected,
+		"last_poll":       cc.lastPoll,
+		"wait":            cc.wait.String(),
+		"executed":        cc.executed,
+		"failed":          cc.failed,
+		"supported_types": types,
+	}
+}
@@ -0,0 +1,181 @@
+package controlplane
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxAttempts    = 4
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+
+	// maxRetryAfter caps how long a Retry-After header can hold up a single call
+	maxRetryAfter = 5 * time.Minute
+)
+
+// RetryPolicy controls how failed control plane calls are retried
+type RetryPolicy struct {
+	MaxAttempts    int           // Total attempts including the first; 1 disables retries
+	InitialBackoff time.Duration // Upper bound of the first jittered wait, doubled after each attempt
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy returns the policy used when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    defaultMaxAttempts,
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+	}
+}
+
+// backoff returns a full-jitter wait before the given retry (1 for the first retry)
+func (policy RetryPolicy) backoff(retry int) time.Duration {
+	ceiling := policy.InitialBackoff << (retry - 1)
+	if ceiling <= 0 || ceiling > policy.MaxBackoff {
+		ceiling = policy.MaxBackoff
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// retryableStatus reports whether a status code is worth retrying
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryable reports whether err is a transient control plane failure such as a refused
+// connection, a timeout or a retryable status
+func retryable(err error) bool {
+	var cpErr *ControlPlaneError
+	return errors.As(err, &cpErr) && cpErr.Retryable
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = date.Sub(now)
+	}
+	if wait < 0 {
+		return 0
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
+
+// deliver sends a request built from method, path, body and any extra headers, retrying transient
+// failures. The response body is returned for successful calls.
+func (c *ControlPlaneClient) deliver(operation, method, path string, body []byte, header http.Header) ([]byte, error) {
+	policy := c.retry
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var respBody []byte
+		respBody, err = c.attempt(method, path, body, header)
+		if err == nil {
+			return respBody, nil
+		}
+		if attempt >= policy.MaxAttempts || !retryable(err) {
+			break
+		}
+
+		wait := policy.backoff(attempt)
+		// Only control plane errors are retryable
+		var cpErr *ControlPlaneError
+		errors.As(err, &cpErr)
+		if cpErr.RetryAfter > wait {
+			wait = cpErr.RetryAfter
+		}
+		c.logger.Warn("Control plane call failed, retrying",
+			"operation", operation,
+			"attempt", attempt,
+			"wait", wait,
+			"kind", cpErr.Kind,
+			"status_code", cpErr.StatusCode,
+			"request_id", cpErr.RequestID,
+			"error", err)
+
+		select {
+		case <-time.After(wait):
+		case <-c.stopCh:
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// attempt makes a single request
+func (c *ControlPlaneClient) attempt(method, path string, body []byte, header http.Header) ([]byte, error) {
+	return c.send(context.Background(), c.client, method, path, body, header)
+}
+
+// send makes a single request through httpClient, bounded by ctx. Failures are returned as a
+// *ControlPlaneError and recorded for GetStatus.
+func (c *ControlPlaneClient) send(ctx context.Context, httpClient *http.Client, method, path string, body []byte, header http.Header) ([]byte, error) {
+	endpoint, _, _ := strings.Cut(path, "?")
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+	}
+	req.Header.Set("X-Agent-ID", c.agentID)
+	req.Header.Set(RequestIDHeader, newRequestID())
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	requestID := req.Header.Get(RequestIDHeader)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, c.recordError(newTransportError(method, endpoint, requestID, err))
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, c.recordError(newStatusError(method, endpoint, requestID, resp, respBody))
+	}
+	if err != nil {
+		return nil, c.recordError(newTransportError(method, endpoint, requestID, fmt.Errorf("failed to read response: %w", err)))
+	}
+	c.recordSuccess()
+	return respBody, nil
+}
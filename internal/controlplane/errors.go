@@ -0,0 +1,165 @@
+package controlplane
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Control plane error kinds, telling authentication problems from outages
+const (
+	ErrorKindAuth        = "auth"        // 401 or 403: the API key or client certificate was refused
+	ErrorKindThrottled   = "throttled"   // 429 Too Many Requests
+	ErrorKindUnavailable = "unavailable" // No response, a timeout or a 5xx response
+	ErrorKindRejected    = "rejected"    // Any other 4xx response, or a response with "success": false
+)
+
+// RequestIDHeader carries the ID that correlates an agent request with control plane logs
+const RequestIDHeader = "X-Request-ID"
+
+// maxErrorMessage bounds how much of an undecodable response body is kept
+const maxErrorMessage = 256
+
+// ControlPlaneError describes a failed control plane call. Inspect it with errors.As:
+//
+//	var cpErr *controlplane.ControlPlaneError
+//	if errors.As(err, &cpErr) && cpErr.Kind == controlplane.ErrorKindAuth {
+//		// fix credentials rather than wait for the control plane to recover
+//	}
+type ControlPlaneError struct {
+	Kind       string        `json:"kind"`
+	Method     string        `json:"method"`
+	Endpoint   string        `json:"endpoint"`              // Request path without the query
+	StatusCode int           `json:"status_code,omitempty"` // Zero when no response was received
+	RequestID  string        `json:"request_id,omitempty"`  // From the response, or the one the agent sent
+	Message    string        `json:"message,omitempty"`     // ControlPlaneResponse.Message, or the start of the body
+	Retryable  bool          `json:"retryable"`
+	RetryAfter time.Duration `json:"-"` // Zero when the response carried no usable Retry-After header
+	Err        error         `json:"-"` // Transport failure when no response was received
+}
+
+func (e *ControlPlaneError) Error() string {
+	call := fmt.Sprintf("control plane %s %s", e.Method, e.Endpoint)
+	if e.RequestID != "" {
+		call += fmt.Sprintf(" (request %s)", e.RequestID)
+	}
+
+	switch {
+	case e.Err != nil:
+		return fmt.Sprintf("%s failed: %v", call, e.Err)
+	case e.StatusCode >= 200 && e.StatusCode <= 299:
+		return fmt.Sprintf("%s was rejected: %s", call, e.Message)
+	case e.Message != "":
+		return fmt.Sprintf("%s returned status %d: %s", call, e.StatusCode, e.Message)
+	default:
+		return fmt.Sprintf("%s returned status %d", call, e.StatusCode)
+	}
+}
+
+func (e *ControlPlaneError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorKind returns the kind of a control plane error in err's chain, or an empty string
+func ErrorKind(err error) string {
+	var cpErr *ControlPlaneError
+	if errors.As(err, &cpErr) {
+		return cpErr.Kind
+	}
+	return ""
+}
+
+// newTransportError describes a request that got no response
+func newTransportError(method, path, requestID string, err error) *ControlPlaneError {
+	e := &ControlPlaneError{
+		Kind:      ErrorKindUnavailable,
+		Method:    method,
+		Endpoint:  path,
+		RequestID: requestID,
+		Retryable: !errors.Is(err, context.Canceled),
+		Err:       err,
+	}
+
+	// An untrusted control plane certificate, or a TLS alert such as a refused client
+	// certificate, is a credentials problem that retrying will not fix
+	var verifyErr *tls.CertificateVerificationError
+	var opErr *net.OpError
+	if errors.As(err, &verifyErr) || (errors.As(err, &opErr) && opErr.Op == "remote error") {
+		e.Kind = ErrorKindAuth
+		e.Retryable = false
+	}
+	return e
+}
+
+// newStatusError describes a non-2xx response, decoding a ControlPlaneResponse message when the body has one
+func newStatusError(method, path, requestID string, resp *http.Response, body []byte) *ControlPlaneError {
+	e := &ControlPlaneError{
+		Kind:       statusKind(resp.StatusCode),
+		Method:     method,
+		Endpoint:   path,
+		StatusCode: resp.StatusCode,
+		RequestID:  requestID,
+		Message:    errorMessage(body),
+		Retryable:  retryableStatus(resp.StatusCode),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+	if id := resp.Header.Get(RequestIDHeader); id != "" {
+		e.RequestID = id
+	}
+	return e
+}
+
+// newRejectedError describes a 2xx response whose body reports failure
+func newRejectedError(method, path, message string) *ControlPlaneError {
+	return &ControlPlaneError{
+		Kind:       ErrorKindRejected,
+		Method:     method,
+		Endpoint:   path,
+		StatusCode: http.StatusOK,
+		Message:    message,
+	}
+}
+
+// statusKind classifies a non-2xx status code
+func statusKind(code int) string {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return ErrorKindAuth
+	case code == http.StatusTooManyRequests:
+		return ErrorKindThrottled
+	case code == http.StatusRequestTimeout || code == http.StatusTooEarly || code >= 500:
+		return ErrorKindUnavailable
+	default:
+		return ErrorKindRejected
+	}
+}
+
+// errorMessage prefers the message of a ControlPlaneResponse body over the raw body
+func errorMessage(body []byte) string {
+	var response ControlPlaneResponse
+	if err := json.Unmarshal(body, &response); err == nil && response.Message != "" {
+		return response.Message
+	}
+	message := bytes.TrimSpace(body)
+	if len(message) > maxErrorMessage {
+		message = message[:maxErrorMessage]
+	}
+	return string(message)
+}
+
+// newRequestID returns a random ID for the X-Request-ID header
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
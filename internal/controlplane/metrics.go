@@ -0,0 +1,46 @@
+package controlplane
+
+import (
+	"errors"
+	"time"
+
+	"k3s-local-agent/internal/metrics"
+)
+
+var (
+	controlPlaneRequests = metrics.NewCounter("k3s_local_agent_control_plane_requests_total",
+		"Calls to the control plane, by operation and outcome.",
+		"operation", "outcome")
+	controlPlaneRequestDuration = metrics.NewHistogram("k3s_local_agent_control_plane_request_duration_seconds",
+		"Duration of calls to the control plane, by operation.",
+		metrics.DefBuckets, "operation")
+	controlPlaneErrors = metrics.NewCounter("k3s_local_agent_control_plane_errors_total",
+		"Failed calls to the control plane, by operation and error kind (auth, throttled, unavailable, rejected).",
+		"operation", "kind")
+	queueDepth = metrics.NewGauge("k3s_local_agent_control_plane_queue_depth",
+		"Monitoring payloads buffered on disk while the control plane is unreachable.")
+	authFailures = metrics.NewCounter("k3s_local_agent_receiver_auth_failures_total",
+		"Inbound control plane requests rejected by authentication, by reason.",
+		"reason")
+	commandsExecuted = metrics.NewCounter("k3s_local_agent_commands_total",
+		"Commands received over the command channel, by type and outcome.",
+		"type", "outcome")
+	commandDuration = metrics.NewHistogram("k3s_local_agent_command_duration_seconds",
+		"Time spent executing commands received over the command channel, by type.",
+		metrics.DefBuckets, "type")
+)
+
+// RecordCall records the outcome and duration of a control plane call
+func RecordCall(operation string, start time.Time, err error) {
+	outcome := "success"
+	if errors.Is(err, ErrQueued) {
+		outcome = "queued"
+	} else if err != nil {
+		outcome = "error"
+	}
+	if kind := ErrorKind(err); kind != "" {
+		controlPlaneErrors.Inc(operation, kind)
+	}
+	controlPlaneRequests.Inc(operation, outcome)
+	controlPlaneRequestDuration.ObserveDuration(start, operation)
+}
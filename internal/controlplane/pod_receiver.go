@@ -7,31 +7,87 @@ import (
 	"sync"
 	"time"
 
+	"k3s-local-agent/internal/metrics"
 	"k3s-local-agent/pkg/logger"
+
+	corev1 "k8s.io/api/core/v1"
 )
 
 type PodReceiver struct {
-	server  *http.Server
-	logger  logger.Logger
-	podData map[string]PodInfo
-	mutex   sync.RWMutex
-	port    int
-	agentID string
+	server        *http.Server
+	logger        logger.Logger
+	podData       map[string]PodInfo
+	mutex         sync.RWMutex
+	port          int
+	agentID       string
+	updateHandler PodUpdateHandler
+	appData       map[string]AppBundle
+	appHandler    AppUpdateHandler
+	authConfig    *AuthConfig
+	auth          *authenticator
+	tlsConfig     *TLSConfig
+	controlPlane  *ControlPlaneClient
+}
+
+// PodReceiverConfig configures the pod receiver listener
+type PodReceiverConfig struct {
+	Port    int
+	AgentID string
+	Auth    *AuthConfig // Nil or empty leaves the endpoints unauthenticated
+	TLS     *TLSConfig  // Server certificate and client CA; nil serves plain HTTP
+
+	// ControlPlane, when set, has its connection status reported by /health
+	ControlPlane *ControlPlaneClient
 }
 
+// AppUpdateHandler is notified with the affected app IDs after the control plane changes app bundles
+type AppUpdateHandler func(action string, appIDs []string)
+
+// PodUpdateHandler is notified with the affected pod IDs after the control plane changes pod data
+type PodUpdateHandler func(action string, podIDs []string)
+
 type PodInfo struct {
-	ID          string            `json:"id"`
-	Name        string            `json:"name"`
-	Namespace   string            `json:"namespace"`
-	Image       string            `json:"image"`
-	Status      string            `json:"status"`
-	CPUUsage    string            `json:"cpu_usage"`
-	MemoryUsage string            `json:"memory_usage"`
-	IP          string            `json:"ip"`
-	NodeName    string            `json:"node_name"`
-	Labels      map[string]string `json:"labels"`
-	CreatedAt   time.Time         `json:"created_at"`
-	UpdatedAt   time.Time         `json:"updated_at"`
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Namespace     string            `json:"namespace"`
+	Image         string            `json:"image"`
+	Status        string            `json:"status"`
+	CPUUsage      string            `json:"cpu_usage"`
+	MemoryUsage   string            `json:"memory_usage"`
+	IP            string            `json:"ip"`
+	NodeName      string            `json:"node_name"`
+	Labels        map[string]string `json:"labels"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	CPURequest    string            `json:"cpu_request,omitempty"`
+	MemoryRequest string            `json:"memory_request,omitempty"`
+	CPULimit      string            `json:"cpu_limit,omitempty"`
+	MemoryLimit   string            `json:"memory_limit,omitempty"`
+	Ports         []ContainerPort   `json:"ports,omitempty"`
+	Environment   []EnvVar          `json:"environment,omitempty"`
+	VolumeMounts  []VolumeMount     `json:"volume_mounts,omitempty"`
+	// Spec optionally carries the full staging pod spec; when set it takes precedence over the fields above
+	Spec      *corev1.PodSpec `json:"spec,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// ContainerPort represents a container port exposed by a staging pod
+type ContainerPort struct {
+	Name          string `json:"name"`
+	ContainerPort int32  `json:"container_port"`
+	Protocol      string `json:"protocol"`
+}
+
+// EnvVar represents an environment variable of a staging pod
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// VolumeMount represents a volume mount of a staging pod
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mount_path"`
 }
 
 type PodUpdateRequest struct {
@@ -40,23 +96,52 @@ type PodUpdateRequest struct {
 	Action  string    `json:"action"` // "update", "delete", "create"
 }
 
+// AppBundle is a staging application described as a set of Kubernetes manifests.
+// Supported kinds are Deployment, Service, ConfigMap and Secret.
+type AppBundle struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Namespace  string            `json:"namespace"` // Namespace in the staging cluster
+	Labels     map[string]string `json:"labels,omitempty"`
+	Manifests  []json.RawMessage `json:"manifests"`
+	SecretRefs []string          `json:"secret_refs,omitempty"` // Secrets that must already exist locally
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+type AppUpdateRequest struct {
+	AgentID string      `json:"agent_id"`
+	Apps    []AppBundle `json:"apps"`
+	Action  string      `json:"action"` // "update", "delete", "create"
+}
+
 type PodUpdateResponse struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
 	Count   int    `json:"count"`
 }
 
-func NewPodReceiver(port int, agentID string, log logger.Logger) *PodReceiver {
+func NewPodReceiver(config *PodReceiverConfig, log logger.Logger) *PodReceiver {
 	return &PodReceiver{
-		port:    port,
-		agentID: agentID,
-		logger:  log,
-		podData: make(map[string]PodInfo),
+		port:         config.Port,
+		agentID:      config.AgentID,
+		authConfig:   config.Auth,
+		tlsConfig:    config.TLS,
+		controlPlane: config.ControlPlane,
+		logger:       log,
+		podData:      make(map[string]PodInfo),
+		appData:      make(map[string]AppBundle),
 	}
 }
 
 // Start starts the HTTP server to receive pod data from control plane
 func (pr *PodReceiver) Start() error {
+	auth, err := newAuthenticator(pr.authConfig, pr.logger)
+	if err != nil {
+		return err
+	}
+	pr.auth = auth
+
 	mux := http.NewServeMux()
 
 	// Endpoint to receive pod updates from control plane
@@ -65,21 +150,52 @@ func (pr *PodReceiver) Start() error {
 	// Endpoint to get current pod data
 	mux.HandleFunc("/api/v1/pods/status", pr.handleGetPodStatus)
 
+	// Endpoint to receive app bundle updates from control plane
+	mux.HandleFunc("/api/v1/apps", pr.handleAppUpdate)
+
 	// Agent registration endpoint
 	mux.HandleFunc("/register-local-agent", pr.handleRegisterLocalAgent)
 
 	// Health check endpoint
 	mux.HandleFunc("/health", pr.handleHealth)
 
+	// Prometheus metrics endpoint
+	mux.Handle("/metrics", metrics.Handler())
+
+	var handler http.Handler = mux
+	if pr.auth != nil {
+		handler = pr.auth.wrap(mux)
+		pr.logger.Info("Pod receiver authentication enabled", "methods", pr.auth.methods())
+	} else {
+		pr.logger.Warn("Pod receiver authentication is disabled; anyone who can reach the agent port can push pods")
+	}
+
 	pr.server = &http.Server{
 		Addr:    fmt.Sprintf(":%d", pr.port),
-		Handler: mux,
+		Handler: handler,
+	}
+
+	if pr.tlsConfig.Enabled() {
+		tlsConfig, err := newServerTLSConfig(pr.tlsConfig, pr.logger)
+		if err != nil {
+			return fmt.Errorf("failed to configure pod receiver TLS: %w", err)
+		}
+		pr.server.TLSConfig = tlsConfig
+		pr.logger.Info("Pod receiver TLS enabled",
+			"cert_file", pr.tlsConfig.CertFile,
+			"client_ca", pr.tlsConfig.CAFile)
 	}
 
 	pr.logger.Info("Starting pod receiver server", "port", pr.port, "agent_id", pr.agentID)
 
 	go func() {
-		if err := pr.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if pr.server.TLSConfig != nil {
+			err = pr.server.ListenAndServeTLS("", "")
+		} else {
+			err = pr.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			pr.logger.Error("Pod receiver server error", "error", err)
 		}
 	}()
@@ -114,10 +230,24 @@ func (pr *PodReceiver) handlePodUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	count := pr.ApplyPodUpdate(request)
+
+	response := PodUpdateResponse{
+		Success: true,
+		Message: fmt.Sprintf("Successfully processed %d pods", count),
+		Count:   count,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ApplyPodUpdate stores pods sent by the control plane, whether pushed or pulled, and notifies the update handler
+func (pr *PodReceiver) ApplyPodUpdate(request PodUpdateRequest) int {
 	pr.mutex.Lock()
-	defer pr.mutex.Unlock()
 
 	var count int
+	podIDs := make([]string, 0, len(request.Pods))
 	switch request.Action {
 	case "update", "create":
 		for _, pod := range request.Pods {
@@ -126,28 +256,124 @@ func (pr *PodReceiver) handlePodUpdate(w http.ResponseWriter, r *http.Request) {
 				pod.CreatedAt = time.Now()
 			}
 			pr.podData[pod.ID] = pod
+			podIDs = append(podIDs, pod.ID)
 			count++
 		}
 	case "delete":
 		for _, pod := range request.Pods {
 			delete(pr.podData, pod.ID)
+			podIDs = append(podIDs, pod.ID)
 			count++
 		}
 	}
+	totalPods := len(pr.podData)
+	handler := pr.updateHandler
+	pr.mutex.Unlock()
+
+	if handler != nil && len(podIDs) > 0 {
+		handler(request.Action, podIDs)
+	}
+
+	pr.logger.Info("Pod data updated from control plane",
+		"action", request.Action,
+		"count", count,
+		"total_pods", totalPods)
+	return count
+}
+
+// handleAppUpdate handles app bundle updates from control plane
+func (pr *PodReceiver) handleAppUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request AppUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Verify agent ID
+	if request.AgentID != pr.agentID {
+		http.Error(w, "Invalid agent ID", http.StatusUnauthorized)
+		return
+	}
+
+	count := pr.ApplyAppUpdate(request)
 
 	response := PodUpdateResponse{
 		Success: true,
-		Message: fmt.Sprintf("Successfully processed %d pods", count),
+		Message: fmt.Sprintf("Successfully processed %d apps", count),
 		Count:   count,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
+}
 
-	pr.logger.Info("Pod data updated from control plane",
+// ApplyAppUpdate stores app bundles sent by the control plane, whether pushed or pulled, and notifies the app handler
+func (pr *PodReceiver) ApplyAppUpdate(request AppUpdateRequest) int {
+	pr.mutex.Lock()
+
+	var count int
+	appIDs := make([]string, 0, len(request.Apps))
+	switch request.Action {
+	case "update", "create":
+		for _, app := range request.Apps {
+			app.UpdatedAt = time.Now()
+			if existing, exists := pr.appData[app.ID]; exists {
+				app.CreatedAt = existing.CreatedAt
+			}
+			if app.CreatedAt.IsZero() {
+				app.CreatedAt = time.Now()
+			}
+			pr.appData[app.ID] = app
+			appIDs = append(appIDs, app.ID)
+			count++
+		}
+	case "delete":
+		for _, app := range request.Apps {
+			delete(pr.appData, app.ID)
+			appIDs = append(appIDs, app.ID)
+			count++
+		}
+	}
+	totalApps := len(pr.appData)
+	handler := pr.appHandler
+	pr.mutex.Unlock()
+
+	if handler != nil && len(appIDs) > 0 {
+		handler(request.Action, appIDs)
+	}
+
+	pr.logger.Info("App data updated from control plane",
 		"action", request.Action,
 		"count", count,
-		"total_pods", len(pr.podData))
+		"total_apps", totalApps)
+	return count
+}
+
+// Resync notifies the handlers of every stored pod and app so they are reconciled again
+func (pr *PodReceiver) Resync() {
+	pr.mutex.RLock()
+	podIDs := make([]string, 0, len(pr.podData))
+	for id := range pr.podData {
+		podIDs = append(podIDs, id)
+	}
+	appIDs := make([]string, 0, len(pr.appData))
+	for id := range pr.appData {
+		appIDs = append(appIDs, id)
+	}
+	updateHandler, appHandler := pr.updateHandler, pr.appHandler
+	pr.mutex.RUnlock()
+
+	if updateHandler != nil && len(podIDs) > 0 {
+		updateHandler("resync", podIDs)
+	}
+	if appHandler != nil && len(appIDs) > 0 {
+		appHandler("resync", appIDs)
+	}
 }
 
 // handleGetPodStatus returns current pod status
@@ -184,6 +410,9 @@ func (pr *PodReceiver) handleHealth(w http.ResponseWriter, r *http.Request) {
 		"timestamp": time.Now(),
 		"pod_count": len(pr.podData),
 	}
+	if pr.controlPlane != nil {
+		response["control_plane"] = pr.controlPlane.GetStatus()
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -235,6 +464,7 @@ func (pr *PodReceiver) handleRegisterLocalAgent(w http.ResponseWriter, r *http.R
 			"pod_status":       "/api/v1/pods/status",
 			"register_agent":   "/register-local-agent",
 			"pod_update":       "/api/v1/pods",
+			"app_update":       "/api/v1/apps",
 		},
 		"pod_scheduling": map[string]interface{}{
 			"current_pods": podCount,
@@ -294,3 +524,62 @@ func (pr *PodReceiver) GetPodByID(id string) (PodInfo, bool) {
 	pod, exists := pr.podData[id]
 	return pod, exists
 }
+
+// SetUpdateHandler registers a handler invoked after every pod update from the control plane
+func (pr *PodReceiver) SetUpdateHandler(handler PodUpdateHandler) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	pr.updateHandler = handler
+}
+
+// SetAppUpdateHandler registers a handler invoked after every app bundle update from the control plane
+func (pr *PodReceiver) SetAppUpdateHandler(handler AppUpdateHandler) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	pr.appHandler = handler
+}
+
+// GetAppData returns current app bundles
+func (pr *PodReceiver) GetAppData() []AppBundle {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	apps := make([]AppBundle, 0, len(pr.appData))
+	for _, app := range pr.appData {
+		apps = append(apps, app)
+	}
+	return apps
+}
+
+// GetAppByID returns a specific app bundle by ID
+func (pr *PodReceiver) GetAppByID(id string) (AppBundle, bool) {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	app, exists := pr.appData[id]
+	return app, exists
+}
+
+// RestoreAppData seeds the receiver with app bundles recovered from persisted state
+func (pr *PodReceiver) RestoreAppData(apps []AppBundle) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	for _, app := range apps {
+		if _, exists := pr.appData[app.ID]; !exists {
+			pr.appData[app.ID] = app
+		}
+	}
+}
+
+// RestorePodData seeds the receiver with pods recovered from persisted state
+func (pr *PodReceiver) RestorePodData(pods []PodInfo) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	for _, pod := range pods {
+		if _, exists := pr.podData[pod.ID]; !exists {
+			pr.podData[pod.ID] = pod
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package controlplane
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultQueueSize = 500
+
+	// Queue entry kinds, stored as the file extension
+	entryMonitoring = "json"  // A single MonitoringData document
+	entryBatch      = "batch" // A gzip-compressed MonitoringBatch
+)
+
+// diskQueue is a bounded FIFO of payloads stored one file per entry, so buffered
+// monitoring data survives restarts while the control plane is unreachable
+type diskQueue struct {
+	dir     string
+	maxSize int
+	entries []string // File names, oldest first
+	nextSeq uint64
+	mutex   sync.Mutex
+}
+
+// newDiskQueue opens the queue in dir, picking up entries left by a previous run
+func newDiskQueue(dir string, maxSize int) (*diskQueue, error) {
+	if maxSize <= 0 {
+		maxSize = defaultQueueSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+
+	q := &diskQueue{dir: dir, maxSize: maxSize}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Left behind by a write interrupted before its rename
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		prefix, kind, _ := strings.Cut(name, ".")
+		seq, err := strconv.ParseUint(prefix, 10, 64)
+		if file.IsDir() || (kind != entryMonitoring && kind != entryBatch) || err != nil {
+			continue
+		}
+		q.entries = append(q.entries, name)
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+	}
+	// Zero-padded names sort in sequence order
+	sort.Strings(q.entries)
+	return q, nil
+}
+
+// push appends a payload of the given kind, dropping the oldest entries beyond the size bound.
+// It returns how many entries were dropped.
+func (q *diskQueue) push(payload []byte, kind string) (int, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	name := fmt.Sprintf("%020d.%s", q.nextSeq, kind)
+	tmpPath := filepath.Join(q.dir, name+".tmp")
+	if err := os.WriteFile(tmpPath, payload, 0600); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(q.dir, name)); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	q.nextSeq++
+	q.entries = append(q.entries, name)
+
+	dropped := 0
+	for len(q.entries) > q.maxSize {
+		os.Remove(filepath.Join(q.dir, q.entries[0]))
+		q.entries = q.entries[1:]
+		dropped++
+	}
+	return dropped, nil
+}
+
+// peek returns the oldest entry without removing it; ok is false when the queue is empty
+func (q *diskQueue) peek() (name string, payload []byte, ok bool, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.entries) > 0 {
+		name = q.entries[0]
+		payload, err = os.ReadFile(filepath.Join(q.dir, name))
+		if os.IsNotExist(err) {
+			// Removed behind our back; skip it
+			q.entries = q.entries[1:]
+			continue
+		}
+		return name, payload, err == nil, err
+	}
+	return "", nil, false, nil
+}
+
+// entryKind returns the kind of a queue entry from its name
+func entryKind(name string) string {
+	_, kind, _ := strings.Cut(name, ".")
+	return kind
+}
+
+// remove deletes an entry returned by peek
+func (q *diskQueue) remove(name string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, entry := range q.entries {
+		if entry == name {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			break
+		}
+	}
+	if err := os.Remove(filepath.Join(q.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// len returns the number of queued entries
+func (q *diskQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.entries)
+}
@@ -0,0 +1,350 @@
+package controlplane
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"k3s-local-agent/internal/monitor"
+	"k3s-local-agent/pkg/logger"
+)
+
+func TestDiskQueueOrder(t *testing.T) {
+	q, err := newDiskQueue(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range []string{"a", "b", "c"} {
+		if _, err := q.push([]byte(payload), entryMonitoring); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := drainPayloads(t, q); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("payloads = %v, want oldest first", got)
+	}
+	if _, _, ok, _ := q.peek(); ok {
+		t.Error("peek on an empty queue returned an entry")
+	}
+}
+
+func TestDiskQueueOverflow(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newDiskQueue(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		payload string
+		dropped int
+	}{
+		{"a", 0},
+		{"b", 0},
+		{"c", 0},
+		{"d", 1},
+		{"e", 1},
+	}
+	for _, tt := range tests {
+		dropped, err := q.push([]byte(tt.payload), entryMonitoring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dropped != tt.dropped {
+			t.Errorf("push %s dropped %d, want %d", tt.payload, dropped, tt.dropped)
+		}
+	}
+
+	if q.len() != 3 {
+		t.Errorf("len = %d, want 3", q.len())
+	}
+	// Dropped entries are removed from disk too
+	if files := queueFiles(t, dir); len(files) != 3 {
+		t.Errorf("files on disk = %v, want 3", files)
+	}
+	if got := drainPayloads(t, q); !reflect.DeepEqual(got, []string{"c", "d", "e"}) {
+		t.Errorf("payloads = %v, want the newest three", got)
+	}
+}
+
+func TestDiskQueueRestart(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newDiskQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.push([]byte("a"), entryMonitoring)
+	q.push([]byte("b"), entryBatch)
+	q.push([]byte("c"), entryMonitoring)
+
+	// Deliver the first entry, then leave behind an interrupted write and unrelated files
+	name, _, _, _ := q.peek()
+	if err := q.remove(name); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "00000000000000000099.json.tmp"), "partial")
+	writeFile(t, filepath.Join(dir, "notes.txt"), "ignored")
+	writeFile(t, filepath.Join(dir, "00000000000000000050.yaml"), "ignored")
+	if err := os.Mkdir(filepath.Join(dir, "00000000000000000060.json"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := newDiskQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.len() != 2 {
+		t.Fatalf("len after restart = %d, want 2", reopened.len())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000000099.json.tmp")); !os.IsNotExist(err) {
+		t.Error("interrupted write was not cleaned up")
+	}
+
+	// New entries continue the sequence after the surviving ones
+	reopened.push([]byte("d"), entryMonitoring)
+
+	var kinds []string
+	for {
+		name, payload, ok, err := reopened.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		kinds = append(kinds, string(payload)+"."+entryKind(name))
+		reopened.remove(name)
+	}
+	if want := []string{"b.batch", "c.json", "d.json"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("entries after restart = %v, want %v", kinds, want)
+	}
+}
+
+func TestDiskQueueSkipsRemovedEntries(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newDiskQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.push([]byte("a"), entryMonitoring)
+	q.push([]byte("b"), entryMonitoring)
+
+	name, _, _, _ := q.peek()
+	if err := os.Remove(filepath.Join(dir, name)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, payload, ok, err := q.peek()
+	if err != nil || !ok || string(payload) != "b" {
+		t.Errorf("peek = %q, %t, %v; want the next entry", payload, ok, err)
+	}
+	if q.len() != 1 {
+		t.Errorf("len = %d, want 1", q.len())
+	}
+}
+
+func TestDrainQueue(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		remaining int // Of the three queued payloads
+		wantErr   bool
+	}{
+		{"delivered", http.StatusOK, `{"success":true}`, 0, false},
+		{"success false drops", http.StatusOK, `{"success":false,"message":"bad sample"}`, 0, false},
+		{"bad request drops", http.StatusBadRequest, `{"message":"invalid"}`, 0, false},
+		{"too large drops", http.StatusRequestEntityTooLarge, ``, 0, false},
+		{"unprocessable drops", http.StatusUnprocessableEntity, ``, 0, false},
+		{"method not allowed drops", http.StatusMethodNotAllowed, ``, 0, false},
+		{"conflict drops", http.StatusConflict, ``, 0, false},
+		{"gone drops", http.StatusGone, ``, 0, false},
+		{"unsupported media type drops", http.StatusUnsupportedMediaType, ``, 0, false},
+		{"unauthorized keeps", http.StatusUnauthorized, `{"message":"invalid api key"}`, 3, true},
+		{"forbidden keeps", http.StatusForbidden, ``, 3, true},
+		{"not found keeps", http.StatusNotFound, ``, 3, true},
+		{"unavailable keeps", http.StatusServiceUnavailable, ``, 3, true},
+		{"throttled keeps", http.StatusTooManyRequests, ``, 3, true},
+		{"request timeout keeps", http.StatusRequestTimeout, ``, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				requests++
+				mutex.Unlock()
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			c := newTestClient(t, server.URL)
+			for _, payload := range []string{"1", "2", "3"} {
+				c.queue.push([]byte(`{"sample":`+payload+`}`), entryMonitoring)
+			}
+
+			err := c.drainQueue()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("drainQueue error = %v, want error %t", err, tt.wantErr)
+			}
+			if c.queue.len() != tt.remaining {
+				t.Errorf("remaining = %d, want %d", c.queue.len(), tt.remaining)
+			}
+			// A failure that is not about the payload stops the drain at the first entry
+			mutex.Lock()
+			defer mutex.Unlock()
+			if tt.wantErr && requests != 1 {
+				t.Errorf("requests = %d, want 1", requests)
+			}
+		})
+	}
+}
+
+func TestDrainQueuePassesRejectedPayload(t *testing.T) {
+	var mutex sync.Mutex
+	var delivered []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		// The oldest payload is permanently refused; the newer ones must still go out
+		if string(body) == `{"sample":1}` {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		delivered = append(delivered, string(body))
+		w.Write([]byte(`{"success":true}`))
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL)
+	for _, payload := range []string{"1", "2", "3"} {
+		c.queue.push([]byte(`{"sample":`+payload+`}`), entryMonitoring)
+	}
+
+	if err := c.drainQueue(); err != nil {
+		t.Fatalf("drainQueue = %v", err)
+	}
+	if c.queue.len() != 0 {
+		t.Errorf("remaining = %d, want 0", c.queue.len())
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if want := []string{`{"sample":2}`, `{"sample":3}`}; !reflect.DeepEqual(delivered, want) {
+		t.Errorf("delivered = %v, want %v", delivered, want)
+	}
+}
+
+func TestSendMonitoringDataBuffersOnAuthFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL)
+	err := c.SendMonitoringData(&monitor.K3sResourceData{})
+	if !errors.Is(err, ErrQueued) || ErrorKind(err) != ErrorKindAuth {
+		t.Fatalf("error = %v (kind %q), want a queued auth failure", err, ErrorKind(err))
+	}
+	if c.queue.len() != 1 {
+		t.Errorf("queued = %d, want 1", c.queue.len())
+	}
+}
+
+func TestPayloadRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"success false", newRejectedError("POST", pathMonitoring, "bad sample"), true},
+		{"bad request", &ControlPlaneError{Kind: ErrorKindRejected, StatusCode: http.StatusBadRequest}, true},
+		{"method not allowed", &ControlPlaneError{Kind: ErrorKindRejected, StatusCode: http.StatusMethodNotAllowed}, true},
+		{"conflict", &ControlPlaneError{Kind: ErrorKindRejected, StatusCode: http.StatusConflict}, true},
+		{"gone", &ControlPlaneError{Kind: ErrorKindRejected, StatusCode: http.StatusGone}, true},
+		{"unsupported media type", &ControlPlaneError{Kind: ErrorKindRejected, StatusCode: http.StatusUnsupportedMediaType}, true},
+		{"forbidden", &ControlPlaneError{Kind: ErrorKindAuth, StatusCode: http.StatusForbidden}, false},
+		{"request timeout", &ControlPlaneError{Kind: ErrorKindUnavailable, StatusCode: http.StatusRequestTimeout, Retryable: true}, false},
+		{"too early", &ControlPlaneError{Kind: ErrorKindUnavailable, StatusCode: http.StatusTooEarly, Retryable: true}, false},
+		{"throttled", &ControlPlaneError{Kind: ErrorKindThrottled, StatusCode: http.StatusTooManyRequests, Retryable: true}, false},
+		{"server error", &ControlPlaneError{Kind: ErrorKindUnavailable, StatusCode: http.StatusInternalServerError, Retryable: true}, false},
+		{"undecodable response", errors.New("failed to decode response"), true},
+		{"unauthorized", &ControlPlaneError{Kind: ErrorKindAuth, StatusCode: http.StatusUnauthorized}, false},
+		{"client certificate refused", &ControlPlaneError{Kind: ErrorKindAuth, Err: errors.New("remote error: tls: bad certificate")}, false},
+		{"not found", &ControlPlaneError{Kind: ErrorKindRejected, StatusCode: http.StatusNotFound}, false},
+		{"connection refused", &ControlPlaneError{Kind: ErrorKindUnavailable, Retryable: true, Err: errors.New("connection refused")}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := payloadRejected(tt.err); got != tt.want {
+				t.Errorf("payloadRejected = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestClient returns a client for baseURL with a disk queue and no retries
+func newTestClient(t *testing.T, baseURL string) *ControlPlaneClient {
+	t.Helper()
+	c, err := NewControlPlaneClient(&ControlPlaneConfig{
+		BaseURL:  baseURL,
+		AgentID:  "agent-1",
+		Retry:    &RetryPolicy{MaxAttempts: 1},
+		QueueDir: t.TempDir(),
+	}, logger.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// drainPayloads removes every entry from q and returns the payloads in order
+func drainPayloads(t *testing.T, q *diskQueue) []string {
+	t.Helper()
+	var payloads []string
+	for {
+		name, payload, ok, err := q.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return payloads
+		}
+		payloads = append(payloads, string(payload))
+		if err := q.remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func queueFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,304 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"k3s-local-agent/internal/k3s"
+	"k3s-local-agent/internal/monitor"
+)
+
+const defaultFullSnapshotInterval = 10 * time.Minute
+
+// DeltaConfig enables delta-encoded cluster snapshots
+type DeltaConfig struct {
+	FullInterval time.Duration // Send a full snapshot at least this often; defaults to 10 minutes
+}
+
+// ClusterSnapshot is posted to /api/v1/monitoring/snapshot. A full snapshot lists every node and
+// pod; a delta lists only the changes since the snapshot numbered BaseSequence.
+type ClusterSnapshot struct {
+	AgentID       string                 `json:"agent_id"`
+	Sequence      uint64                 `json:"sequence"`
+	Full          bool                   `json:"full"`
+	BaseSequence  uint64                 `json:"base_sequence,omitempty"` // Deltas only: the acknowledged snapshot they apply to
+	Timestamp     time.Time              `json:"timestamp"`
+	LocalSystem   *monitor.ResourceData  `json:"local_system"`
+	ClusterHealth map[string]interface{} `json:"cluster_health"`
+	Nodes         []k3s.NodeMetrics      `json:"nodes,omitempty"` // Full snapshots only
+	Pods          []k3s.PodMetrics       `json:"pods,omitempty"`  // Full snapshots only
+	NodeChanges   *NodeChanges           `json:"node_changes,omitempty"`
+	PodChanges    *PodChanges            `json:"pod_changes,omitempty"`
+}
+
+// NodeChanges lists the nodes that differ from the base snapshot
+type NodeChanges struct {
+	Added   []k3s.NodeMetrics `json:"added,omitempty"`
+	Changed []k3s.NodeMetrics `json:"changed,omitempty"`
+	Removed []string          `json:"removed,omitempty"` // Node names
+}
+
+// PodChanges lists the pods that differ from the base snapshot
+type PodChanges struct {
+	Added   []k3s.PodMetrics `json:"added,omitempty"`
+	Changed []k3s.PodMetrics `json:"changed,omitempty"`
+	Removed []string         `json:"removed,omitempty"` // namespace/name
+}
+
+// SnapshotAck is the control plane's reply to a snapshot
+type SnapshotAck struct {
+	Success      bool   `json:"success"`
+	Message      string `json:"message"`
+	Acknowledged uint64 `json:"acknowledged,omitempty"` // Sequence applied; zero means the one just sent
+	Resync       bool   `json:"resync,omitempty"`       // Ask the agent for a full snapshot
+}
+
+// deltaTracker remembers the last acknowledged cluster state that deltas are computed against
+type deltaTracker struct {
+	fullInterval time.Duration
+	sequence     uint64 // Last sequence sent
+	acked        uint64 // Last sequence acknowledged; zero until the first full snapshot is accepted
+	lastFull     time.Time
+	nodes        map[string]k3s.NodeMetrics
+	pods         map[string]k3s.PodMetrics
+	resync       bool
+	mutex        sync.Mutex
+}
+
+func newDeltaTracker(config *DeltaConfig) *deltaTracker {
+	dt := &deltaTracker{fullInterval: config.FullInterval}
+	if dt.fullInterval <= 0 {
+		dt.fullInterval = defaultFullSnapshotInterval
+	}
+	return dt
+}
+
+// clusterState is the node and pod set a snapshot describes
+type clusterState struct {
+	nodes map[string]k3s.NodeMetrics
+	pods  map[string]k3s.PodMetrics
+}
+
+func podKey(pod k3s.PodMetrics) string {
+	return pod.Namespace + "/" + pod.Name
+}
+
+// next numbers and builds the snapshot for k3sData, returning the state to adopt once it is acknowledged
+func (dt *deltaTracker) next(agentID string, k3sData *monitor.K3sResourceData) (*ClusterSnapshot, clusterState) {
+	state := clusterState{
+		nodes: make(map[string]k3s.NodeMetrics, len(k3sData.NodeMetrics)),
+		pods:  make(map[string]k3s.PodMetrics, len(k3sData.PodMetrics)),
+	}
+	for _, node := range k3sData.NodeMetrics {
+		state.nodes[node.Name] = node
+	}
+	for _, pod := range k3sData.PodMetrics {
+		state.pods[podKey(pod)] = pod
+	}
+
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+
+	dt.sequence++
+	snapshot := &ClusterSnapshot{
+		AgentID:       agentID,
+		Sequence:      dt.sequence,
+		Timestamp:     time.Now(),
+		LocalSystem:   k3sData.LocalSystem,
+		ClusterHealth: k3sData.ClusterHealth,
+	}
+
+	if dt.resync || dt.acked == 0 || time.Since(dt.lastFull) >= dt.fullInterval {
+		snapshot.Full = true
+		snapshot.Nodes = k3sData.NodeMetrics
+		snapshot.Pods = k3sData.PodMetrics
+		return snapshot, state
+	}
+
+	snapshot.BaseSequence = dt.acked
+	snapshot.NodeChanges = diffNodes(dt.nodes, state.nodes)
+	snapshot.PodChanges = diffPods(dt.pods, state.pods)
+	return snapshot, state
+}
+
+// acknowledge makes state the base for later deltas
+func (dt *deltaTracker) acknowledge(snapshot *ClusterSnapshot, state clusterState) {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+
+	// A slower, older reply must not replace a newer base
+	if snapshot.Sequence < dt.acked {
+		return
+	}
+	dt.acked = snapshot.Sequence
+	dt.nodes = state.nodes
+	dt.pods = state.pods
+	if snapshot.Full {
+		dt.resync = false
+		dt.lastFull = time.Now()
+	}
+}
+
+// requestResync makes the next snapshot a full one
+func (dt *deltaTracker) requestResync() {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+	dt.resync = true
+}
+
+// status describes the delta protocol state
+func (dt *deltaTracker) status() map[string]interface{} {
+	dt.mutex.Lock()
+	defer dt.mutex.Unlock()
+	return map[string]interface{}{
+		"sequence":     dt.sequence,
+		"acknowledged": dt.acked,
+		"last_full":    dt.lastFull,
+		"resync":       dt.resync,
+	}
+}
+
+func diffNodes(base, current map[string]k3s.NodeMetrics) *NodeChanges {
+	changes := &NodeChanges{}
+	for name, node := range current {
+		old, exists := base[name]
+		if !exists {
+			changes.Added = append(changes.Added, node)
+		} else if nodeChanged(old, node) {
+			changes.Changed = append(changes.Changed, node)
+		}
+	}
+	for name := range base {
+		if _, exists := current[name]; !exists {
+			changes.Removed = append(changes.Removed, name)
+		}
+	}
+
+	sort.Slice(changes.Added, func(i, j int) bool { return changes.Added[i].Name < changes.Added[j].Name })
+	sort.Slice(changes.Changed, func(i, j int) bool { return changes.Changed[i].Name < changes.Changed[j].Name })
+	sort.Strings(changes.Removed)
+	return changes
+}
+
+func diffPods(base, current map[string]k3s.PodMetrics) *PodChanges {
+	changes := &PodChanges{}
+	for key, pod := range current {
+		old, exists := base[key]
+		if !exists {
+			changes.Added = append(changes.Added, pod)
+		} else if podChanged(old, pod) {
+			changes.Changed = append(changes.Changed, pod)
+		}
+	}
+	for key := range base {
+		if _, exists := current[key]; !exists {
+			changes.Removed = append(changes.Removed, key)
+		}
+	}
+
+	sort.Slice(changes.Added, func(i, j int) bool { return podKey(changes.Added[i]) < podKey(changes.Added[j]) })
+	sort.Slice(changes.Changed, func(i, j int) bool { return podKey(changes.Changed[i]) < podKey(changes.Changed[j]) })
+	sort.Strings(changes.Removed)
+	return changes
+}
+
+// nodeChanged compares node metrics, ignoring the collection timestamp
+func nodeChanged(a, b k3s.NodeMetrics) bool {
+	return a.CPUUsage.Cmp(b.CPUUsage) != 0 ||
+		a.MemoryUsage.Cmp(b.MemoryUsage) != 0 ||
+		a.CPUCapacity.Cmp(b.CPUCapacity) != 0 ||
+		a.MemoryCapacity.Cmp(b.MemoryCapacity) != 0 ||
+		a.CPUAvailable.Cmp(b.CPUAvailable) != 0 ||
+		a.MemoryAvailable.Cmp(b.MemoryAvailable) != 0
+}
+
+// podChanged compares pod metrics, ignoring the collection timestamp
+func podChanged(a, b k3s.PodMetrics) bool {
+	return a.CPUUsage.Cmp(b.CPUUsage) != 0 || a.MemoryUsage.Cmp(b.MemoryUsage) != 0
+}
+
+// sendSnapshot posts the next full or delta snapshot, falling back to a full snapshot at once
+// when the control plane asks for a resync
+func (c *ControlPlaneClient) sendSnapshot(k3sData *monitor.K3sResourceData) (err error) {
+	defer func(start time.Time) { RecordCall("snapshot", start, err) }(time.Now())
+
+	snapshot, state := c.delta.next(c.agentID, k3sData)
+	ack, err := c.postSnapshot(snapshot)
+
+	resync := err == nil && ack.Resync
+	var cpErr *ControlPlaneError
+	if errors.As(err, &cpErr) && cpErr.StatusCode == http.StatusConflict {
+		// The control plane does not hold the base snapshot
+		resync = true
+	}
+	if resync {
+		c.logger.Info("Control plane requested a full snapshot", "sequence", snapshot.Sequence)
+		c.delta.requestResync()
+		if snapshot.Full {
+			return err
+		}
+		snapshot, state = c.delta.next(c.agentID, k3sData)
+		ack, err = c.postSnapshot(snapshot)
+	}
+	if err != nil {
+		// Nothing is buffered: the next delta is computed against the last acknowledged snapshot and covers this one
+		return err
+	}
+
+	if ack.Acknowledged != 0 && ack.Acknowledged != snapshot.Sequence {
+		c.logger.Warn("Control plane acknowledged a different snapshot, resyncing",
+			"sent", snapshot.Sequence,
+			"acknowledged", ack.Acknowledged)
+		c.delta.requestResync()
+		return nil
+	}
+	c.delta.acknowledge(snapshot, state)
+
+	c.logger.Info("Successfully sent cluster snapshot to control plane",
+		"agent_id", c.agentID,
+		"sequence", snapshot.Sequence,
+		"full", snapshot.Full)
+	return nil
+}
+
+// postSnapshot delivers one snapshot and decodes the acknowledgement
+func (c *ControlPlaneClient) postSnapshot(snapshot *ClusterSnapshot) (*SnapshotAck, error) {
+	jsonData, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	respBody, err := c.deliver("snapshot", "POST", pathMonitoringSnapshot, jsonData, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var ack SnapshotAck
+	if err := json.Unmarshal(respBody, &ack); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot acknowledgement: %w", err)
+	}
+	if !ack.Success && !ack.Resync {
+		return nil, c.recordError(newRejectedError("POST", pathMonitoringSnapshot, ack.Message))
+	}
+	return &ack, nil
+}
+
+// RequestResync makes the next snapshot a full one; it does nothing unless delta snapshots are enabled
+func (c *ControlPlaneClient) RequestResync() {
+	if c.delta != nil {
+		c.delta.requestResync()
+	}
+}
+
+// GetDeltaStatus describes the delta snapshot protocol, or returns nil when it is disabled
+func (c *ControlPlaneClient) GetDeltaStatus() map[string]interface{} {
+	if c.delta == nil {
+		return nil
+	}
+	return c.delta.status()
+}
@@ -0,0 +1,257 @@
+package controlplane
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k3s-local-agent/internal/k3s"
+	"k3s-local-agent/internal/monitor"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestDiffNodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    []k3s.NodeMetrics
+		current []k3s.NodeMetrics
+		added   []string
+		changed []string
+		removed []string
+	}{
+		{
+			name:    "unchanged",
+			base:    []k3s.NodeMetrics{node("a", "500m", "1Gi")},
+			current: []k3s.NodeMetrics{node("a", "500m", "1Gi")},
+		},
+		{
+			name:    "timestamp only",
+			base:    []k3s.NodeMetrics{node("a", "500m", "1Gi")},
+			current: []k3s.NodeMetrics{stamped(node("a", "500m", "1Gi"))},
+		},
+		{
+			name:    "same quantity in another format",
+			base:    []k3s.NodeMetrics{node("a", "1", "1024Mi")},
+			current: []k3s.NodeMetrics{node("a", "1000m", "1Gi")},
+		},
+		{
+			name:    "usage changed",
+			base:    []k3s.NodeMetrics{node("a", "500m", "1Gi"), node("b", "100m", "1Gi")},
+			current: []k3s.NodeMetrics{node("a", "600m", "1Gi"), node("b", "100m", "2Gi")},
+			changed: []string{"a", "b"},
+		},
+		{
+			name:    "capacity changed",
+			base:    []k3s.NodeMetrics{node("a", "500m", "1Gi")},
+			current: []k3s.NodeMetrics{withCapacity(node("a", "500m", "1Gi"), "8")},
+			changed: []string{"a"},
+		},
+		{
+			name:    "added and removed",
+			base:    []k3s.NodeMetrics{node("c", "1", "1Gi"), node("a", "1", "1Gi")},
+			current: []k3s.NodeMetrics{node("d", "1", "1Gi"), node("b", "1", "1Gi")},
+			added:   []string{"b", "d"},
+			removed: []string{"a", "c"},
+		},
+		{
+			name:    "first node",
+			current: []k3s.NodeMetrics{node("a", "1", "1Gi")},
+			added:   []string{"a"},
+		},
+		{
+			name:    "last node removed",
+			base:    []k3s.NodeMetrics{node("a", "1", "1Gi")},
+			removed: []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := make(map[string]k3s.NodeMetrics)
+			for _, n := range tt.base {
+				base[n.Name] = n
+			}
+			current := make(map[string]k3s.NodeMetrics)
+			for _, n := range tt.current {
+				current[n.Name] = n
+			}
+
+			changes := diffNodes(base, current)
+			if got := nodeNames(changes.Added); !reflect.DeepEqual(got, tt.added) {
+				t.Errorf("added = %v, want %v", got, tt.added)
+			}
+			if got := nodeNames(changes.Changed); !reflect.DeepEqual(got, tt.changed) {
+				t.Errorf("changed = %v, want %v", got, tt.changed)
+			}
+			if !reflect.DeepEqual(changes.Removed, tt.removed) {
+				t.Errorf("removed = %v, want %v", changes.Removed, tt.removed)
+			}
+		})
+	}
+}
+
+func TestDiffPods(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    []k3s.PodMetrics
+		current []k3s.PodMetrics
+		added   []string
+		changed []string
+		removed []string
+	}{
+		{
+			name:    "unchanged",
+			base:    []k3s.PodMetrics{pod("default", "web", "100m", "64Mi")},
+			current: []k3s.PodMetrics{pod("default", "web", "100m", "64Mi")},
+		},
+		{
+			name:    "timestamp only",
+			base:    []k3s.PodMetrics{pod("default", "web", "100m", "64Mi")},
+			current: []k3s.PodMetrics{stampedPod(pod("default", "web", "100m", "64Mi"))},
+		},
+		{
+			name:    "usage changed",
+			base:    []k3s.PodMetrics{pod("default", "web", "100m", "64Mi"), pod("default", "db", "100m", "64Mi")},
+			current: []k3s.PodMetrics{pod("default", "web", "200m", "64Mi"), pod("default", "db", "100m", "128Mi")},
+			changed: []string{"default/db", "default/web"},
+		},
+		{
+			name:    "same name in another namespace",
+			base:    []k3s.PodMetrics{pod("default", "web", "100m", "64Mi")},
+			current: []k3s.PodMetrics{pod("default", "web", "100m", "64Mi"), pod("staging", "web", "100m", "64Mi")},
+			added:   []string{"staging/web"},
+		},
+		{
+			name:    "moved namespace",
+			base:    []k3s.PodMetrics{pod("default", "web", "100m", "64Mi")},
+			current: []k3s.PodMetrics{pod("staging", "web", "100m", "64Mi")},
+			added:   []string{"staging/web"},
+			removed: []string{"default/web"},
+		},
+		{
+			name:    "sorted by namespace and name",
+			current: []k3s.PodMetrics{pod("b", "a", "1", "1Mi"), pod("a", "z", "1", "1Mi"), pod("a", "b", "1", "1Mi")},
+			added:   []string{"a/b", "a/z", "b/a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := make(map[string]k3s.PodMetrics)
+			for _, p := range tt.base {
+				base[podKey(p)] = p
+			}
+			current := make(map[string]k3s.PodMetrics)
+			for _, p := range tt.current {
+				current[podKey(p)] = p
+			}
+
+			changes := diffPods(base, current)
+			if got := podKeys(changes.Added); !reflect.DeepEqual(got, tt.added) {
+				t.Errorf("added = %v, want %v", got, tt.added)
+			}
+			if got := podKeys(changes.Changed); !reflect.DeepEqual(got, tt.changed) {
+				t.Errorf("changed = %v, want %v", got, tt.changed)
+			}
+			if !reflect.DeepEqual(changes.Removed, tt.removed) {
+				t.Errorf("removed = %v, want %v", changes.Removed, tt.removed)
+			}
+		})
+	}
+}
+
+func TestDeltaTracker(t *testing.T) {
+	dt := newDeltaTracker(&DeltaConfig{FullInterval: time.Hour})
+	data := &monitor.K3sResourceData{
+		NodeMetrics: []k3s.NodeMetrics{node("a", "500m", "1Gi")},
+		PodMetrics:  []k3s.PodMetrics{pod("default", "web", "100m", "64Mi")},
+	}
+
+	// Nothing is acknowledged yet, so the first snapshots are full
+	first, firstState := dt.next("agent-1", data)
+	if !first.Full || first.Sequence != 1 {
+		t.Fatalf("first snapshot full = %t, sequence = %d; want a full snapshot 1", first.Full, first.Sequence)
+	}
+	dt.acknowledge(first, firstState)
+
+	data.NodeMetrics = []k3s.NodeMetrics{node("a", "700m", "1Gi")}
+	delta, deltaState := dt.next("agent-1", data)
+	if delta.Full || delta.BaseSequence != 1 {
+		t.Fatalf("second snapshot full = %t, base = %d; want a delta on 1", delta.Full, delta.BaseSequence)
+	}
+	if got := nodeNames(delta.NodeChanges.Changed); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("delta changed nodes = %v, want [a]", got)
+	}
+
+	// An unacknowledged delta leaves the base in place, so the next delta still covers its change
+	again, _ := dt.next("agent-1", data)
+	if again.BaseSequence != 1 || len(again.NodeChanges.Changed) != 1 {
+		t.Errorf("retry base = %d, changed = %d; want base 1 with the change", again.BaseSequence, len(again.NodeChanges.Changed))
+	}
+
+	dt.acknowledge(again, deltaState)
+	// A late reply to an older snapshot does not move the base back
+	dt.acknowledge(delta, firstState)
+	after, _ := dt.next("agent-1", data)
+	if after.BaseSequence != again.Sequence || len(after.NodeChanges.Changed) != 0 {
+		t.Errorf("base = %d, changed = %d; want base %d with no changes", after.BaseSequence, len(after.NodeChanges.Changed), again.Sequence)
+	}
+
+	dt.requestResync()
+	if resync, _ := dt.next("agent-1", data); !resync.Full {
+		t.Error("snapshot after a resync request is not full")
+	}
+}
+
+func node(name, cpu, memory string) k3s.NodeMetrics {
+	return k3s.NodeMetrics{
+		Name:            name,
+		CPUUsage:        resource.MustParse(cpu),
+		MemoryUsage:     resource.MustParse(memory),
+		CPUCapacity:     resource.MustParse("4"),
+		MemoryCapacity:  resource.MustParse("8Gi"),
+		CPUAvailable:    resource.MustParse("2"),
+		MemoryAvailable: resource.MustParse("4Gi"),
+	}
+}
+
+func withCapacity(n k3s.NodeMetrics, cpu string) k3s.NodeMetrics {
+	n.CPUCapacity = resource.MustParse(cpu)
+	return n
+}
+
+func stamped(n k3s.NodeMetrics) k3s.NodeMetrics {
+	n.Timestamp = time.Now()
+	return n
+}
+
+func pod(namespace, name, cpu, memory string) k3s.PodMetrics {
+	return k3s.PodMetrics{
+		Name:        name,
+		Namespace:   namespace,
+		CPUUsage:    resource.MustParse(cpu),
+		MemoryUsage: resource.MustParse(memory),
+	}
+}
+
+func stampedPod(p k3s.PodMetrics) k3s.PodMetrics {
+	p.Timestamp = time.Now()
+	return p
+}
+
+func nodeNames(nodes []k3s.NodeMetrics) []string {
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+func podKeys(pods []k3s.PodMetrics) []string {
+	var keys []string
+	for _, p := range pods {
+		keys = append(keys, podKey(p))
+	}
+	return keys
+}
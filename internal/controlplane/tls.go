@@ -0,0 +1,193 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k3s-local-agent/pkg/logger"
+)
+
+// TLSConfig holds certificate paths for mutual TLS with the control plane.
+// For outbound calls CertFile/KeyFile are the agent's client certificate and CAFile verifies the
+// control plane; on the pod receiver they are its server certificate and CAFile verifies client certificates.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string // Empty trusts the system roots outbound and disables client verification inbound
+}
+
+// Enabled reports whether any certificate path is configured
+func (config *TLSConfig) Enabled() bool {
+	return config != nil && (config.CertFile != "" || config.KeyFile != "" || config.CAFile != "")
+}
+
+// certReloader serves a certificate and CA pool from disk, reloading them when the files change
+// so rotated certificates are picked up by new connections without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes map[string]time.Time
+	logger   logger.Logger
+	mutex    sync.Mutex
+}
+
+// newCertReloader loads the configured files once so mistakes fail at startup
+func newCertReloader(config *TLSConfig, log logger.Logger) (*certReloader, error) {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, errors.New("certificate and key files must be configured together")
+	}
+
+	cr := &certReloader{
+		certFile: config.CertFile,
+		keyFile:  config.KeyFile,
+		caFile:   config.CAFile,
+		modTimes: make(map[string]time.Time),
+		logger:   log,
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload re-reads any file whose modification time changed since it was last loaded
+func (cr *certReloader) reload() error {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if cr.certFile != "" && (cr.changed(cr.certFile) || cr.changed(cr.keyFile)) {
+		cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s: %w", cr.certFile, err)
+		}
+		if cr.cert != nil {
+			cr.logger.Info("Reloaded rotated certificate", "cert_file", cr.certFile)
+		}
+		cr.cert = &cert
+		cr.markLoaded(cr.certFile, cr.keyFile)
+	}
+
+	if cr.caFile != "" && cr.changed(cr.caFile) {
+		data, err := os.ReadFile(cr.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in CA file %s", cr.caFile)
+		}
+		if cr.pool != nil {
+			cr.logger.Info("Reloaded rotated CA bundle", "ca_file", cr.caFile)
+		}
+		cr.pool = pool
+		cr.markLoaded(cr.caFile)
+	}
+	return nil
+}
+
+func (cr *certReloader) changed(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		// Let the load report the error
+		return true
+	}
+	return !info.ModTime().Equal(cr.modTimes[path])
+}
+
+func (cr *certReloader) markLoaded(paths ...string) {
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			cr.modTimes[path] = info.ModTime()
+		}
+	}
+}
+
+// current reloads changed files, keeping the previous certificate and pool when a reload fails
+func (cr *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	if err := cr.reload(); err != nil {
+		cr.logger.Error("Failed to reload certificates, keeping the previous ones", "error", err)
+	}
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.cert, cr.pool
+}
+
+// dialTLS opens a connection with the current client certificate and CA bundle, so every new
+// connection picks up rotated files
+func (cr *certReloader) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, pool := cr.current()
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+		RootCAs:    pool, // nil uses the system roots
+	}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}, Config: config}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// serverConfig serves the receiver certificate and, with a CA bundle, requires verified client certificates
+func (cr *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := cr.current()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if pool != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = pool
+			}
+			return config, nil
+		},
+	}
+}
+
+// newTransport builds the HTTP transport for outbound control plane calls
+func newTransport(config *TLSConfig, log logger.Logger) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !config.Enabled() {
+		return transport, nil
+	}
+
+	cr, err := newCertReloader(config, log)
+	if err != nil {
+		return nil, err
+	}
+	transport.DialTLSContext = cr.dialTLS
+	return transport, nil
+}
+
+// newServerTLSConfig builds the pod receiver's TLS configuration
+func newServerTLSConfig(config *TLSConfig, log logger.Logger) (*tls.Config, error) {
+	if config.CertFile == "" {
+		return nil, errors.New("the pod receiver needs a server certificate to verify client certificates")
+	}
+	cr, err := newCertReloader(config, log)
+	if err != nil {
+		return nil, err
+	}
+	return cr.serverConfig(), nil
+}
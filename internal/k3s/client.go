@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	"k3s-local-agent/internal/ownership"
 	"k3s-local-agent/pkg/logger"
 
 	v1 "k8s.io/api/core/v1"
@@ -17,11 +18,15 @@ import (
 	metricsclientset "k8s.io/metrics/pkg/client/clientset/versioned"
 )
 
+// schedulerSource is recorded as the source of pods created by SchedulePod
+const schedulerSource = "k3s-agent-scheduler"
+
 type K3sClient struct {
 	clientset     *kubernetes.Clientset
 	metricsClient *metricsclientset.Clientset
 	logger        logger.Logger
 	namespace     string
+	agentID       string
 }
 
 type NodeMetrics struct {
@@ -82,6 +87,11 @@ func NewK3sClient(logger logger.Logger, namespace string) (*K3sClient, error) {
 	}, nil
 }
 
+// SetAgentID sets the agent ID recorded on every object the client creates
+func (k *K3sClient) SetAgentID(agentID string) {
+	k.agentID = agentID
+}
+
 // GetNodeMetrics retrieves current resource metrics for all nodes
 func (k *K3sClient) GetNodeMetrics() ([]NodeMetrics, error) {
 	ctx := context.Background()
@@ -210,11 +220,17 @@ func (k *K3sClient) SchedulePod(podName, image string, cpuRequest, memoryRequest
 		return nil, fmt.Errorf("no suitable node found for pod %s", podName)
 	}
 
-	// Create the pod
+	// Apply the pod so scheduling the same pod again updates it instead of failing
+	owner := ownership.Metadata{
+		AgentID: k.agentID,
+		Source:  schedulerSource,
+	}
 	pod := &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      podName,
-			Namespace: k.namespace,
+			Name:        podName,
+			Namespace:   k.namespace,
+			Labels:      owner.Labels(nil),
+			Annotations: owner.Annotations(nil),
 		},
 		Spec: v1.PodSpec{
 			Containers: []v1.Container{
@@ -239,9 +255,9 @@ func (k *K3sClient) SchedulePod(podName, image string, cpuRequest, memoryRequest
 		},
 	}
 
-	_, err = k.clientset.CoreV1().Pods(k.namespace).Create(ctx, pod, metav1.CreateOptions{})
+	_, err = ownership.ApplyPod(ctx, k.clientset, pod)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create pod: %w", err)
+		return nil, fmt.Errorf("failed to apply pod: %w", err)
 	}
 
 	decision := &SchedulingDecision{
@@ -0,0 +1,311 @@
+// Package metrics exposes counters, gauges and histograms in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k3s-local-agent/pkg/logger"
+)
+
+// DefBuckets are latency buckets in seconds suited to HTTP requests
+var DefBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Default is the registry used by the package-level constructors and Handler
+var Default = NewRegistry()
+
+// Registry holds metric families and the hooks that refresh them before each scrape
+type Registry struct {
+	families map[string]*family
+	hooks    []func()
+	mutex    sync.RWMutex
+}
+
+// NewRegistry creates an empty registry with process metrics
+func NewRegistry() *Registry {
+	r := &Registry{families: make(map[string]*family)}
+
+	goroutines := r.NewGauge("go_goroutines", "Number of goroutines that currently exist.")
+	startTime := r.NewGauge("process_start_time_seconds", "Start time of the process since unix epoch in seconds.")
+	startTime.Set(float64(time.Now().Unix()))
+	r.OnScrape(func() { goroutines.Set(float64(runtime.NumGoroutine())) })
+	return r
+}
+
+// OnScrape registers a function that updates metrics right before they are written
+func (r *Registry) OnScrape(hook func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.hooks = append(r.hooks, hook)
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if existing, exists := r.families[f.name]; exists {
+		if existing.kind != f.kind || strings.Join(existing.labels, ",") != strings.Join(f.labels, ",") {
+			panic(fmt.Sprintf("metrics: %s registered twice with different definitions", f.name))
+		}
+		return existing
+	}
+	r.families[f.name] = f
+	return f
+}
+
+// Counter is a monotonically increasing value per label set
+type Counter struct{ f *family }
+
+// Gauge is a value per label set that can go up and down
+type Gauge struct{ f *family }
+
+// Histogram counts observations into buckets per label set
+type Histogram struct{ f *family }
+
+// NewCounter registers a counter with the given label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(newFamily(name, help, "counter", labels, nil))}
+}
+
+// NewGauge registers a gauge with the given label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(newFamily(name, help, "gauge", labels, nil))}
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds and label names
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &Histogram{r.register(newFamily(name, help, "histogram", labels, sorted))}
+}
+
+// NewCounter registers a counter in the default registry
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewGauge registers a gauge in the default registry
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewHistogram registers a histogram in the default registry
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// OnScrape registers a scrape hook in the default registry
+func OnScrape(hook func()) {
+	Default.OnScrape(hook)
+}
+
+// Inc adds one to the counter for the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a non-negative value to the counter for the label values
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	c.f.update(labelValues, func(s *series) { s.value += value })
+}
+
+// Set sets the gauge for the label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) { s.value = value })
+}
+
+// Reset drops every label set, so values that are no longer set disappear from the output
+func (g *Gauge) Reset() {
+	g.f.mutex.Lock()
+	defer g.f.mutex.Unlock()
+	g.f.series = make(map[string]*series)
+}
+
+// Observe records a value in the histogram for the label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.f.update(labelValues, func(s *series) {
+		for i, bound := range h.f.buckets {
+			if value <= bound {
+				s.counts[i]++
+			}
+		}
+		s.count++
+		s.sum += value
+	})
+}
+
+// ObserveDuration records the time elapsed since start in seconds
+func (h *Histogram) ObserveDuration(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+	mutex   sync.Mutex
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64 // Cumulative histogram bucket counts
+	count       uint64
+	sum         float64
+}
+
+func newFamily(name, help, kind string, labels []string, buckets []float64) *family {
+	return &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+func (f *family) update(labelValues []string, fn func(*series)) {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	s, exists := f.series[key]
+	if !exists {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// Handler serves the default registry
+func Handler() http.Handler {
+	return Default
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.RLock()
+	hooks := append([]func(){}, r.hooks...)
+	r.mutex.RUnlock()
+	for _, hook := range hooks {
+		hook()
+	}
+
+	r.mutex.RLock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mutex.RUnlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(out)
+	}
+	out.Flush()
+}
+
+func (f *family) write(out *bufio.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fmt.Fprintf(out, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+	fmt.Fprintf(out, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		labels := formatLabels(f.labels, s.labelValues)
+
+		if f.kind != "histogram" {
+			fmt.Fprintf(out, "%s%s %s\n", f.name, labels, formatFloat(s.value))
+			continue
+		}
+
+		for i, bound := range f.buckets {
+			fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, withLabel(labels, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, withLabel(labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(out, "%s_sum%s %s\n", f.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(out, "%s_count%s %d\n", f.name, labels, s.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + value + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + pair + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Serve exposes the default registry on addr at /metrics in the background
+func Serve(addr string, log logger.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	go func() {
+		log.Info("Metrics server started", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil && err != http.ErrServerClosed {
+			log.Error("Metrics server failed", "error", err)
+		}
+	}()
+}
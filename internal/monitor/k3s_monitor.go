@@ -55,6 +55,11 @@ func NewK3sResourceMonitor(cfg *config.Config, log logger.Logger, namespace stri
 	}, nil
 }
 
+// SetAgentID sets the agent ID recorded on objects created in the cluster
+func (m *K3sResourceMonitor) SetAgentID(agentID string) {
+	m.k3sClient.SetAgentID(agentID)
+}
+
 // GetAllK3sResources combines local system data with K3s cluster data
 func (m *K3sResourceMonitor) GetAllK3sResources() (*K3sResourceData, error) {
 	// Get local system resources
@@ -0,0 +1,15 @@
+package monitor
+
+import "k3s-local-agent/internal/metrics"
+
+var (
+	hostCPUUsage = metrics.NewGauge("k3s_local_agent_host_cpu_usage_percent",
+		"Host CPU usage at the last collection.")
+	hostCPUCores = metrics.NewGauge("k3s_local_agent_host_cpu_cores",
+		"Number of logical CPU cores on the host.")
+	hostMemory = metrics.NewGauge("k3s_local_agent_host_memory_bytes",
+		"Host memory at the last collection, by state.",
+		"state")
+	hostMemoryUsage = metrics.NewGauge("k3s_local_agent_host_memory_usage_percent",
+		"Host memory usage at the last collection.")
+)
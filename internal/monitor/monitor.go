@@ -118,6 +118,9 @@ func (m *monitor) GetCPUInfo() (*CPUInfo, error) {
 		modelName = info[0].ModelName
 	}
 
+	hostCPUUsage.Set(usage[0])
+	hostCPUCores.Set(float64(runtime.NumCPU()))
+
 	return &CPUInfo{
 		UsagePercent: usage[0],
 		CoreCount:    runtime.NumCPU(),
@@ -133,6 +136,12 @@ func (m *monitor) GetMemoryInfo() (*MemoryInfo, error) {
 		return nil, fmt.Errorf("failed to get memory info: %w", err)
 	}
 
+	hostMemory.Set(float64(memInfo.Total), "total")
+	hostMemory.Set(float64(memInfo.Available), "available")
+	hostMemory.Set(float64(memInfo.Used), "used")
+	hostMemory.Set(float64(memInfo.Free), "free")
+	hostMemoryUsage.Set(memInfo.UsedPercent)
+
 	return &MemoryInfo{
 		Total:       memInfo.Total,
 		Available:   memInfo.Available,
@@ -0,0 +1,101 @@
+package ownership
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// FieldManager identifies the agent as the owner of fields it applies
+	FieldManager = "k3s-local-agent"
+
+	// ManagedByLabel marks every object the agent creates
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedByValue = "k3s-local-agent"
+
+	// Agent and staging IDs are not always valid label values, so they are kept in annotations
+	AgentIDAnnotation      = "k3s-local-agent/agent-id"
+	StagingPodIDAnnotation = "k3s-local-agent/staging-pod-id"
+	StagingAppIDAnnotation = "k3s-local-agent/staging-app-id"
+	SourceAnnotation       = "k3s-local-agent/source"
+	SpecHashAnnotation     = "k3s-local-agent/spec-hash"
+)
+
+// ManagedSelector is the label selector matching every agent-managed object
+var ManagedSelector = fmt.Sprintf("%s=%s", ManagedByLabel, ManagedByValue)
+
+// Metadata describes who owns an object created by the agent
+type Metadata struct {
+	AgentID      string
+	StagingPodID string
+	StagingAppID string
+	Source       string
+}
+
+// Labels returns extra merged with the common agent labels
+func (m Metadata) Labels(extra map[string]string) map[string]string {
+	labels := make(map[string]string, len(extra)+1)
+	for k, v := range extra {
+		labels[k] = v
+	}
+	labels[ManagedByLabel] = ManagedByValue
+	return labels
+}
+
+// Annotations returns extra merged with the common agent annotations
+func (m Metadata) Annotations(extra map[string]string) map[string]string {
+	annotations := make(map[string]string, len(extra)+4)
+	for k, v := range extra {
+		annotations[k] = v
+	}
+	if m.AgentID != "" {
+		annotations[AgentIDAnnotation] = m.AgentID
+	}
+	if m.StagingPodID != "" {
+		annotations[StagingPodIDAnnotation] = m.StagingPodID
+	}
+	if m.StagingAppID != "" {
+		annotations[StagingAppIDAnnotation] = m.StagingAppID
+	}
+	if m.Source != "" {
+		annotations[SourceAnnotation] = m.Source
+	}
+	return annotations
+}
+
+// IsOwnedBy reports whether an object's annotations mark it as owned by agentID
+func IsOwnedBy(annotations map[string]string, agentID string) bool {
+	return annotations[AgentIDAnnotation] == agentID
+}
+
+// SpecHash returns a short stable hash of a pod spec, used to detect changes that need rolling out
+func SpecHash(spec *v1.PodSpec) (string, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal pod spec: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+// ApplyPod creates or updates a pod with server-side apply under the agent's field manager
+func ApplyPod(ctx context.Context, client kubernetes.Interface, pod *v1.Pod) (*v1.Pod, error) {
+	pod.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}
+
+	data, err := json.Marshal(pod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pod: %w", err)
+	}
+
+	force := true
+	return client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.ApplyPatchType, data,
+		metav1.PatchOptions{FieldManager: FieldManager, Force: &force})
+}
@@ -0,0 +1,369 @@
+package staging
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"k3s-local-agent/internal/controlplane"
+	"k3s-local-agent/internal/ownership"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// stagingAppSource is recorded as the source of every object applied from an app bundle
+const stagingAppSource = "control-plane-app-bundle"
+
+// bundleResources maps the kinds accepted in an app bundle to their API resources
+var bundleResources = map[schema.GroupVersionKind]schema.GroupVersionResource{
+	{Group: "apps", Version: "v1", Kind: "Deployment"}: {Group: "apps", Version: "v1", Resource: "deployments"},
+	{Group: "", Version: "v1", Kind: "Service"}:        {Group: "", Version: "v1", Resource: "services"},
+	{Group: "", Version: "v1", Kind: "ConfigMap"}:      {Group: "", Version: "v1", Resource: "configmaps"},
+	{Group: "", Version: "v1", Kind: "Secret"}:         secretsResource,
+}
+
+// secretsResource is also used to look up the Secrets an app bundle references
+var secretsResource = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "secrets"}
+
+// StagingAppInfo represents an app bundle mirrored into the local cluster
+type StagingAppInfo struct {
+	ID             string        `json:"id"`
+	Name           string        `json:"name"`
+	Namespace      string        `json:"namespace"` // Namespace in the staging cluster
+	Resources      []AppResource `json:"resources"`
+	Services       []string      `json:"services,omitempty"` // In-cluster DNS names of the app's services
+	MissingSecrets []string      `json:"missing_secrets,omitempty"`
+	LocalStatus    string        `json:"local_status"` // "pending", "running", "failed"
+	LocalMessage   string        `json:"local_message,omitempty"`
+	AppliedAt      time.Time     `json:"applied_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
+}
+
+// AppResource identifies an object applied as part of an app bundle
+type AppResource struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+func (r AppResource) key() string {
+	return r.Kind + "/" + r.Name
+}
+
+// clone copies an app's slices so the copy can be read without holding the agent's mutex
+func (info StagingAppInfo) clone() StagingAppInfo {
+	info.Resources = slices.Clone(info.Resources)
+	info.Services = slices.Clone(info.Services)
+	info.MissingSecrets = slices.Clone(info.MissingSecrets)
+	return info
+}
+
+// manageStagingApps applies app bundles on every sync interval and whenever the control plane changes them
+func (lsa *LocalStagingAgent) manageStagingApps() {
+	if lsa.dynamicClient == nil {
+		lsa.logger.Warn("Dynamic client not available, staging apps will not be applied")
+		return
+	}
+
+	ticker := time.NewTicker(lsa.config.SyncInterval)
+	defer ticker.Stop()
+
+	// Initial sync
+	lsa.syncStagingApps()
+
+	for {
+		select {
+		case <-ticker.C:
+			lsa.syncStagingApps()
+		case <-lsa.appSyncCh:
+			lsa.syncStagingApps()
+		case <-lsa.stopCh:
+			lsa.logger.Info("Staging app management stopped")
+			return
+		}
+	}
+}
+
+// requestAppSync schedules an app sync without blocking
+func (lsa *LocalStagingAgent) requestAppSync() {
+	select {
+	case lsa.appSyncCh <- struct{}{}:
+	default:
+	}
+}
+
+// syncStagingApps applies every desired app bundle and prunes objects that are no longer part of one
+func (lsa *LocalStagingAgent) syncStagingApps() {
+	defer syncDuration.ObserveDuration(time.Now(), "app_sync")
+	desired := lsa.podReceiver.GetAppData()
+
+	desiredResources := make(map[string]map[string]bool, len(desired))
+	for _, app := range desired {
+		info := lsa.applyAppBundle(app)
+		if info.LocalStatus == "failed" {
+			syncErrors.Inc("app_sync")
+		}
+
+		resources := make(map[string]bool, len(info.Resources))
+		for _, res := range info.Resources {
+			resources[res.key()] = true
+		}
+		desiredResources[app.ID] = resources
+
+		lsa.mutex.Lock()
+		if existing, exists := lsa.stagingApps[app.ID]; exists && existing.LocalStatus != info.LocalStatus {
+			lsa.logger.Info("Staging app status changed",
+				"app", info.Name,
+				"from", existing.LocalStatus,
+				"to", info.LocalStatus)
+		}
+		lsa.stagingApps[app.ID] = info
+		lsa.mutex.Unlock()
+	}
+
+	lsa.pruneAppResources(desiredResources)
+
+	lsa.mutex.Lock()
+	for id := range lsa.stagingApps {
+		if _, exists := desiredResources[id]; !exists {
+			delete(lsa.stagingApps, id)
+		}
+	}
+	localApps := len(lsa.stagingApps)
+	lsa.mutex.Unlock()
+
+	lsa.logger.Debug("Staging apps sync completed",
+		"desired_apps", len(desired),
+		"local_apps", localApps)
+}
+
+// applyAppBundle server-side applies every manifest of an app bundle into the local namespace
+func (lsa *LocalStagingAgent) applyAppBundle(app controlplane.AppBundle) StagingAppInfo {
+	ctx := context.Background()
+	namespace := lsa.localNamespace()
+
+	info := StagingAppInfo{
+		ID:          app.ID,
+		Name:        app.Name,
+		Namespace:   app.Namespace,
+		LocalStatus: "running",
+		AppliedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+
+	var errs []string
+	var pending []string
+	unreadable := false
+	for i, manifest := range app.Manifests {
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(manifest); err != nil {
+			errs = append(errs, fmt.Sprintf("manifest %d: %v", i, err))
+			unreadable = true
+			continue
+		}
+
+		gvr, supported := bundleResources[obj.GroupVersionKind()]
+		if !supported {
+			errs = append(errs, fmt.Sprintf("manifest %d: unsupported kind %s", i, obj.GroupVersionKind()))
+			unreadable = true
+			continue
+		}
+
+		lsa.prepareAppObject(obj, app, namespace)
+
+		// Record the resource before applying so a failed apply never causes it to be pruned
+		info.Resources = append(info.Resources, AppResource{Kind: obj.GetKind(), Name: obj.GetName()})
+
+		applied, err := lsa.dynamicClient.Resource(gvr).Namespace(namespace).Apply(ctx, obj.GetName(), obj,
+			metav1.ApplyOptions{FieldManager: ownership.FieldManager, Force: true})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s/%s: %v", obj.GetKind(), obj.GetName(), err))
+			continue
+		}
+
+		switch applied.GetKind() {
+		case "Service":
+			info.Services = append(info.Services,
+				fmt.Sprintf("%s.%s.svc.cluster.local", applied.GetName(), namespace))
+		case "Deployment":
+			if !deploymentReady(applied) {
+				pending = append(pending, applied.GetName())
+			}
+		}
+	}
+
+	// A manifest that could not be read may describe a live object, so keep every resource the
+	// previous apply recorded rather than let it be pruned
+	if unreadable {
+		info.Resources = lsa.carryOverAppResources(app.ID, info.Resources)
+	}
+
+	// Secrets referenced by the app are expected to be provisioned locally
+	for _, name := range app.SecretRefs {
+		_, err := lsa.dynamicClient.Resource(secretsResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			info.MissingSecrets = append(info.MissingSecrets, name)
+		} else if err != nil {
+			errs = append(errs, fmt.Sprintf("secret %s: %v", name, err))
+		}
+	}
+
+	switch {
+	case len(errs) > 0:
+		info.LocalStatus = "failed"
+		info.LocalMessage = strings.Join(errs, "; ")
+		lsa.logger.Error("Failed to apply staging app",
+			"app", app.Name,
+			"errors", info.LocalMessage)
+	case len(info.MissingSecrets) > 0:
+		info.LocalStatus = "pending"
+		info.LocalMessage = fmt.Sprintf("missing secrets: %s", strings.Join(info.MissingSecrets, ", "))
+	case len(pending) > 0:
+		info.LocalStatus = "pending"
+		info.LocalMessage = fmt.Sprintf("deployments not ready: %s", strings.Join(pending, ", "))
+	}
+
+	return info
+}
+
+// carryOverAppResources adds the resources recorded for an app by its previous apply to resources
+func (lsa *LocalStagingAgent) carryOverAppResources(appID string, resources []AppResource) []AppResource {
+	lsa.mutex.RLock()
+	previous := lsa.stagingApps[appID].Resources
+	lsa.mutex.RUnlock()
+
+	seen := make(map[string]bool, len(resources))
+	for _, res := range resources {
+		seen[res.key()] = true
+	}
+	for _, res := range previous {
+		if !seen[res.key()] {
+			seen[res.key()] = true
+			resources = append(resources, res)
+		}
+	}
+	return resources
+}
+
+// prepareAppObject rewrites an app manifest for the local cluster and marks it as owned by this agent
+func (lsa *LocalStagingAgent) prepareAppObject(obj *unstructured.Unstructured, app controlplane.AppBundle, namespace string) {
+	obj.SetNamespace(namespace)
+
+	// Server-generated metadata is rejected by apply
+	obj.SetResourceVersion("")
+	obj.SetUID("")
+	obj.SetCreationTimestamp(metav1.Time{})
+	obj.SetManagedFields(nil)
+	obj.SetOwnerReferences(nil)
+	unstructured.RemoveNestedField(obj.Object, "status")
+	if obj.GetKind() == "Service" {
+		clearServiceAllocations(obj)
+	}
+
+	// App-level labels apply unless the manifest sets its own value
+	labels := make(map[string]string, len(app.Labels))
+	for k, v := range app.Labels {
+		labels[k] = v
+	}
+	for k, v := range obj.GetLabels() {
+		labels[k] = v
+	}
+
+	owner := ownership.Metadata{
+		AgentID:      lsa.agentID,
+		StagingAppID: app.ID,
+		Source:       stagingAppSource,
+	}
+	obj.SetLabels(owner.Labels(labels))
+	obj.SetAnnotations(owner.Annotations(obj.GetAnnotations()))
+}
+
+// clearServiceAllocations removes the cluster IPs and node ports the staging cluster allocated
+// to a Service, which fall outside the kind cluster's ranges or collide with its ports. Headless
+// Services keep their "None" cluster IP.
+func clearServiceAllocations(obj *unstructured.Unstructured) {
+	if clusterIP, _, _ := unstructured.NestedString(obj.Object, "spec", "clusterIP"); clusterIP != "None" {
+		unstructured.RemoveNestedField(obj.Object, "spec", "clusterIP")
+		unstructured.RemoveNestedField(obj.Object, "spec", "clusterIPs")
+	}
+	unstructured.RemoveNestedField(obj.Object, "spec", "healthCheckNodePort")
+
+	ports, found, _ := unstructured.NestedSlice(obj.Object, "spec", "ports")
+	if !found {
+		return
+	}
+	for _, port := range ports {
+		if port, ok := port.(map[string]interface{}); ok {
+			delete(port, "nodePort")
+		}
+	}
+	unstructured.SetNestedSlice(obj.Object, ports, "spec", "ports")
+}
+
+// pruneAppResources deletes agent-owned app objects that are no longer part of a desired bundle
+func (lsa *LocalStagingAgent) pruneAppResources(desired map[string]map[string]bool) {
+	ctx := context.Background()
+	namespace := lsa.localNamespace()
+
+	for gvk, gvr := range bundleResources {
+		list, err := lsa.dynamicClient.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: ownership.ManagedSelector})
+		if err != nil {
+			lsa.logger.Warn("Failed to list app resources for pruning",
+				"kind", gvk.Kind,
+				"error", err)
+			continue
+		}
+
+		for _, item := range list.Items {
+			annotations := item.GetAnnotations()
+			appID := annotations[ownership.StagingAppIDAnnotation]
+			if appID == "" || !ownership.IsOwnedBy(annotations, lsa.agentID) {
+				continue
+			}
+
+			key := AppResource{Kind: gvk.Kind, Name: item.GetName()}.key()
+			if resources, exists := desired[appID]; exists && resources[key] {
+				continue
+			}
+
+			err := lsa.dynamicClient.Resource(gvr).Namespace(namespace).Delete(ctx, item.GetName(), metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				lsa.logger.Error("Failed to prune app resource",
+					"app_id", appID,
+					"resource", key,
+					"error", err)
+				continue
+			}
+
+			lsa.logger.Info("Pruned app resource",
+				"app_id", appID,
+				"resource", key)
+		}
+	}
+}
+
+// deploymentReady reports whether all desired replicas of a deployment are ready
+func deploymentReady(deployment *unstructured.Unstructured) bool {
+	replicas, found, _ := unstructured.NestedInt64(deployment.Object, "spec", "replicas")
+	if !found {
+		replicas = 1
+	}
+	ready, _, _ := unstructured.NestedInt64(deployment.Object, "status", "readyReplicas")
+	return ready >= replicas
+}
+
+// GetStagingApps returns all staging apps
+func (lsa *LocalStagingAgent) GetStagingApps() map[string]StagingAppInfo {
+	lsa.mutex.RLock()
+	defer lsa.mutex.RUnlock()
+
+	result := make(map[string]StagingAppInfo, len(lsa.stagingApps))
+	for id, app := range lsa.stagingApps {
+		result[id] = app.clone()
+	}
+	return result
+}
@@ -0,0 +1,83 @@
+package staging
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestClearServiceAllocations(t *testing.T) {
+	tests := []struct {
+		name string
+		spec map[string]interface{}
+		want map[string]interface{}
+	}{
+		{
+			name: "cluster IP service",
+			spec: map[string]interface{}{
+				"type":       "ClusterIP",
+				"clusterIP":  "10.96.12.4",
+				"clusterIPs": []interface{}{"10.96.12.4"},
+				"ports":      []interface{}{map[string]interface{}{"port": int64(80), "targetPort": int64(8080)}},
+			},
+			want: map[string]interface{}{
+				"type":  "ClusterIP",
+				"ports": []interface{}{map[string]interface{}{"port": int64(80), "targetPort": int64(8080)}},
+			},
+		},
+		{
+			name: "load balancer service",
+			spec: map[string]interface{}{
+				"type":                  "LoadBalancer",
+				"clusterIP":             "10.96.0.20",
+				"healthCheckNodePort":   int64(32000),
+				"externalTrafficPolicy": "Local",
+				"ports": []interface{}{
+					map[string]interface{}{"name": "http", "port": int64(80), "nodePort": int64(30080)},
+					map[string]interface{}{"name": "https", "port": int64(443), "nodePort": int64(30443)},
+				},
+			},
+			want: map[string]interface{}{
+				"type":                  "LoadBalancer",
+				"externalTrafficPolicy": "Local",
+				"ports": []interface{}{
+					map[string]interface{}{"name": "http", "port": int64(80)},
+					map[string]interface{}{"name": "https", "port": int64(443)},
+				},
+			},
+		},
+		{
+			name: "headless service",
+			spec: map[string]interface{}{
+				"clusterIP":  "None",
+				"clusterIPs": []interface{}{"None"},
+				"selector":   map[string]interface{}{"app": "db"},
+			},
+			want: map[string]interface{}{
+				"clusterIP":  "None",
+				"clusterIPs": []interface{}{"None"},
+				"selector":   map[string]interface{}{"app": "db"},
+			},
+		},
+		{
+			name: "no ports",
+			spec: map[string]interface{}{"type": "ExternalName", "externalName": "db.example.com"},
+			want: map[string]interface{}{"type": "ExternalName", "externalName": "db.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Service",
+				"spec":       tt.spec,
+			}}
+			clearServiceAllocations(obj)
+			if got := obj.Object["spec"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("spec = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -30,6 +30,7 @@ type CloudflareTunnel struct {
 	Protocol  string    `json:"protocol"`
 	Status    string    `json:"status"` // "active", "failed", "pending"
 	PublicURL string    `json:"public_url"`
+	PID       int       `json:"pid,omitempty"` // cloudflared process ID
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -126,6 +127,9 @@ func (ctm *CloudflareTunnelManager) startTunnel(tunnel *CloudflareTunnel) error
 		return fmt.Errorf("failed to start cloudflared tunnel: %w", err)
 	}
 
+	tunnel.PID = cmd.Process.Pid
+	go cmd.Wait()
+
 	ctm.logger.Info("Cloudflare tunnel started",
 		"local_port", tunnel.LocalPort,
 		"pid", cmd.Process.Pid)
@@ -180,13 +184,17 @@ func (ctm *CloudflareTunnelManager) RemoveTunnel(hostname string, localPort int)
 	}
 
 	// Kill cloudflared process if running
-	if tunnel.Status == "active" {
-		// Note: In a real implementation, you'd track the process ID
-		// and kill it properly. For now, we'll just remove from map.
-		ctm.logger.Info("Removing Cloudflare tunnel",
-			"hostname", tunnel.Hostname,
-			"tunnel_id", tunnel.TunnelID)
+	if tunnel.PID != 0 {
+		if err := killOwnedProcess(tunnel.PID, "cloudflared"); err != nil {
+			ctm.logger.Error("Failed to stop cloudflared process",
+				"tunnel_id", tunnel.TunnelID,
+				"pid", tunnel.PID,
+				"error", err)
+		}
 	}
+	ctm.logger.Info("Removing Cloudflare tunnel",
+		"hostname", tunnel.Hostname,
+		"tunnel_id", tunnel.TunnelID)
 
 	// Remove from tunnels map
 	delete(ctm.tunnels, tunnelKey)
@@ -0,0 +1,70 @@
+package staging
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k3s-local-agent/internal/controlplane"
+)
+
+// registerCommandHandlers routes command channel commands to the same code paths the pod receiver uses
+func (lsa *LocalStagingAgent) registerCommandHandlers() {
+	lsa.commandChannel.Handle(controlplane.CommandPods, lsa.handlePodsCommand)
+	lsa.commandChannel.Handle(controlplane.CommandApps, lsa.handleAppsCommand)
+	lsa.commandChannel.Handle(controlplane.CommandResync, lsa.handleResyncCommand)
+	lsa.commandChannel.Handle(controlplane.CommandCollectDiagnostics, lsa.handleDiagnosticsCommand)
+}
+
+// handlePodsCommand creates, updates or deletes staging pods
+func (lsa *LocalStagingAgent) handlePodsCommand(command controlplane.Command) (interface{}, error) {
+	var request controlplane.PodUpdateRequest
+	if err := json.Unmarshal(command.Payload, &request); err != nil {
+		return nil, fmt.Errorf("invalid pods payload: %w", err)
+	}
+	if request.AgentID != "" && request.AgentID != lsa.agentID {
+		return nil, fmt.Errorf("pods addressed to agent %s", request.AgentID)
+	}
+
+	count := lsa.podReceiver.ApplyPodUpdate(request)
+	return map[string]interface{}{"count": count}, nil
+}
+
+// handleAppsCommand applies or removes staging app bundles
+func (lsa *LocalStagingAgent) handleAppsCommand(command controlplane.Command) (interface{}, error) {
+	var request controlplane.AppUpdateRequest
+	if err := json.Unmarshal(command.Payload, &request); err != nil {
+		return nil, fmt.Errorf("invalid apps payload: %w", err)
+	}
+	if request.AgentID != "" && request.AgentID != lsa.agentID {
+		return nil, fmt.Errorf("apps addressed to agent %s", request.AgentID)
+	}
+
+	count := lsa.podReceiver.ApplyAppUpdate(request)
+	return map[string]interface{}{"count": count}, nil
+}
+
+// handleResyncCommand reconciles every stored pod and app again and reports fresh status
+func (lsa *LocalStagingAgent) handleResyncCommand(command controlplane.Command) (interface{}, error) {
+	lsa.podReceiver.Resync()
+	lsa.requestAppSync()
+	go lsa.sendStatusToControlPlane()
+
+	status := lsa.GetStagingStatus()
+	return map[string]interface{}{
+		"total_pods": status.TotalPods,
+		"total_apps": len(status.StagingApps),
+	}, nil
+}
+
+// handleDiagnosticsCommand collects the agent's view of its pods, proxies and cleanup
+func (lsa *LocalStagingAgent) handleDiagnosticsCommand(command controlplane.Command) (interface{}, error) {
+	return map[string]interface{}{
+		"staging_status":  lsa.GetStagingStatus(),
+		"proxy_status":    lsa.GetProxyStatus(),
+		"redirections":    lsa.ipRedirection.GetRedirections(),
+		"last_gc":         lsa.GetLastGCReport(),
+		"command_channel": lsa.commandChannel.GetStatus(),
+		"timestamp":       time.Now(),
+	}, nil
+}
@@ -0,0 +1,249 @@
+package staging
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"k3s-local-agent/internal/ownership"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GCReport lists the agent-owned resources a garbage collection run removed, or
+// would have removed in dry-run mode
+type GCReport struct {
+	Trigger      string    `json:"trigger"` // "startup" or "shutdown"
+	DryRun       bool      `json:"dry_run"`
+	Pods         []string  `json:"pods,omitempty"`
+	AppResources []string  `json:"app_resources,omitempty"`
+	Proxies      []string  `json:"proxies,omitempty"`
+	Redirections []string  `json:"redirections,omitempty"`
+	Processes    []string  `json:"processes,omitempty"`
+	Errors       []string  `json:"errors,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// Total returns the number of resources collected
+func (r *GCReport) Total() int {
+	return len(r.Pods) + len(r.AppResources) + len(r.Proxies) + len(r.Redirections) + len(r.Processes)
+}
+
+// collectGarbage removes agent-owned resources that are not part of the desired state.
+// On startup the desired state is what the control plane last sent; on shutdown it is
+// empty so that everything the agent created is torn down.
+func (lsa *LocalStagingAgent) collectGarbage(trigger string, keepDesired bool) *GCReport {
+	report := &GCReport{
+		Trigger:   trigger,
+		DryRun:    lsa.config.GCDryRun,
+		Timestamp: time.Now(),
+	}
+
+	desiredPods := make(map[string]bool)
+	desiredApps := make(map[string]bool)
+	if keepDesired {
+		for _, pod := range lsa.podReceiver.GetPodData() {
+			desiredPods[pod.ID] = true
+		}
+		for _, app := range lsa.podReceiver.GetAppData() {
+			desiredApps[app.ID] = true
+		}
+	}
+
+	if lsa.k8sClient != nil {
+		lsa.collectPods(report, desiredPods)
+	}
+	if lsa.dynamicClient != nil {
+		lsa.collectAppResources(report, desiredApps)
+	}
+	lsa.collectRouting(report, desiredPods)
+	lsa.collectProcesses(report, keepDesired)
+
+	lsa.mutex.Lock()
+	lsa.lastGC = report
+	lsa.mutex.Unlock()
+
+	verb := "Collected"
+	if report.DryRun {
+		verb = "Would collect"
+	}
+	lsa.logger.Info(verb+" agent-owned garbage",
+		"trigger", trigger,
+		"pods", report.Pods,
+		"app_resources", report.AppResources,
+		"proxies", report.Proxies,
+		"redirections", report.Redirections,
+		"processes", report.Processes,
+		"errors", len(report.Errors))
+
+	return report
+}
+
+// collectPods deletes managed pods owned by this agent whose staging pod is not desired
+func (lsa *LocalStagingAgent) collectPods(report *GCReport, desired map[string]bool) {
+	ctx := context.Background()
+	namespace := lsa.localNamespace()
+
+	pods, err := lsa.k8sClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: ownership.ManagedSelector})
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("list pods: %v", err))
+		return
+	}
+
+	for _, pod := range pods.Items {
+		id := pod.Annotations[ownership.StagingPodIDAnnotation]
+		if id == "" || !ownership.IsOwnedBy(pod.Annotations, lsa.agentID) || desired[id] {
+			continue
+		}
+
+		report.Pods = append(report.Pods, fmt.Sprintf("%s/%s", namespace, pod.Name))
+		if report.DryRun {
+			continue
+		}
+		if err := lsa.deleteLocalPod(namespace, pod.Name); err != nil {
+			// Keep tracking the pod so its proxy and redirection are torn down on a later pass
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		lsa.mutex.Lock()
+		delete(lsa.stagingPods, id)
+		lsa.mutex.Unlock()
+	}
+}
+
+// collectAppResources deletes app bundle objects owned by this agent whose app is not desired
+func (lsa *LocalStagingAgent) collectAppResources(report *GCReport, desired map[string]bool) {
+	ctx := context.Background()
+	namespace := lsa.localNamespace()
+
+	for gvk, gvr := range bundleResources {
+		list, err := lsa.dynamicClient.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: ownership.ManagedSelector})
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("list %s: %v", gvr.Resource, err))
+			continue
+		}
+
+		for _, item := range list.Items {
+			annotations := item.GetAnnotations()
+			appID := annotations[ownership.StagingAppIDAnnotation]
+			if appID == "" || !ownership.IsOwnedBy(annotations, lsa.agentID) || desired[appID] {
+				continue
+			}
+
+			report.AppResources = append(report.AppResources, AppResource{Kind: gvk.Kind, Name: item.GetName()}.key())
+			if report.DryRun {
+				continue
+			}
+			err := lsa.dynamicClient.Resource(gvr).Namespace(namespace).Delete(ctx, item.GetName(), metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				report.Errors = append(report.Errors, fmt.Sprintf("delete %s/%s: %v", gvk.Kind, item.GetName(), err))
+			}
+		}
+	}
+}
+
+// collectRouting removes proxies and redirections whose staging pod is not desired
+func (lsa *LocalStagingAgent) collectRouting(report *GCReport, desired map[string]bool) {
+	if lsa.httpProxy != nil {
+		for id, proxy := range lsa.httpProxy.GetProxies() {
+			if desired[id] {
+				continue
+			}
+			report.Proxies = append(report.Proxies, proxy.LocalPath)
+			if report.DryRun {
+				continue
+			}
+			if err := lsa.httpProxy.RemoveProxy(id); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+			}
+		}
+	}
+
+	if lsa.ipRedirection != nil {
+		for id, redirection := range lsa.ipRedirection.GetRedirections() {
+			if desired[id] {
+				continue
+			}
+			report.Redirections = append(report.Redirections,
+				fmt.Sprintf("%s:%d", redirection.StagingPodName, redirection.LocalPort))
+			if report.DryRun {
+				continue
+			}
+			if err := lsa.ipRedirection.RemoveRedirection(id); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+			}
+		}
+	}
+}
+
+// collectProcesses stops cloudflared processes left behind by a previous run, and on
+// shutdown also the tunnels started by this run
+func (lsa *LocalStagingAgent) collectProcesses(report *GCReport, keepDesired bool) {
+	lsa.mutex.Lock()
+	stale := lsa.staleTunnels
+	if !report.DryRun {
+		lsa.staleTunnels = nil
+	}
+	lsa.mutex.Unlock()
+
+	for _, tunnel := range stale {
+		if tunnel.PID == 0 || !isOwnedProcess(tunnel.PID, "cloudflared") {
+			continue
+		}
+		report.Processes = append(report.Processes, fmt.Sprintf("cloudflared[%d]", tunnel.PID))
+		if report.DryRun {
+			continue
+		}
+		if err := killOwnedProcess(tunnel.PID, "cloudflared"); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	if keepDesired || lsa.cloudflareTunnel == nil {
+		return
+	}
+
+	for _, tunnel := range lsa.cloudflareTunnel.GetTunnels() {
+		report.Processes = append(report.Processes, fmt.Sprintf("cloudflared[%d]", tunnel.PID))
+		if report.DryRun {
+			continue
+		}
+		if err := lsa.cloudflareTunnel.RemoveTunnel(tunnel.Hostname, tunnel.LocalPort); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+}
+
+// GetLastGCReport returns the report of the most recent garbage collection run
+func (lsa *LocalStagingAgent) GetLastGCReport() *GCReport {
+	lsa.mutex.RLock()
+	defer lsa.mutex.RUnlock()
+	return lsa.lastGC
+}
+
+// isOwnedProcess reports whether pid is still running the named command, guarding
+// against killing an unrelated process that reused a recorded PID
+func isOwnedProcess(pid int, name string) bool {
+	output, err := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "command=").Output()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(output), name)
+}
+
+// killOwnedProcess terminates pid if it is still running the named command
+func killOwnedProcess(pid int, name string) error {
+	if !isOwnedProcess(pid, name) {
+		return nil
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("failed to stop %s process %d: %w", name, pid, err)
+	}
+	return nil
+}
@@ -1,11 +1,15 @@
 package staging
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,43 +18,129 @@ import (
 
 // HTTPProxyManager handles HTTP reverse proxy for staging pods
 type HTTPProxyManager struct {
-	logger    logger.Logger
-	proxies   map[string]HTTPProxy
-	mutex     sync.RWMutex
-	agentID   string
-	server    *http.Server
-	proxyPort int
+	logger         logger.Logger
+	proxies        map[string]HTTPProxy
+	mutex          sync.RWMutex
+	agentID        string
+	server         *http.Server
+	proxyPort      int
+	tunnelHostname string
+	groupLabel     string
+	balancers      map[string]*loadBalancer // keyed by group
+	capture        *captureStore            // nil when traffic capture is disabled
+	faults         *faultStore
+	apiToken       string      // Bearer token for the traffic and fault APIs from non-loopback clients
+	secretsDir     string      // Directory auth secrets named by proxy policies are read from
+	tlsConfig      *tls.Config // nil when the listener serves plain HTTP
+	ca             *localCA    // nil unless certificates are issued by the local CA
+	flushInterval  time.Duration
+	idleTimeout    time.Duration
+	healthCheck    HealthCheckConfig
+	healthClient   *http.Client
+	router         *proxyRouter
+	startOnce      sync.Once
 }
 
 // HTTPProxy represents an HTTP proxy configuration
 type HTTPProxy struct {
-	ProxyID      string    `json:"proxy_id"`
-	PodName      string    `json:"pod_name"`
-	StagingPodIP string    `json:"staging_pod_ip"`
-	StagingPort  int       `json:"staging_port"`
-	LocalPath    string    `json:"local_path"` // e.g., "/my-app"
-	ProxyURL     string    `json:"proxy_url"`  // e.g., "http://localhost:8080/my-app"
-	Status       string    `json:"status"`     // "active", "failed", "pending"
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ProxyID       string            `json:"proxy_id"`
+	PodName       string            `json:"pod_name"`
+	StagingPodIP  string            `json:"staging_pod_ip"`
+	LocalPodIP    string            `json:"local_pod_ip"` // Pod IP in the local kind cluster that requests are sent to
+	StagingPort   int               `json:"staging_port"`
+	LocalPath     string            `json:"local_path"`            // e.g., "/my-app"
+	StripPrefix   bool              `json:"strip_prefix"`          // Remove LocalPath before forwarding upstream
+	RoutingMode   string            `json:"routing_mode"`          // "path", "host" or "both"
+	Hosts         []string          `json:"hosts,omitempty"`       // e.g., "my-app.agent-1.localhost"
+	Group         string            `json:"group,omitempty"`       // Value of the group label; pods sharing it are load balanced
+	Balance       string            `json:"balance,omitempty"`     // Strategy for the group route
+	HashHeader    string            `json:"hash_header,omitempty"` // Header hashed by the consistent-hash strategy
+	FlushInterval time.Duration     `json:"flush_interval"`        // Negative flushes after every write
+	IdleTimeout   time.Duration     `json:"idle_timeout"`          // Upstream connections idle this long are closed; zero disables
+	H2C           bool              `json:"h2c"`                   // Talk HTTP/2 without TLS to the pod
+	Policy        *HeaderPolicy     `json:"policy,omitempty"`
+	HealthCheck   HealthCheckConfig `json:"health_check"`
+	Health        ProxyHealth       `json:"health"`
+	ProxyURL      string            `json:"proxy_url"` // e.g., "http://localhost:8080/my-app"
+	Status        string            `json:"status"`    // "active", "failed", "pending"
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
 }
 
+const (
+	// stripPrefixAnnotation lets a staging pod opt out of LocalPath stripping with "false"
+	stripPrefixAnnotation = "k3s-local-agent/proxy-strip-prefix"
+
+	// routingModeAnnotation selects how a staging pod is addressed through the proxy
+	routingModeAnnotation = "k3s-local-agent/proxy-routing"
+
+	// Streaming options, as Go durations ("100ms", "-1ms", "10m") and "true"/"false"
+	flushIntervalAnnotation = "k3s-local-agent/proxy-flush-interval"
+	idleTimeoutAnnotation   = "k3s-local-agent/proxy-idle-timeout"
+	h2cAnnotation           = "k3s-local-agent/proxy-h2c"
+
+	RoutingModePath = "path"
+	RoutingModeHost = "host"
+	RoutingModeBoth = "both"
+)
+
 // ProxyConfig holds configuration for HTTP proxy
 type ProxyConfig struct {
-	AgentID   string
-	ProxyPort int
-	BasePath  string
-	EnableSSL bool
+	AgentID        string
+	ProxyPort      int
+	BasePath       string
+	EnableSSL      bool   // Serve the proxy over HTTPS
+	CertDir        string // Where the local CA is persisted; empty keeps it in memory
+	CertFile       string // Serve this certificate instead of issuing from the local CA
+	KeyFile        string
+	TunnelHostname string        // Pods are also served as <pod>.<TunnelHostname> when set
+	FlushInterval  time.Duration // Default flush interval for proxied responses
+	IdleTimeout    time.Duration // Default idle timeout for upstream connections
+	HealthCheck    HealthCheckConfig
+	GroupLabel     string // Pods with the same value for this label share a balanced route
+	CaptureSize    int    // Exchanges kept per proxy for inspection and replay; zero disables capture
+	CaptureBody    int64  // Bytes of each body kept by capture; zero uses the default
+	APIToken       string // Bearer token for the traffic and fault APIs; empty serves them to loopback clients only
+	SecretsDir     string // Directory auth secrets named by proxy policies are read from; empty disables auth injection
 }
 
 // NewHTTPProxyManager creates a new HTTP proxy manager
 func NewHTTPProxyManager(config *ProxyConfig, log logger.Logger) *HTTPProxyManager {
-	return &HTTPProxyManager{
-		logger:    log,
-		proxies:   make(map[string]HTTPProxy),
-		agentID:   config.AgentID,
-		proxyPort: config.ProxyPort,
+	healthCheck := config.HealthCheck
+	if healthCheck.Path == "" {
+		healthCheck = DefaultHealthCheckConfig()
+	}
+
+	var capture *captureStore
+	if config.CaptureSize > 0 {
+		capture = newCaptureStore(config.CaptureSize, config.CaptureBody)
+	}
+
+	hpm := &HTTPProxyManager{
+		logger:         log,
+		proxies:        make(map[string]HTTPProxy),
+		agentID:        config.AgentID,
+		proxyPort:      config.ProxyPort,
+		tunnelHostname: config.TunnelHostname,
+		groupLabel:     config.GroupLabel,
+		balancers:      make(map[string]*loadBalancer),
+		capture:        capture,
+		faults:         newFaultStore(),
+		apiToken:       config.APIToken,
+		secretsDir:     config.SecretsDir,
+		flushInterval:  config.FlushInterval,
+		idleTimeout:    config.IdleTimeout,
+		healthCheck:    healthCheck,
+		healthClient:   &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+		router:         newProxyRouter(),
+	}
+
+	if config.EnableSSL {
+		if err := hpm.setupTLS(config); err != nil {
+			log.Error("Failed to set up HTTP proxy TLS, serving plain HTTP", "error", err)
+		}
 	}
+	return hpm
 }
 
 // SetupProxy creates an HTTP proxy for a staging pod
@@ -60,10 +150,30 @@ func (hpm *HTTPProxyManager) SetupProxy(stagingPod StagingPodInfo, localPodIP st
 
 	// Check if proxy already exists
 	if existing, exists := hpm.proxies[stagingPod.ID]; exists {
-		hpm.logger.Info("HTTP proxy already exists",
+		if existing.LocalPodIP == localPodIP {
+			hpm.logger.Info("HTTP proxy already exists",
+				"pod", stagingPod.Name,
+				"proxy_id", existing.ProxyID,
+				"proxy_url", existing.ProxyURL)
+			return &existing, nil
+		}
+
+		// The pod was re-created with a new IP, so replace its route
+		hpm.logger.Info("Re-pointing HTTP proxy to new pod IP",
 			"pod", stagingPod.Name,
-			"proxy_id", existing.ProxyID,
-			"proxy_url", existing.ProxyURL)
+			"from", existing.LocalPodIP,
+			"to", localPodIP)
+		existing.LocalPodIP = localPodIP
+		existing.StagingPort = stagingPodPort(stagingPod)
+		existing.Health.ConsecutiveFailures = 0
+		existing.Health.ConsecutiveSuccesses = 0
+		existing.UpdatedAt = time.Now()
+		if err := hpm.setupProxyRouting(stagingPod.ID, &existing); err != nil {
+			existing.Status = "failed"
+		} else {
+			existing.Status = "active"
+		}
+		hpm.proxies[stagingPod.ID] = existing
 		return &existing, nil
 	}
 
@@ -75,19 +185,39 @@ func (hpm *HTTPProxyManager) SetupProxy(stagingPod StagingPodInfo, localPodIP st
 
 	// Create proxy
 	proxy := &HTTPProxy{
-		ProxyID:      proxyID,
-		PodName:      stagingPod.Name,
-		StagingPodIP: stagingPod.IP,
-		StagingPort:  80, // Default port
-		LocalPath:    localPath,
-		ProxyURL:     fmt.Sprintf("http://localhost:%d%s", hpm.proxyPort, localPath),
-		Status:       "pending",
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+		ProxyID:       proxyID,
+		PodName:       stagingPod.Name,
+		StagingPodIP:  stagingPod.IP,
+		LocalPodIP:    localPodIP,
+		StagingPort:   stagingPodPort(stagingPod),
+		LocalPath:     localPath,
+		StripPrefix:   !strings.EqualFold(stagingPod.Annotations[stripPrefixAnnotation], "false"),
+		RoutingMode:   proxyRoutingMode(stagingPod.Annotations[routingModeAnnotation]),
+		FlushInterval: hpm.annotationDuration(stagingPod, flushIntervalAnnotation, hpm.flushInterval),
+		IdleTimeout:   hpm.annotationDuration(stagingPod, idleTimeoutAnnotation, hpm.idleTimeout),
+		H2C:           strings.EqualFold(stagingPod.Annotations[h2cAnnotation], "true"),
+		HealthCheck:   hpm.healthCheckConfigFor(stagingPod),
+		Policy:        hpm.policyFor(stagingPod),
+		ProxyURL:      fmt.Sprintf("%s://localhost:%d%s", hpm.scheme(), hpm.proxyPort, localPath),
+		Status:        "pending",
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+
+	if proxy.RoutingMode != RoutingModePath {
+		proxy.Hosts = hpm.virtualHosts(stagingPod.Name)
+	}
+	if hpm.groupLabel != "" {
+		proxy.Group = stagingPod.Labels[hpm.groupLabel]
+		proxy.Balance = balanceStrategy(stagingPod.Annotations[balanceAnnotation])
+		proxy.HashHeader = stagingPod.Annotations[hashHeaderAnnotation]
+	}
+	if proxy.RoutingMode == RoutingModeHost && len(proxy.Hosts) > 0 {
+		proxy.ProxyURL = fmt.Sprintf("%s://%s:%d/", hpm.scheme(), proxy.Hosts[0], hpm.proxyPort)
 	}
 
 	// Setup proxy routing
-	if err := hpm.setupProxyRouting(proxy); err != nil {
+	if err := hpm.setupProxyRouting(stagingPod.ID, proxy); err != nil {
 		proxy.Status = "failed"
 		hpm.logger.Error("Failed to setup proxy routing",
 			"pod", stagingPod.Name,
@@ -98,6 +228,7 @@ func (hpm *HTTPProxyManager) SetupProxy(stagingPod StagingPodInfo, localPodIP st
 
 	// Store proxy
 	hpm.proxies[stagingPod.ID] = *proxy
+	hpm.syncGroupRoute(proxy.Group)
 
 	hpm.logger.Info("HTTP proxy setup completed",
 		"pod", stagingPod.Name,
@@ -108,16 +239,25 @@ func (hpm *HTTPProxyManager) SetupProxy(stagingPod StagingPodInfo, localPodIP st
 	return proxy, nil
 }
 
-// setupProxyRouting sets up the HTTP proxy routing
-func (hpm *HTTPProxyManager) setupProxyRouting(proxy *HTTPProxy) error {
-	// Create target URL
-	targetURL, err := url.Parse(fmt.Sprintf("http://%s:%d", proxy.StagingPodIP, proxy.StagingPort))
+// setupProxyRouting adds or replaces the route for a proxy in the routing table
+func (hpm *HTTPProxyManager) setupProxyRouting(podID string, proxy *HTTPProxy) error {
+	targetURL, err := proxyTargetURL(proxy)
 	if err != nil {
-		return fmt.Errorf("failed to parse target URL: %w", err)
+		return err
 	}
 
 	// Create reverse proxy
+	transport := newStreamingTransport(proxy.IdleTimeout, proxy.H2C)
 	reverseProxy := httputil.NewSingleHostReverseProxy(targetURL)
+	reverseProxy.Transport = transport
+	reverseProxy.FlushInterval = proxy.FlushInterval
+
+	podName := proxy.PodName
+	policy := proxy.Policy
+	var secret *secretSource
+	if policy != nil && policy.Auth != nil {
+		secret = newSecretSource(hpm.secretsDir, policy.Auth.Secret)
+	}
 
 	// Customize the proxy director
 	originalDirector := reverseProxy.Director
@@ -126,36 +266,150 @@ func (hpm *HTTPProxyManager) setupProxyRouting(proxy *HTTPProxy) error {
 		req.Header.Set("X-Proxy-By", "k3s-local-agent")
 		req.Header.Set("X-Original-Host", req.Host)
 		req.Host = targetURL.Host
+		hpm.rewriteRequest(req, podName, policy, secret)
+	}
+
+	reverseProxy.ModifyResponse = func(resp *http.Response) error {
+		rewriteResponse(resp, targetURL, policy, hpm.scheme())
+
+		// Gateway errors from the pod count against its health without waiting for the next probe
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			hpm.recordHealthResult(podID, fmt.Errorf("upstream returned %d", resp.StatusCode), "passive")
+		}
+
+		if isStreamingResponse(resp) {
+			hpm.logger.Debug("Streaming proxied response",
+				"pod", podName,
+				"status", resp.StatusCode,
+				"content_type", resp.Header.Get("Content-Type"),
+				"upgrade", resp.Header.Get("Upgrade"))
+		}
+		return nil
 	}
 
 	// Add error handling
 	reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 		hpm.logger.Error("Proxy error",
-			"pod", proxy.PodName,
+			"pod", podName,
 			"target", targetURL.String(),
 			"error", err)
+
+		// Requests abandoned by the client say nothing about the pod's health
+		if r.Context().Err() == nil {
+			hpm.recordHealthResult(podID, err, "passive")
+		}
 		http.Error(w, "Proxy Error", http.StatusBadGateway)
 	}
 
-	// Register the proxy handler
-	http.HandleFunc(proxy.LocalPath, func(w http.ResponseWriter, r *http.Request) {
-		hpm.logger.Debug("Proxying request",
-			"pod", proxy.PodName,
-			"path", r.URL.Path,
-			"target", targetURL.String())
-		reverseProxy.ServeHTTP(w, r)
+	prefix := proxy.LocalPath
+	if proxy.RoutingMode == RoutingModeHost {
+		prefix = ""
+	}
+
+	previous := hpm.router.Set(&proxyRoute{
+		podID:       podID,
+		prefix:      prefix,
+		hosts:       proxy.Hosts,
+		stripPrefix: proxy.StripPrefix,
+		transport:   transport,
+		handler: instrumentHandler(podName, hpm.captureHandler(podID, proxy.ProxyID, hpm.faultHandler(podID, proxy.ProxyID, podName, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Upgraded connections are hijacked from the client and spliced to the pod
+			if isUpgradeRequest(r) {
+				if _, ok := w.(http.Hijacker); !ok {
+					http.Error(w, "Connection upgrade not supported", http.StatusNotImplemented)
+					return
+				}
+				hpm.logger.Debug("Proxying upgrade request",
+					"pod", podName,
+					"path", r.URL.Path,
+					"upgrade", r.Header.Get("Upgrade"),
+					"target", targetURL.String())
+			} else {
+				hpm.logger.Debug("Proxying request",
+					"pod", podName,
+					"path", r.URL.Path,
+					"target", targetURL.String())
+			}
+			reverseProxy.ServeHTTP(w, r)
+		})))),
 	})
+	previous.close()
 
 	// Start HTTP server if not already running
-	if hpm.server == nil {
-		go hpm.startHTTPServer()
-	}
+	go hpm.startHTTPServer()
 
 	return nil
 }
 
-// startHTTPServer starts the HTTP proxy server
+// virtualHosts returns the Host names a pod is served under: <pod>.<agent-id>.localhost
+// and, when a tunnel is configured, <pod>.<tunnel-hostname>
+func (hpm *HTTPProxyManager) virtualHosts(podName string) []string {
+	pod := dnsLabel(podName)
+	if pod == "" {
+		return nil
+	}
+
+	hosts := []string{fmt.Sprintf("%s.%s.localhost", pod, dnsLabel(hpm.agentID))}
+	if hpm.tunnelHostname != "" {
+		hosts = append(hosts, fmt.Sprintf("%s.%s", pod, normalizeHost(hpm.tunnelHostname)))
+	}
+	return hosts
+}
+
+// annotationDuration reads a duration annotation from a staging pod, falling back on absence or error
+func (hpm *HTTPProxyManager) annotationDuration(stagingPod StagingPodInfo, key string, fallback time.Duration) time.Duration {
+	value, exists := stagingPod.Annotations[key]
+	if !exists {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		hpm.logger.Warn("Ignoring invalid proxy annotation",
+			"pod", stagingPod.Name,
+			"annotation", key,
+			"value", value,
+			"error", err)
+		return fallback
+	}
+	return duration
+}
+
+// proxyRoutingMode validates a routing mode, defaulting to serving by both path and host
+func proxyRoutingMode(mode string) string {
+	switch strings.ToLower(mode) {
+	case RoutingModePath:
+		return RoutingModePath
+	case RoutingModeHost:
+		return RoutingModeHost
+	default:
+		return RoutingModeBoth
+	}
+}
+
+// proxyTargetURL returns the URL requests for a proxy are sent to, preferring the local pod IP
+func proxyTargetURL(proxy *HTTPProxy) (*url.URL, error) {
+	targetIP := proxy.LocalPodIP
+	if targetIP == "" {
+		targetIP = proxy.StagingPodIP
+	}
+
+	targetURL, err := url.Parse(fmt.Sprintf("http://%s:%d", targetIP, proxy.StagingPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse target URL: %w", err)
+	}
+	return targetURL, nil
+}
+
+// startHTTPServer starts the HTTP proxy server; calls after the first are no-ops
 func (hpm *HTTPProxyManager) startHTTPServer() error {
+	started := false
+	hpm.startOnce.Do(func() { started = true })
+	if !started {
+		return nil
+	}
+
 	mux := http.NewServeMux()
 
 	// Add health check endpoint
@@ -165,7 +419,7 @@ func (hpm *HTTPProxyManager) startHTTPServer() error {
 			"status":    "healthy",
 			"agent_id":  hpm.agentID,
 			"timestamp": time.Now(),
-			"proxies":   len(hpm.proxies),
+			"proxies":   len(hpm.GetProxies()),
 		})
 	})
 
@@ -175,15 +429,90 @@ func (hpm *HTTPProxyManager) startHTTPServer() error {
 		json.NewEncoder(w).Encode(hpm.GetProxyStatus())
 	})
 
+	// Add traffic capture endpoints
+	hpm.registerTrafficAPI(mux)
+
+	// Add fault injection endpoints
+	hpm.registerFaultAPI(mux)
+
+	// Add local CA download for clients that need to trust the proxy's certificates
+	mux.HandleFunc("GET /ca.crt", hpm.serveCACertificate)
+
+	// Everything else is dispatched through the proxy routing table
+	mux.Handle("/", hpm.router)
+
+	// A virtual host serves its app at /, so every path on it, including /health and /api,
+	// belongs to the app rather than to the management endpoints above
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, exists := hpm.router.MatchHost(r.Host); exists {
+			hpm.router.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+
 	hpm.server = &http.Server{
-		Addr:    fmt.Sprintf(":%d", hpm.proxyPort),
-		Handler: mux,
+		Addr:      fmt.Sprintf(":%d", hpm.proxyPort),
+		Handler:   handler,
+		TLSConfig: hpm.tlsConfig,
 	}
 
-	hpm.logger.Info("HTTP proxy server started", "port", hpm.proxyPort)
+	hpm.logger.Info("HTTP proxy server started", "port", hpm.proxyPort, "scheme", hpm.scheme())
+	if hpm.tlsConfig != nil {
+		// Certificates come from TLSConfig, so no files are passed here
+		return hpm.server.ListenAndServeTLS("", "")
+	}
 	return hpm.server.ListenAndServe()
 }
 
+// requireAPIAccess guards the traffic and fault APIs, which expose captured requests and can
+// disrupt every route. Loopback clients are served; anyone else needs the API token.
+func (hpm *HTTPProxyManager) requireAPIAccess(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isLoopbackClient(r) || hpm.validAPIToken(r) {
+			next(w, r)
+			return
+		}
+
+		hpm.logger.Warn("Rejected proxy API request",
+			"remote_addr", r.RemoteAddr,
+			"method", r.Method,
+			"path", r.URL.Path)
+		if hpm.apiToken == "" {
+			writeProxyJSON(w, http.StatusForbidden, map[string]string{"error": "proxy API is only served to loopback clients"})
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="k3s-local-agent"`)
+		writeProxyJSON(w, http.StatusUnauthorized, map[string]string{"error": "proxy API token required"})
+	}
+}
+
+// validAPIToken compares the request's bearer token with the API token in constant time
+func (hpm *HTTPProxyManager) validAPIToken(r *http.Request) bool {
+	if hpm.apiToken == "" {
+		return false
+	}
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(hpm.apiToken)) == 1
+}
+
+// isLoopbackClient reports whether a request comes straight from this host. Requests relayed
+// by a tunnel or reverse proxy also arrive over loopback, so forwarding headers disqualify them.
+func isLoopbackClient(r *http.Request) bool {
+	if r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("Forwarded") != "" || r.Header.Get("CF-Connecting-IP") != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // RemoveProxy removes an HTTP proxy
 func (hpm *HTTPProxyManager) RemoveProxy(podID string) error {
 	hpm.mutex.Lock()
@@ -194,8 +523,13 @@ func (hpm *HTTPProxyManager) RemoveProxy(podID string) error {
 		return fmt.Errorf("proxy not found for pod %s", podID)
 	}
 
-	// Remove from proxies map
+	// Stop routing traffic and remove from proxies map
+	hpm.router.Remove(podID).close()
+	if hpm.capture != nil {
+		hpm.capture.clear(podID)
+	}
 	delete(hpm.proxies, podID)
+	hpm.syncGroupRoute(proxy.Group)
 
 	hpm.logger.Info("HTTP proxy removed",
 		"pod", proxy.PodName,
@@ -222,18 +556,29 @@ func (hpm *HTTPProxyManager) GetProxyStatus() map[string]interface{} {
 	hpm.mutex.RLock()
 	defer hpm.mutex.RUnlock()
 
+	proxies := make(map[string]HTTPProxy, len(hpm.proxies))
 	status := map[string]interface{}{
-		"total_proxies":  len(hpm.proxies),
-		"active_proxies": 0,
-		"failed_proxies": 0,
-		"proxies":        hpm.proxies,
-		"timestamp":      time.Now(),
+		"total_proxies":    len(hpm.proxies),
+		"active_proxies":   0,
+		"degraded_proxies": 0,
+		"failed_proxies":   0,
+		"proxies":          proxies,
+		"routes":           hpm.router.Paths(),
+		"hosts":            hpm.router.Hosts(),
+		"groups":           hpm.groupStatusLocked(),
+		"fault_rules":      hpm.faults.list(),
+		"tls":              hpm.tlsStatus(),
+		"timestamp":        time.Now(),
 	}
 
-	for _, proxy := range hpm.proxies {
-		if proxy.Status == "active" {
+	for podID, proxy := range hpm.proxies {
+		proxies[podID] = proxy
+		switch proxy.Status {
+		case "active":
 			status["active_proxies"] = status["active_proxies"].(int) + 1
-		} else if proxy.Status == "failed" {
+		case "degraded":
+			status["degraded_proxies"] = status["degraded_proxies"].(int) + 1
+		case "failed":
 			status["failed_proxies"] = status["failed_proxies"].(int) + 1
 		}
 	}
@@ -241,32 +586,34 @@ func (hpm *HTTPProxyManager) GetProxyStatus() map[string]interface{} {
 	return status
 }
 
-// HealthCheck performs a health check on all proxies
+// HealthCheck probes every proxy immediately and returns the resulting status
 func (hpm *HTTPProxyManager) HealthCheck() map[string]interface{} {
-	status := hpm.GetProxyStatus()
+	hpm.runHealthChecks(true)
+	return hpm.GetProxyStatus()
+}
 
-	// Check each proxy's health
-	for podID, proxy := range hpm.proxies {
-		isHealthy := hpm.isProxyHealthy(&proxy)
-		status["proxies"].(map[string]HTTPProxy)[podID] = proxy
+// RestoreProxies re-registers proxies recovered from persisted state
+func (hpm *HTTPProxyManager) RestoreProxies(proxies map[string]HTTPProxy) {
+	hpm.mutex.Lock()
+	defer hpm.mutex.Unlock()
 
-		if !isHealthy && proxy.Status == "active" {
-			hpm.logger.Warn("Proxy health check failed",
-				"proxy_id", proxy.ProxyID,
-				"pod", proxy.PodName)
+	for podID, proxy := range proxies {
+		if _, exists := hpm.proxies[podID]; exists {
+			continue
 		}
-	}
 
-	return status
-}
+		if proxy.HealthCheck.Path == "" {
+			proxy.HealthCheck = hpm.healthCheck
+		}
 
-// isProxyHealthy checks if a proxy is healthy
-func (hpm *HTTPProxyManager) isProxyHealthy(proxy *HTTPProxy) bool {
-	// Test the proxy endpoint
-	resp, err := http.Get(proxy.ProxyURL)
-	if err != nil {
-		return false
+		if err := hpm.setupProxyRouting(podID, &proxy); err != nil {
+			proxy.Status = "failed"
+			hpm.logger.Error("Failed to restore proxy routing",
+				"pod", proxy.PodName,
+				"error", err)
+		}
+		proxy.UpdatedAt = time.Now()
+		hpm.proxies[podID] = proxy
+		hpm.syncGroupRoute(proxy.Group)
 	}
-	defer resp.Body.Close()
-	return resp.StatusCode < 500
 }
@@ -29,6 +29,7 @@ type PodRedirection struct {
 	LocalPort      int       `json:"local_port"`   // Port forwarding port
 	StagingPort    int       `json:"staging_port"` // Original port from staging
 	Status         string    `json:"status"`       // "active", "failed", "pending"
+	ForwarderPID   int       `json:"forwarder_pid,omitempty"`
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
 }
@@ -58,11 +59,14 @@ func (irm *IPRedirectionManager) SetupRedirection(stagingPod StagingPodInfo, loc
 
 	// Check if redirection already exists
 	if existing, exists := irm.redirections[stagingPod.ID]; exists {
-		irm.logger.Info("Redirection already exists",
-			"pod", stagingPod.Name,
-			"staging_ip", existing.StagingPodIP,
-			"local_ip", existing.LocalPodIP)
-		return &existing, nil
+		if existing.LocalPodIP == localPodIP {
+			irm.logger.Info("Redirection already exists",
+				"pod", stagingPod.Name,
+				"staging_ip", existing.StagingPodIP,
+				"local_ip", existing.LocalPodIP)
+			return &existing, nil
+		}
+		return irm.repointRedirection(stagingPod.ID, existing, localPodIP)
 	}
 
 	// Create new redirection
@@ -72,8 +76,8 @@ func (irm *IPRedirectionManager) SetupRedirection(stagingPod StagingPodInfo, loc
 		StagingPodIP:   stagingPod.IP,
 		LocalPodName:   stagingPod.Name,
 		LocalPodIP:     localPodIP,
-		StagingPort:    80, // Default port
-		LocalPort:      0,  // Will be assigned
+		StagingPort:    stagingPodPort(stagingPod),
+		LocalPort:      0, // Will be assigned
 		Status:         "pending",
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
@@ -114,6 +118,47 @@ func (irm *IPRedirectionManager) SetupRedirection(stagingPod StagingPodInfo, loc
 	return &redirection, nil
 }
 
+// repointRedirection moves an existing redirection to a re-created pod's new IP, keeping its local port
+func (irm *IPRedirectionManager) repointRedirection(podID string, redirection PodRedirection, localPodIP string) (*PodRedirection, error) {
+	irm.logger.Info("Re-pointing IP redirection to new pod IP",
+		"pod", redirection.StagingPodName,
+		"from", redirection.LocalPodIP,
+		"to", localPodIP)
+
+	if err := irm.stopPortForwarding(&redirection); err != nil {
+		irm.logger.Warn("Failed to stop previous port forwarding",
+			"pod", redirection.StagingPodName,
+			"error", err)
+	}
+	if err := irm.removeDNSRedirection(&redirection); err != nil {
+		irm.logger.Warn("Failed to remove previous DNS redirection",
+			"pod", redirection.StagingPodName,
+			"error", err)
+	}
+
+	redirection.LocalPodIP = localPodIP
+	redirection.ForwarderPID = 0
+	redirection.UpdatedAt = time.Now()
+
+	if err := irm.setupPortForwarding(&redirection); err != nil {
+		redirection.Status = "failed"
+		irm.logger.Error("Failed to setup port forwarding",
+			"pod", redirection.StagingPodName,
+			"error", err)
+	} else {
+		redirection.Status = "active"
+	}
+
+	if err := irm.setupDNSRedirection(&redirection); err != nil {
+		irm.logger.Warn("Failed to setup DNS redirection",
+			"pod", redirection.StagingPodName,
+			"error", err)
+	}
+
+	irm.redirections[podID] = redirection
+	return &redirection, nil
+}
+
 // assignLocalPort assigns an available local port for redirection
 func (irm *IPRedirectionManager) assignLocalPort(redirection *PodRedirection) error {
 	// Start from port 8080 and find an available port
@@ -144,28 +189,31 @@ func (irm *IPRedirectionManager) isPortAvailable(port int) bool {
 	return true
 }
 
-// setupPortForwarding sets up port forwarding from local port to staging IP
+// setupPortForwarding sets up port forwarding from the local port to the local pod
 func (irm *IPRedirectionManager) setupPortForwarding(redirection *PodRedirection) error {
-	// Create port forwarding using socat or similar tool
+	targetIP := redirection.LocalPodIP
+	if targetIP == "" {
+		targetIP = redirection.StagingPodIP
+	}
+
+	// Run socat in the background and keep its PID so the forward can be stopped later
 	cmd := exec.Command("socat",
-		"TCP-LISTEN:"+fmt.Sprintf("%d", redirection.LocalPort),
-		fmt.Sprintf("TCP:%s:%d", redirection.StagingPodIP, redirection.StagingPort),
-		"&")
+		fmt.Sprintf("TCP-LISTEN:%d,fork,reuseaddr", redirection.LocalPort),
+		fmt.Sprintf("TCP:%s:%d", targetIP, redirection.StagingPort))
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		// Fallback: try using netcat
-		cmd = exec.Command("nc", "-l", fmt.Sprintf("%d", redirection.LocalPort))
-		output, err = cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("failed to setup port forwarding: %w, output: %s", err, string(output))
-		}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to setup port forwarding: %w", err)
 	}
+	redirection.ForwarderPID = cmd.Process.Pid
+
+	// Reap the process when it exits so it does not linger as a zombie
+	go cmd.Wait()
 
 	irm.logger.Info("Port forwarding setup",
 		"local_port", redirection.LocalPort,
-		"staging_ip", redirection.StagingPodIP,
-		"staging_port", redirection.StagingPort)
+		"target_ip", targetIP,
+		"target_port", redirection.StagingPort,
+		"pid", redirection.ForwarderPID)
 
 	return nil
 }
@@ -224,6 +272,10 @@ func (irm *IPRedirectionManager) RemoveRedirection(podID string) error {
 
 // stopPortForwarding stops port forwarding for a redirection
 func (irm *IPRedirectionManager) stopPortForwarding(redirection *PodRedirection) error {
+	if redirection.ForwarderPID != 0 {
+		return killOwnedProcess(redirection.ForwarderPID, "socat")
+	}
+
 	// Kill processes using the local port
 	cmd := exec.Command("lsof", "-ti", fmt.Sprintf(":%d", redirection.LocalPort))
 	output, err := cmd.Output()
@@ -307,3 +359,15 @@ func (irm *IPRedirectionManager) GetRedirectionStatus() map[string]interface{} {
 
 	return status
 }
+
+// RestoreRedirections reloads redirections recovered from persisted state
+func (irm *IPRedirectionManager) RestoreRedirections(redirections map[string]PodRedirection) {
+	irm.mutex.Lock()
+	defer irm.mutex.Unlock()
+
+	for id, redirection := range redirections {
+		if _, exists := irm.redirections[id]; !exists {
+			irm.redirections[id] = redirection
+		}
+	}
+}
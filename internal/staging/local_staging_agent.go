@@ -2,20 +2,22 @@ package staging
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"net/http"
-	"strings"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"k3s-local-agent/internal/controlplane"
 	"k3s-local-agent/internal/kind"
+	"k3s-local-agent/internal/metrics"
+	"k3s-local-agent/internal/ownership"
 	"k3s-local-agent/pkg/logger"
 
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -26,15 +28,25 @@ type LocalStagingAgent struct {
 	config           *StagingConfig
 	logger           logger.Logger
 	podReceiver      *controlplane.PodReceiver
+	controlPlane     *controlplane.ControlPlaneClient
+	commandChannel   *controlplane.CommandChannel // Polls the control plane for commands; nil when the pod receiver is pushed to
 	kindCluster      *kind.KindCluster
 	k8sClient        *kubernetes.Clientset
+	dynamicClient    dynamic.Interface
 	stagingPods      map[string]StagingPodInfo
+	stagingApps      map[string]StagingAppInfo
+	appSyncCh        chan struct{}
 	cloudflareTunnel *CloudflareTunnelManager
 	httpProxy        *HTTPProxyManager
+	ipRedirection    *IPRedirectionManager
+	stateStore       StateStore
+	pendingDeletions []DeletionResult
+	readinessWatches map[string]*readinessWatch
+	staleTunnels     []CloudflareTunnel // Tunnels recorded by a previous run, stopped by startup GC
+	lastGC           *GCReport
 	mutex            sync.RWMutex
 	stopCh           chan struct{}
 	agentID          string
-	controlPlaneURL  string
 }
 
 // StagingConfig holds configuration for local staging
@@ -42,10 +54,32 @@ type StagingConfig struct {
 	AgentID          string
 	ControlPlaneURL  string
 	ControlPlanePort int
+	ControlPlaneKey  string // API key sent as a bearer token on control plane calls
 	KindClusterName  string
 	LocalNamespace   string
 	AgentPort        int
 	SyncInterval     time.Duration
+	DataDir          string // Directory for persisted agent state; empty disables persistence
+	GCOnShutdown     bool   // Remove all agent-owned resources on graceful shutdown
+	GCDryRun         bool   // Only report what garbage collection would remove
+	ProxyCaptureSize int    // Proxied exchanges kept per proxy for inspection and replay; zero disables capture
+	ProxyTLS         bool   // Serve the HTTP proxy over HTTPS
+	ProxyCertFile    string // Certificate for the proxy; empty issues certificates from a local CA
+	ProxyKeyFile     string
+	ProxyAPIToken    string   // Bearer token for the proxy's traffic and fault APIs; empty allows loopback clients only
+	ProxySecretsDir  string   // Directory holding the auth secrets proxy policies may name
+	AuthTokens       []string // Bearer tokens the control plane must present to the pod receiver
+	AuthTokenFile    string   // File with one accepted token per line, re-read when it changes
+	HMACSecret       string   // Shared secret the control plane signs pod receiver requests with
+	HMACSecretFile   string
+	ClientCertFile   string // Client certificate presented to the control plane
+	ClientKeyFile    string
+	ControlPlaneCA   string // CA bundle verifying the control plane; empty uses the system roots
+	ReceiverCertFile string // Server certificate for the pod receiver; enables HTTPS on the agent port
+	ReceiverKeyFile  string
+	ReceiverClientCA string // CA bundle the control plane's client certificates must chain to
+	CommandChannel   bool   // Poll the control plane for commands instead of exposing the pod receiver through a tunnel
+	CommandWait      time.Duration
 }
 
 // StagingPodInfo represents a staging pod from GCS
@@ -69,7 +103,10 @@ type StagingPodInfo struct {
 	StagingSource string            `json:"staging_source"` // GCS cluster info
 	CreatedAt     time.Time         `json:"created_at"`
 	UpdatedAt     time.Time         `json:"updated_at"`
-	LocalStatus   string            `json:"local_status"` // "created", "running", "failed", "not_created"
+	LocalStatus   string            `json:"local_status"` // "pending", "running", "failed", "completed", "not_created"
+	LocalMessage  string            `json:"local_message,omitempty"`
+	LocalIP       string            `json:"local_ip,omitempty"` // Pod IP in the local kind cluster
+	Spec          *v1.PodSpec       `json:"spec,omitempty"`     // Full staging pod spec, when provided by the control plane
 }
 
 // ContainerPort represents container port configuration
@@ -99,14 +136,58 @@ type StagingStatus struct {
 	RunningPods       int                       `json:"running_pods"`
 	FailedPods        int                       `json:"failed_pods"`
 	StagingPods       map[string]StagingPodInfo `json:"staging_pods"`
+	StagingApps       map[string]StagingAppInfo `json:"staging_apps,omitempty"`
+	Deletions         []DeletionResult          `json:"deletions,omitempty"` // Teardowns since the last accepted report
+	LastGC            *GCReport                 `json:"last_gc,omitempty"`
+	ControlPlane      map[string]interface{}    `json:"control_plane,omitempty"` // Connection status and the last control plane error
 	KindClusterStatus string                    `json:"kind_cluster_status"`
 	LastSync          time.Time                 `json:"last_sync"`
 	Timestamp         time.Time                 `json:"timestamp"`
 }
 
 func NewLocalStagingAgent(config *StagingConfig, log logger.Logger) (*LocalStagingAgent, error) {
+	// Create control plane client for status reports and registration
+	controlPlane, err := controlplane.NewControlPlaneClient(&controlplane.ControlPlaneConfig{
+		BaseURL: config.ControlPlaneURL,
+		APIKey:  config.ControlPlaneKey,
+		AgentID: config.AgentID,
+		Timeout: 30 * time.Second,
+		TLS: &controlplane.TLSConfig{
+			CertFile: config.ClientCertFile,
+			KeyFile:  config.ClientKeyFile,
+			CAFile:   config.ControlPlaneCA,
+		},
+	}, log)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create pod receiver
-	podReceiver := controlplane.NewPodReceiver(config.AgentPort, config.AgentID, log)
+	authConfig := &controlplane.AuthConfig{
+		Tokens:         config.AuthTokens,
+		TokenFile:      config.AuthTokenFile,
+		HMACSecret:     config.HMACSecret,
+		HMACSecretFile: config.HMACSecretFile,
+	}
+	podReceiver := controlplane.NewPodReceiver(&controlplane.PodReceiverConfig{
+		Port:    config.AgentPort,
+		AgentID: config.AgentID,
+		Auth:    authConfig,
+		TLS: &controlplane.TLSConfig{
+			CertFile: config.ReceiverCertFile,
+			KeyFile:  config.ReceiverKeyFile,
+			CAFile:   config.ReceiverClientCA,
+		},
+		ControlPlane: controlPlane,
+	}, log)
+
+	// Create the command channel for outbound-only operation
+	var commandChannel *controlplane.CommandChannel
+	if config.CommandChannel {
+		commandChannel = controlplane.NewCommandChannel(controlPlane, &controlplane.CommandChannelConfig{
+			Wait: config.CommandWait,
+		}, log)
+	}
 
 	// Create kind cluster
 	kindConfig := &kind.KindClusterConfig{
@@ -117,8 +198,8 @@ func NewLocalStagingAgent(config *StagingConfig, log logger.Logger) (*LocalStagi
 	}
 	kindCluster := kind.NewKindCluster(kindConfig, log)
 
-	// Create Kubernetes client
-	k8sClient, err := createK8sClient()
+	// Create Kubernetes clients
+	k8sClient, dynamicClient, err := createK8sClients()
 	if err != nil {
 		log.Warn("Failed to create K8s client, continuing without cluster access", "error", err)
 	}
@@ -133,41 +214,92 @@ func NewLocalStagingAgent(config *StagingConfig, log logger.Logger) (*LocalStagi
 	}
 	cloudflareTunnel := NewCloudflareTunnelManager(tunnelConfig, log)
 
-	// Create HTTP proxy manager
+	// Create HTTP proxy manager; the local CA is kept with the agent state so clients only trust it once
+	proxyCertDir := ""
+	if config.DataDir != "" {
+		proxyCertDir = filepath.Join(config.DataDir, "tls")
+	}
 	proxyConfig := &ProxyConfig{
-		AgentID:   config.AgentID,
-		ProxyPort: 8080,
-		BasePath:  "/",
-		EnableSSL: false,
+		AgentID:        config.AgentID,
+		ProxyPort:      8080,
+		BasePath:       "/",
+		EnableSSL:      config.ProxyTLS,
+		CertDir:        proxyCertDir,
+		CertFile:       config.ProxyCertFile,
+		KeyFile:        config.ProxyKeyFile,
+		TunnelHostname: tunnelConfig.Hostname,
+		FlushInterval:  100 * time.Millisecond,
+		IdleTimeout:    10 * time.Minute,
+		HealthCheck:    DefaultHealthCheckConfig(),
+		GroupLabel:     "app",
+		CaptureSize:    config.ProxyCaptureSize,
+		APIToken:       config.ProxyAPIToken,
+		SecretsDir:     config.ProxySecretsDir,
 	}
 	httpProxy := NewHTTPProxyManager(proxyConfig, log)
 
-	return &LocalStagingAgent{
+	// Create IP redirection manager
+	redirectionConfig := &RedirectionConfig{
+		AgentID:        config.AgentID,
+		LocalHost:      "localhost",
+		PortRangeStart: 8080,
+		PortRangeEnd:   9000,
+	}
+	ipRedirection := NewIPRedirectionManager(redirectionConfig, log)
+
+	// Create state store if persistence is enabled
+	var stateStore StateStore
+	if config.DataDir != "" {
+		fileStore, err := NewFileStateStore(config.DataDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create state store: %w", err)
+		}
+		stateStore = fileStore
+	}
+
+	lsa := &LocalStagingAgent{
 		config:           config,
 		logger:           log,
 		podReceiver:      podReceiver,
+		controlPlane:     controlPlane,
+		commandChannel:   commandChannel,
 		kindCluster:      kindCluster,
 		k8sClient:        k8sClient,
+		dynamicClient:    dynamicClient,
 		stagingPods:      make(map[string]StagingPodInfo),
+		stagingApps:      make(map[string]StagingAppInfo),
+		appSyncCh:        make(chan struct{}, 1),
+		readinessWatches: make(map[string]*readinessWatch),
 		cloudflareTunnel: cloudflareTunnel,
 		httpProxy:        httpProxy,
+		ipRedirection:    ipRedirection,
+		stateStore:       stateStore,
 		stopCh:           make(chan struct{}),
 		agentID:          config.AgentID,
-		controlPlaneURL:  config.ControlPlaneURL,
-	}, nil
+	}
+	metrics.OnScrape(lsa.collectMetrics)
+
+	return lsa, nil
 }
 
 // Start starts the local staging agent
 func (lsa *LocalStagingAgent) Start() error {
 	lsa.logger.Info("Starting local staging agent...")
 
+	// Restore state persisted by a previous run
+	if err := lsa.loadState(); err != nil {
+		lsa.logger.Warn("Failed to load persisted staging state", "error", err)
+	}
+
 	// Start pod receiver server
 	if err := lsa.podReceiver.Start(); err != nil {
 		return fmt.Errorf("failed to start pod receiver: %w", err)
 	}
 
-	// Setup Cloudflare tunnel
-	if lsa.cloudflareTunnel != nil {
+	// Setup Cloudflare tunnel; the command channel needs no inbound connections
+	if lsa.commandChannel != nil {
+		lsa.logger.Info("Command channel enabled, skipping Cloudflare tunnel setup")
+	} else if lsa.cloudflareTunnel != nil {
 		lsa.logger.Info("Setting up Cloudflare tunnel...")
 		if tunnel, err := lsa.cloudflareTunnel.SetupTunnel(); err != nil {
 			lsa.logger.Error("Failed to setup Cloudflare tunnel", "error", err)
@@ -189,6 +321,7 @@ func (lsa *LocalStagingAgent) Start() error {
 				lsa.logger.Error("HTTP proxy server failed", "error", err)
 			}
 		}()
+		go lsa.httpProxy.RunHealthChecks(lsa.stopCh)
 	}
 
 	// Create kind cluster if it doesn't exist
@@ -196,7 +329,17 @@ func (lsa *LocalStagingAgent) Start() error {
 		lsa.logger.Warn("Failed to setup kind cluster", "error", err)
 	}
 
-	// Start staging pod management
+	// Remove agent-owned leftovers that are no longer desired before the controllers start
+	lsa.collectGarbage("startup", true)
+
+	// Start staging app management and apply bundles as soon as they change
+	lsa.podReceiver.SetAppUpdateHandler(func(action string, appIDs []string) {
+		lsa.requestAppSync()
+	})
+	go lsa.manageStagingApps()
+
+	// Start staging pod management; the controller also reconciles restored
+	// pods against what actually exists in the cluster once its cache syncs
 	go lsa.manageStagingPods()
 
 	// Start control plane communication
@@ -205,6 +348,12 @@ func (lsa *LocalStagingAgent) Start() error {
 	// Register with control plane at startup
 	go lsa.registerWithControlPlane()
 
+	// Receive commands over the outbound command channel
+	if lsa.commandChannel != nil {
+		lsa.registerCommandHandlers()
+		go lsa.commandChannel.Run(lsa.stopCh)
+	}
+
 	lsa.logger.Info("Local staging agent started successfully")
 	return nil
 }
@@ -213,11 +362,20 @@ func (lsa *LocalStagingAgent) Start() error {
 func (lsa *LocalStagingAgent) Stop() error {
 	lsa.logger.Info("Stopping local staging agent...")
 	close(lsa.stopCh)
+	lsa.controlPlane.Close()
 
 	if lsa.podReceiver != nil {
 		lsa.podReceiver.Stop()
 	}
 
+	if lsa.config.GCOnShutdown {
+		lsa.collectGarbage("shutdown", false)
+	}
+
+	if err := lsa.saveState(); err != nil {
+		lsa.logger.Error("Failed to persist staging state", "error", err)
+	}
+
 	lsa.logger.Info("Local staging agent stopped successfully")
 	return nil
 }
@@ -242,76 +400,142 @@ func (lsa *LocalStagingAgent) setupKindCluster() error {
 	return nil
 }
 
-// manageStagingPods manages staging pods locally
+// manageStagingPods runs the staging pod controller until the agent stops
 func (lsa *LocalStagingAgent) manageStagingPods() {
-	ticker := time.NewTicker(lsa.config.SyncInterval)
-	defer ticker.Stop()
+	if lsa.k8sClient == nil {
+		lsa.logger.Warn("K8s client not available, staging pods will not be reconciled")
+		return
+	}
 
-	// Initial sync
-	lsa.syncStagingPods()
+	if err := lsa.ensureNamespace(); err != nil {
+		lsa.logger.Error("Failed to ensure local staging namespace", "error", err)
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			lsa.syncStagingPods()
-		case <-lsa.stopCh:
-			lsa.logger.Info("Staging pod management stopped")
-			return
-		}
+	controller := NewStagingPodController(lsa)
+	controller.Run(lsa.stopCh)
+}
+
+// ensureNamespace creates the local staging namespace if it does not exist
+func (lsa *LocalStagingAgent) ensureNamespace() error {
+	namespace := &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: lsa.localNamespace(),
+		},
+	}
+
+	_, err := lsa.k8sClient.CoreV1().Namespaces().Create(context.Background(), namespace, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create namespace %s: %w", namespace.Name, err)
 	}
+	return nil
+}
+
+// localNamespace returns the namespace staging pods are created in
+func (lsa *LocalStagingAgent) localNamespace() string {
+	if lsa.config.LocalNamespace == "" {
+		return "staging"
+	}
+	return lsa.config.LocalNamespace
 }
 
-// syncStagingPods synchronizes staging pods from control plane to local cluster
-func (lsa *LocalStagingAgent) syncStagingPods() {
-	lsa.logger.Debug("Syncing staging pods from control plane...")
+// loadState restores staging pods, received pods, proxies and redirections from the state store
+func (lsa *LocalStagingAgent) loadState() error {
+	if lsa.stateStore == nil {
+		return nil
+	}
+
+	state, err := lsa.stateStore.Load()
+	if err != nil {
+		return err
+	}
 
-	// Get pod data from receiver
-	podData := lsa.podReceiver.GetPodData()
+	if state.AgentID != "" && state.AgentID != lsa.agentID {
+		lsa.logger.Warn("Persisted state belongs to a different agent ID",
+			"persisted_agent_id", state.AgentID,
+			"agent_id", lsa.agentID)
+	}
 
 	lsa.mutex.Lock()
-	defer lsa.mutex.Unlock()
-
-	// Process each pod
-	for _, pod := range podData {
-		stagingPod := lsa.convertToStagingPod(pod)
-
-		// Check if pod already exists locally
-		if existingPod, exists := lsa.stagingPods[stagingPod.ID]; exists {
-			if existingPod.LocalStatus == "not_created" || existingPod.LocalStatus == "failed" {
-				// Try to create the pod locally
-				if err := lsa.createStagingPodLocally(stagingPod); err != nil {
-					lsa.logger.Error("Failed to create staging pod locally",
-						"pod", stagingPod.Name,
-						"error", err)
-					stagingPod.LocalStatus = "failed"
-				} else {
-					stagingPod.LocalStatus = "created"
-				}
-			}
-		} else {
-			// New pod, create it locally
-			if err := lsa.createStagingPodLocally(stagingPod); err != nil {
-				lsa.logger.Error("Failed to create new staging pod locally",
-					"pod", stagingPod.Name,
-					"error", err)
-				stagingPod.LocalStatus = "failed"
-			} else {
-				stagingPod.LocalStatus = "created"
-			}
-		}
+	for id, pod := range state.StagingPods {
+		lsa.stagingPods[id] = pod
+	}
+	for id, app := range state.StagingApps {
+		lsa.stagingApps[id] = app
+	}
+	for _, deletion := range state.PendingDeletions {
+		lsa.recordDeletion(deletion)
+	}
+	for _, tunnel := range state.Tunnels {
+		lsa.staleTunnels = append(lsa.staleTunnels, tunnel)
+	}
+	lsa.mutex.Unlock()
+
+	receivedPods := make([]controlplane.PodInfo, 0, len(state.ReceivedPods))
+	for _, pod := range state.ReceivedPods {
+		receivedPods = append(receivedPods, pod)
+	}
+	lsa.podReceiver.RestorePodData(receivedPods)
+
+	receivedApps := make([]controlplane.AppBundle, 0, len(state.ReceivedApps))
+	for _, app := range state.ReceivedApps {
+		receivedApps = append(receivedApps, app)
+	}
+	lsa.podReceiver.RestoreAppData(receivedApps)
 
-		stagingPod.UpdatedAt = time.Now()
-		lsa.stagingPods[stagingPod.ID] = stagingPod
+	if lsa.httpProxy != nil {
+		lsa.httpProxy.RestoreProxies(state.Proxies)
+	}
+	if lsa.ipRedirection != nil {
+		lsa.ipRedirection.RestoreRedirections(state.Redirections)
 	}
 
-	lsa.logger.Info("Staging pods sync completed",
-		"total_pods", len(podData),
-		"local_pods", len(lsa.stagingPods))
+	lsa.logger.Info("Restored persisted staging state",
+		"staging_pods", len(state.StagingPods),
+		"received_pods", len(state.ReceivedPods),
+		"staging_apps", len(state.StagingApps),
+		"proxies", len(state.Proxies),
+		"redirections", len(state.Redirections),
+		"saved_at", state.SavedAt)
+
+	return nil
 }
 
-// convertToStagingPod converts PodInfo to StagingPodInfo
+// saveState writes the current agent state to the state store
+func (lsa *LocalStagingAgent) saveState() error {
+	if lsa.stateStore == nil {
+		return nil
+	}
+
+	state := newAgentState(lsa.agentID)
+	for id, pod := range lsa.GetStagingPods() {
+		state.StagingPods[id] = pod
+	}
+	for _, pod := range lsa.podReceiver.GetPodData() {
+		state.ReceivedPods[pod.ID] = pod
+	}
+	for id, app := range lsa.GetStagingApps() {
+		state.StagingApps[id] = app
+	}
+	for _, app := range lsa.podReceiver.GetAppData() {
+		state.ReceivedApps[app.ID] = app
+	}
+	state.PendingDeletions = lsa.getPendingDeletions()
+	if lsa.httpProxy != nil {
+		state.Proxies = lsa.httpProxy.GetProxies()
+	}
+	if lsa.ipRedirection != nil {
+		state.Redirections = lsa.ipRedirection.GetRedirections()
+	}
+	if lsa.cloudflareTunnel != nil {
+		state.Tunnels = lsa.cloudflareTunnel.GetTunnels()
+	}
+
+	return lsa.stateStore.Save(state)
+}
+
+// convertToStagingPod converts PodInfo to StagingPodInfo, filling in defaults for missing fields
 func (lsa *LocalStagingAgent) convertToStagingPod(pod controlplane.PodInfo) StagingPodInfo {
-	return StagingPodInfo{
+	stagingPod := StagingPodInfo{
 		ID:            pod.ID,
 		Name:          pod.Name,
 		Namespace:     pod.Namespace,
@@ -320,52 +544,92 @@ func (lsa *LocalStagingAgent) convertToStagingPod(pod controlplane.PodInfo) Stag
 		IP:            pod.IP,
 		NodeName:      pod.NodeName,
 		Labels:        pod.Labels,
+		Annotations:   pod.Annotations,
 		StagingSource: "GCS-Staging-Cluster",
 		CreatedAt:     pod.CreatedAt,
 		UpdatedAt:     pod.UpdatedAt,
 		LocalStatus:   "not_created",
-		// Set default resource requests
-		CPURequest:    "100m",
-		MemoryRequest: "128Mi",
-		CPULimit:      "200m",
-		MemoryLimit:   "256Mi",
-		Ports: []ContainerPort{
+		CPURequest:    valueOrDefault(pod.CPURequest, "100m"),
+		MemoryRequest: valueOrDefault(pod.MemoryRequest, "128Mi"),
+		CPULimit:      valueOrDefault(pod.CPULimit, "200m"),
+		MemoryLimit:   valueOrDefault(pod.MemoryLimit, "256Mi"),
+		Spec:          pod.Spec,
+	}
+
+	for _, port := range pod.Ports {
+		stagingPod.Ports = append(stagingPod.Ports, ContainerPort{
+			Name:          port.Name,
+			ContainerPort: port.ContainerPort,
+			Protocol:      valueOrDefault(port.Protocol, "TCP"),
+		})
+	}
+	if len(stagingPod.Ports) == 0 && pod.Spec == nil {
+		// Default to a single HTTP port so the proxy has something to target
+		stagingPod.Ports = []ContainerPort{
 			{
 				Name:          "http",
 				ContainerPort: 80,
 				Protocol:      "TCP",
 			},
-		},
+		}
+	}
+
+	for _, env := range pod.Environment {
+		stagingPod.Environment = append(stagingPod.Environment, EnvVar{
+			Name:  env.Name,
+			Value: env.Value,
+		})
+	}
+
+	for _, mount := range pod.VolumeMounts {
+		stagingPod.VolumeMounts = append(stagingPod.VolumeMounts, VolumeMount{
+			Name:      mount.Name,
+			MountPath: mount.MountPath,
+		})
 	}
+
+	return stagingPod
 }
 
-// createStagingPodLocally creates a staging pod in the local kind cluster
-func (lsa *LocalStagingAgent) createStagingPodLocally(pod StagingPodInfo) error {
-	if lsa.k8sClient == nil {
-		return fmt.Errorf("K8s client not available")
+// valueOrDefault returns value, or def when value is empty
+func valueOrDefault(value, def string) string {
+	if value == "" {
+		return def
 	}
+	return value
+}
 
-	ctx := context.Background()
+// buildPodSpec builds the local pod spec for a staging pod. A raw spec from the
+// control plane is used as-is; otherwise a single-container spec is built from
+// the image, resources, ports, environment and volume mounts.
+func buildPodSpec(pod StagingPodInfo) (v1.PodSpec, error) {
+	if pod.Spec != nil {
+		spec := pod.Spec.DeepCopy()
+		// Node names and selectors refer to the staging cluster and can never match locally
+		spec.NodeName = ""
+		spec.NodeSelector = nil
+		return *spec, nil
+	}
 
 	// Parse resource requests
 	cpuRequest, err := resource.ParseQuantity(pod.CPURequest)
 	if err != nil {
-		return fmt.Errorf("invalid CPU request: %w", err)
+		return v1.PodSpec{}, fmt.Errorf("invalid CPU request: %w", err)
 	}
 
 	memoryRequest, err := resource.ParseQuantity(pod.MemoryRequest)
 	if err != nil {
-		return fmt.Errorf("invalid memory request: %w", err)
+		return v1.PodSpec{}, fmt.Errorf("invalid memory request: %w", err)
 	}
 
 	cpuLimit, err := resource.ParseQuantity(pod.CPULimit)
 	if err != nil {
-		return fmt.Errorf("invalid CPU limit: %w", err)
+		return v1.PodSpec{}, fmt.Errorf("invalid CPU limit: %w", err)
 	}
 
 	memoryLimit, err := resource.ParseQuantity(pod.MemoryLimit)
 	if err != nil {
-		return fmt.Errorf("invalid memory limit: %w", err)
+		return v1.PodSpec{}, fmt.Errorf("invalid memory limit: %w", err)
 	}
 
 	// Create container ports
@@ -387,69 +651,102 @@ func (lsa *LocalStagingAgent) createStagingPodLocally(pod StagingPodInfo) error
 		})
 	}
 
-	// Create the pod
-	k8sPod := &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:        pod.Name,
-			Namespace:   pod.Namespace,
-			Labels:      pod.Labels,
-			Annotations: pod.Annotations,
-		},
-		Spec: v1.PodSpec{
-			Containers: []v1.Container{
-				{
-					Name:  "main",
-					Image: pod.Image,
-					Ports: containerPorts,
-					Env:   envVars,
-					Resources: v1.ResourceRequirements{
-						Requests: v1.ResourceList{
-							v1.ResourceCPU:    cpuRequest,
-							v1.ResourceMemory: memoryRequest,
-						},
-						Limits: v1.ResourceList{
-							v1.ResourceCPU:    cpuLimit,
-							v1.ResourceMemory: memoryLimit,
-						},
+	// Create volume mounts; without volume sources from the control plane each
+	// named volume is backed by an emptyDir
+	var volumeMounts []v1.VolumeMount
+	var volumes []v1.Volume
+	seenVolumes := make(map[string]bool)
+	for _, mount := range pod.VolumeMounts {
+		volumeMounts = append(volumeMounts, v1.VolumeMount{
+			Name:      mount.Name,
+			MountPath: mount.MountPath,
+		})
+		if !seenVolumes[mount.Name] {
+			seenVolumes[mount.Name] = true
+			volumes = append(volumes, v1.Volume{
+				Name: mount.Name,
+				VolumeSource: v1.VolumeSource{
+					EmptyDir: &v1.EmptyDirVolumeSource{},
+				},
+			})
+		}
+	}
+
+	return v1.PodSpec{
+		Containers: []v1.Container{
+			{
+				Name:         "main",
+				Image:        pod.Image,
+				Ports:        containerPorts,
+				Env:          envVars,
+				VolumeMounts: volumeMounts,
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{
+						v1.ResourceCPU:    cpuRequest,
+						v1.ResourceMemory: memoryRequest,
+					},
+					Limits: v1.ResourceList{
+						v1.ResourceCPU:    cpuLimit,
+						v1.ResourceMemory: memoryLimit,
 					},
 				},
 			},
 		},
+		Volumes: volumes,
+	}, nil
+}
+
+// applyStagingPodLocally creates or updates a staging pod in the local kind cluster using server-side apply
+func (lsa *LocalStagingAgent) applyStagingPodLocally(pod StagingPodInfo) error {
+	if lsa.k8sClient == nil {
+		return fmt.Errorf("K8s client not available")
 	}
 
-	createdPod, err := lsa.k8sClient.CoreV1().Pods(pod.Namespace).Create(ctx, k8sPod, metav1.CreateOptions{})
+	ctx := context.Background()
+
+	spec, err := buildPodSpec(pod)
 	if err != nil {
-		return fmt.Errorf("failed to create pod: %w", err)
+		return err
+	}
+
+	specHash, err := ownership.SpecHash(&spec)
+	if err != nil {
+		return err
+	}
+
+	// Label and annotate the pod so the controller can map it back to its staging pod
+	owner := ownership.Metadata{
+		AgentID:      lsa.agentID,
+		StagingPodID: pod.ID,
+		Source:       pod.StagingSource,
+	}
+	annotations := owner.Annotations(pod.Annotations)
+	annotations[ownership.SpecHashAnnotation] = specHash
+
+	// Apply the pod
+	namespace := lsa.localNamespace()
+	k8sPod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pod.Name,
+			Namespace:   namespace,
+			Labels:      owner.Labels(pod.Labels),
+			Annotations: annotations,
+		},
+		Spec: spec,
+	}
+
+	if _, err := ownership.ApplyPod(ctx, lsa.k8sClient, k8sPod); err != nil {
+		return fmt.Errorf("failed to apply pod: %w", err)
 	}
 
-	lsa.logger.Info("Created staging pod locally",
+	lsa.logger.Info("Applied staging pod locally",
 		"pod", pod.Name,
-		"namespace", pod.Namespace,
+		"namespace", namespace,
 		"image", pod.Image)
 
-	// Setup HTTP proxy if staging pod has an IP
+	// The pod IP is only assigned once the pod is scheduled, so wire up routing in the background
 	if pod.IP != "" {
-		// Get the local pod IP (will be assigned by Kubernetes)
-		localPodIP := createdPod.Status.PodIP
-		if localPodIP == "" {
-			lsa.logger.Warn("Local pod IP not yet assigned, will setup proxy later",
-				"pod", pod.Name)
-		} else {
-			// Setup HTTP proxy
-			proxy, err := lsa.httpProxy.SetupProxy(pod, localPodIP)
-			if err != nil {
-				lsa.logger.Error("Failed to setup HTTP proxy",
-					"pod", pod.Name,
-					"staging_ip", pod.IP,
-					"local_ip", localPodIP,
-					"error", err)
-			} else {
-				lsa.logger.Info("HTTP proxy setup successful",
-					"pod", pod.Name,
-					"staging_ip", proxy.StagingPodIP,
-					"proxy_url", proxy.ProxyURL)
-			}
-		}
+		lsa.watchPodReadiness(pod)
 	}
 
 	return nil
@@ -480,39 +777,14 @@ func (lsa *LocalStagingAgent) sendStatusToControlPlane() {
 
 	status := lsa.GetStagingStatus()
 
-	// Create HTTP client
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
 	// Send status to control plane
-	url := fmt.Sprintf("%s/api/v1/staging/status", lsa.controlPlaneURL)
-	jsonData, err := json.Marshal(status)
-	if err != nil {
-		lsa.logger.Error("Failed to marshal status", "error", err)
-		return
-	}
-
-	req, err := http.NewRequest("POST", url, strings.NewReader(string(jsonData)))
-	if err != nil {
-		lsa.logger.Error("Failed to create request", "error", err)
+	if err := lsa.controlPlane.SendStagingStatus(status.report()); err != nil {
+		lsa.logger.Error("Failed to send status to control plane", "kind", controlplane.ErrorKind(err), "error", err)
 		return
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Agent-ID", lsa.agentID)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		lsa.logger.Error("Failed to send status to control plane", "error", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		lsa.logger.Error("Control plane returned error status", "status", resp.StatusCode)
-		return
-	}
+	// The control plane has now seen these deletion outcomes
+	lsa.clearReportedDeletions(status.Deletions)
 
 	lsa.logger.Info("Successfully sent staging status to control plane",
 		"total_pods", status.TotalPods,
@@ -542,13 +814,28 @@ func (lsa *LocalStagingAgent) GetStagingStatus() *StagingStatus {
 		}
 	}
 
+	// Copy the maps so callers can read and encode the status after the lock is released
+	// while the controllers keep updating them
+	stagingPods := make(map[string]StagingPodInfo, len(lsa.stagingPods))
+	for id, pod := range lsa.stagingPods {
+		stagingPods[id] = pod
+	}
+	stagingApps := make(map[string]StagingAppInfo, len(lsa.stagingApps))
+	for id, app := range lsa.stagingApps {
+		stagingApps[id] = app.clone()
+	}
+
 	return &StagingStatus{
 		AgentID:           lsa.agentID,
 		Status:            "healthy",
 		TotalPods:         len(lsa.stagingPods),
 		RunningPods:       runningPods,
 		FailedPods:        failedPods,
-		StagingPods:       lsa.stagingPods,
+		StagingPods:       stagingPods,
+		StagingApps:       stagingApps,
+		Deletions:         append([]DeletionResult(nil), lsa.pendingDeletions...),
+		LastGC:            lsa.lastGC,
+		ControlPlane:      lsa.controlPlane.GetStatus(),
 		KindClusterStatus: clusterStatus,
 		LastSync:          time.Now(),
 		Timestamp:         time.Now(),
@@ -596,8 +883,13 @@ func (lsa *LocalStagingAgent) registerWithControlPlane() {
 	// Get the current Cloudflare tunnel URL
 	tunnelURL := "https://tunnel-establishing.trycloudflare.com" // Default tunnel URL
 
-	// Try to get the actual tunnel URL from the tunnel manager if available
-	if lsa.cloudflareTunnel != nil {
+	// Agents on the command channel cannot be reached and are sent commands instead
+	delivery := "push"
+	if lsa.commandChannel != nil {
+		tunnelURL = ""
+		delivery = "command_channel"
+	} else if lsa.cloudflareTunnel != nil {
+		// Try to get the actual tunnel URL from the tunnel manager if available
 		tunnels := lsa.cloudflareTunnel.GetTunnels()
 		for _, tunnel := range tunnels {
 			if tunnel.Status == "active" && tunnel.PublicURL != "" {
@@ -610,9 +902,9 @@ func (lsa *LocalStagingAgent) registerWithControlPlane() {
 	// Get current pod data for scheduling information
 	lsa.mutex.RLock()
 	podCount := len(lsa.stagingPods)
-	pods := make([]StagingPodInfo, 0, len(lsa.stagingPods))
+	pods := make([]controlplane.StagingPodSummary, 0, len(lsa.stagingPods))
 	for _, pod := range lsa.stagingPods {
-		pods = append(pods, pod)
+		pods = append(pods, pod.summary())
 	}
 	lsa.mutex.RUnlock()
 
@@ -625,76 +917,51 @@ func (lsa *LocalStagingAgent) registerWithControlPlane() {
 	}
 
 	// Create comprehensive registration payload
-	registrationPayload := map[string]interface{}{
-		"host": tunnelURL,
-		"agent_info": map[string]interface{}{
-			"agent_id":  lsa.agentID,
-			"status":    "healthy",
-			"timestamp": time.Now(),
+	registration := &controlplane.AgentRegistration{
+		Host:     tunnelURL,
+		Delivery: delivery,
+		AgentInfo: controlplane.AgentInfo{
+			AgentID:   lsa.agentID,
+			Status:    "healthy",
+			Timestamp: time.Now(),
 		},
-		"pod_scheduling": map[string]interface{}{
-			"current_pods":   podCount,
-			"available_pods": pods,
-			"capabilities": map[string]interface{}{
-				"staging_pods":      true,
-				"kind_cluster":      true,
-				"http_proxy":        true,
-				"cloudflare_tunnel": true,
-				"auto_scaling":      true,
+		PodScheduling: controlplane.PodScheduling{
+			CurrentPods:   podCount,
+			AvailablePods: pods,
+			Capabilities: controlplane.AgentCapabilities{
+				StagingPods:      true,
+				KindCluster:      true,
+				HTTPProxy:        true,
+				CloudflareTunnel: lsa.commandChannel == nil,
+				CommandChannel:   lsa.commandChannel != nil,
+				AutoScaling:      true,
 			},
-			"resources": map[string]interface{}{
-				"cpu_available":     "4 cores",
-				"memory_available":  "8GB",
-				"storage_available": "100GB",
-				"network_ports":     []int{8080, 8082, 30000, 32767},
+			Resources: controlplane.AgentResources{
+				CPUAvailable:     "4 cores",
+				MemoryAvailable:  "8GB",
+				StorageAvailable: "100GB",
+				NetworkPorts:     []int{8080, 8082, 30000, 32767},
 			},
-			"staging_config": map[string]interface{}{
-				"namespace":      "staging",
-				"cluster_name":   "kind-staging",
-				"sync_interval":  "30s",
-				"auto_scale":     true,
-				"pod_scheduling": true,
+			StagingConfig: controlplane.StagingSettings{
+				Namespace:     "staging",
+				ClusterName:   "kind-staging",
+				SyncInterval:  "30s",
+				AutoScale:     true,
+				PodScheduling: true,
 			},
 		},
-		"endpoints": map[string]string{
+		Endpoints: map[string]string{
 			"health":         "/health",
 			"pod_status":     "/api/v1/pods/status",
 			"register_agent": "/api/v1/register-local-agent",
 			"pod_update":     "/api/v1/pods",
 		},
-		"cluster_status": clusterStatus,
+		ClusterStatus: clusterStatus,
 	}
 
 	// Send registration request
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
-	url := fmt.Sprintf("%s/api/v1/register-local-agent", lsa.controlPlaneURL)
-	jsonData, err := json.Marshal(registrationPayload)
-	if err != nil {
-		lsa.logger.Error("Failed to marshal registration payload", "error", err)
-		return
-	}
-
-	req, err := http.NewRequest("POST", url, strings.NewReader(string(jsonData)))
-	if err != nil {
-		lsa.logger.Error("Failed to create registration request", "error", err)
-		return
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Agent-ID", lsa.agentID)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		lsa.logger.Error("Failed to register with control plane", "error", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		lsa.logger.Error("Control plane registration failed", "status", resp.StatusCode)
+	if err := lsa.controlPlane.Register(registration); err != nil {
+		lsa.logger.Error("Failed to register with control plane", "kind", controlplane.ErrorKind(err), "error", err)
 		return
 	}
 
@@ -704,8 +971,17 @@ func (lsa *LocalStagingAgent) registerWithControlPlane() {
 		"pod_count", podCount)
 }
 
-// createK8sClient creates a Kubernetes client
-func createK8sClient() (*kubernetes.Clientset, error) {
+// stagingPodSpecHash returns the spec hash a staging pod is applied with
+func stagingPodSpecHash(pod StagingPodInfo) (string, error) {
+	spec, err := buildPodSpec(pod)
+	if err != nil {
+		return "", err
+	}
+	return ownership.SpecHash(&spec)
+}
+
+// createK8sClients creates typed and dynamic Kubernetes clients
+func createK8sClients() (*kubernetes.Clientset, dynamic.Interface, error) {
 	// Try to load in-cluster config first
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -713,14 +989,19 @@ func createK8sClient() (*kubernetes.Clientset, error) {
 		kubeconfig := clientcmd.NewDefaultClientConfigLoadingRules().GetDefaultFilename()
 		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+			return nil, nil, fmt.Errorf("failed to load kubeconfig: %w", err)
 		}
 	}
 
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+		return nil, nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create dynamic client: %w", err)
 	}
 
-	return clientset, nil
+	return clientset, dynamicClient, nil
 }
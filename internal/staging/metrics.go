@@ -0,0 +1,134 @@
+package staging
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"k3s-local-agent/internal/metrics"
+)
+
+var (
+	proxyRequests = metrics.NewCounter("k3s_local_agent_proxy_requests_total",
+		"Requests handled by the staging proxy, by route, method and status code.",
+		"route", "method", "code")
+	proxyRequestDuration = metrics.NewHistogram("k3s_local_agent_proxy_request_duration_seconds",
+		"Time to serve proxied requests, by route.",
+		metrics.DefBuckets, "route")
+	proxiesByStatus = metrics.NewGauge("k3s_local_agent_proxies",
+		"HTTP proxies by status.",
+		"status")
+
+	stagingPodsByStatus = metrics.NewGauge("k3s_local_agent_staging_pods",
+		"Staging pods tracked by the agent, by local status.",
+		"status")
+	syncDuration = metrics.NewHistogram("k3s_local_agent_sync_duration_seconds",
+		"Duration of sync loop iterations, by loop.",
+		metrics.DefBuckets, "loop")
+	syncErrors = metrics.NewCounter("k3s_local_agent_sync_errors_total",
+		"Sync loop failures, by loop.",
+		"loop")
+)
+
+// collectMetrics refreshes the gauges derived from agent state before each scrape
+func (lsa *LocalStagingAgent) collectMetrics() {
+	lsa.mutex.RLock()
+	pods := make(map[string]int)
+	for _, pod := range lsa.stagingPods {
+		pods[pod.LocalStatus]++
+	}
+	lsa.mutex.RUnlock()
+
+	stagingPodsByStatus.Reset()
+	for status, count := range pods {
+		stagingPodsByStatus.Set(float64(count), status)
+	}
+
+	if lsa.httpProxy == nil {
+		return
+	}
+	proxies := make(map[string]int)
+	for _, proxy := range lsa.httpProxy.GetProxies() {
+		proxies[proxy.Status]++
+	}
+	proxiesByStatus.Reset()
+	for status, count := range proxies {
+		proxiesByStatus.Set(float64(count), status)
+	}
+}
+
+// instrumentHandler counts and times the requests served by a proxy route
+func instrumentHandler(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		defer func() {
+			code := strconv.Itoa(sw.status)
+			recovered := recover()
+			if recovered != nil {
+				code = "aborted"
+			}
+			proxyRequests.Inc(route, metricMethod(r.Method), code)
+			proxyRequestDuration.ObserveDuration(start, route)
+			if recovered != nil {
+				panic(recovered)
+			}
+		}()
+
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// metricMethod bounds the method label to the standard methods
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+// statusWriter records the response status while passing flushes and hijacks through
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.status = status
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	sw.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,385 @@
+package staging
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k3s-local-agent/internal/ownership"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const controllerWorkers = 2
+
+// StagingPodController reconciles desired staging pods from the PodReceiver
+// against the pods that actually exist in the local kind cluster
+type StagingPodController struct {
+	agent     *LocalStagingAgent
+	factory   informers.SharedInformerFactory
+	podLister corelisters.PodLister
+	podSynced cache.InformerSynced
+	queue     workqueue.TypedRateLimitingInterface[string]
+}
+
+// NewStagingPodController creates a controller watching the agent's local namespace
+func NewStagingPodController(agent *LocalStagingAgent) *StagingPodController {
+	factory := informers.NewSharedInformerFactoryWithOptions(agent.k8sClient, agent.config.SyncInterval,
+		informers.WithNamespace(agent.localNamespace()),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = ownership.ManagedSelector
+		}))
+
+	podInformer := factory.Core().V1().Pods()
+
+	controller := &StagingPodController{
+		agent:     agent,
+		factory:   factory,
+		podLister: podInformer.Lister(),
+		podSynced: podInformer.Informer().HasSynced,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "staging-pods"}),
+	}
+
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: controller.enqueuePod,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			controller.enqueuePod(newObj)
+		},
+		DeleteFunc: controller.enqueuePod,
+	})
+
+	// React to control plane changes immediately instead of waiting for the next resync
+	agent.podReceiver.SetUpdateHandler(func(action string, podIDs []string) {
+		for _, id := range podIDs {
+			controller.queue.Add(id)
+		}
+	})
+
+	return controller
+}
+
+// Run starts the informers and workers and blocks until stopCh is closed
+func (c *StagingPodController) Run(stopCh <-chan struct{}) {
+	defer c.queue.ShutDown()
+
+	c.factory.Start(stopCh)
+
+	c.agent.logger.Info("Waiting for staging pod informer cache to sync...")
+	if !cache.WaitForCacheSync(stopCh, c.podSynced) {
+		c.agent.logger.Error("Failed to sync staging pod informer cache")
+		return
+	}
+
+	for i := 0; i < controllerWorkers; i++ {
+		go c.runWorker()
+	}
+
+	ticker := time.NewTicker(c.agent.config.SyncInterval)
+	defer ticker.Stop()
+
+	// Initial resync also reconciles any state restored from disk
+	c.resync()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.resync()
+		case <-stopCh:
+			c.agent.logger.Info("Staging pod controller stopped")
+			return
+		}
+	}
+}
+
+// resync enqueues every desired and every known staging pod
+func (c *StagingPodController) resync() {
+	desired := c.agent.podReceiver.GetPodData()
+	for _, pod := range desired {
+		c.queue.Add(pod.ID)
+	}
+
+	known := c.agent.GetStagingPods()
+	for id := range known {
+		c.queue.Add(id)
+	}
+
+	// Pick up managed pods that are neither desired nor tracked so they are cleaned up
+	if pods, err := c.podLister.List(labels.Everything()); err == nil {
+		for _, pod := range pods {
+			c.enqueuePod(pod)
+		}
+	}
+
+	if err := c.agent.saveState(); err != nil {
+		c.agent.logger.Error("Failed to persist staging state", "error", err)
+	}
+
+	c.agent.logger.Debug("Staging pod resync queued",
+		"desired_pods", len(desired),
+		"local_pods", len(known))
+}
+
+// enqueuePod maps a Kubernetes pod event back to its staging pod ID
+func (c *StagingPodController) enqueuePod(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+
+	if !ownership.IsOwnedBy(pod.Annotations, c.agent.agentID) {
+		return
+	}
+
+	if id := pod.Annotations[ownership.StagingPodIDAnnotation]; id != "" {
+		c.queue.Add(id)
+	}
+}
+
+func (c *StagingPodController) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *StagingPodController) processNextItem() bool {
+	id, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(id)
+
+	start := time.Now()
+	err := c.reconcile(id)
+	syncDuration.ObserveDuration(start, "pod_reconcile")
+
+	if err != nil {
+		syncErrors.Inc("pod_reconcile")
+		c.agent.logger.Warn("Staging pod reconcile failed, requeueing",
+			"staging_pod_id", id,
+			"error", err)
+		c.queue.AddRateLimited(id)
+		return true
+	}
+
+	c.queue.Forget(id)
+	return true
+}
+
+// reconcile brings a single staging pod's local state in line with the desired state
+func (c *StagingPodController) reconcile(id string) error {
+	lsa := c.agent
+	namespace := lsa.localNamespace()
+
+	desiredInfo, desired := lsa.podReceiver.GetPodByID(id)
+
+	lsa.mutex.RLock()
+	tracked, isTracked := lsa.stagingPods[id]
+	lsa.mutex.RUnlock()
+
+	// Work out which local pod name this ID maps to
+	name := tracked.Name
+	if desired {
+		name = desiredInfo.Name
+	}
+	if name == "" {
+		name = c.findPodNameByID(id)
+	}
+
+	var actual *v1.Pod
+	if name != "" {
+		pod, err := c.podLister.Pods(namespace).Get(name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to read pod from cache: %w", err)
+		}
+		if err == nil {
+			actual = pod
+		}
+	}
+
+	// Pod was removed from the control plane: tear down everything we created for it
+	if !desired {
+		if !isTracked && actual == nil {
+			return nil
+		}
+
+		podName := ""
+		if actual != nil && actual.DeletionTimestamp == nil {
+			podName = actual.Name
+		}
+
+		result := lsa.teardownStagingPod(id, namespace, podName)
+		if !result.Success {
+			return fmt.Errorf("teardown of staging pod %s incomplete: %v", id, result.Errors)
+		}
+
+		lsa.mutex.Lock()
+		delete(lsa.stagingPods, id)
+		lsa.mutex.Unlock()
+		return nil
+	}
+
+	stagingPod := lsa.convertToStagingPod(desiredInfo)
+	if isTracked {
+		stagingPod.CreatedAt = tracked.CreatedAt
+	}
+
+	switch {
+	case actual == nil:
+		// Missing locally (new, deleted by hand, or lost while the agent was down)
+		if err := lsa.applyStagingPodLocally(stagingPod); err != nil {
+			stagingPod.LocalStatus = "failed"
+			stagingPod.LocalMessage = err.Error()
+			lsa.updateStagingPod(stagingPod)
+			return err
+		}
+		stagingPod.LocalStatus = "pending"
+
+	case actual.DeletionTimestamp != nil:
+		// Wait for the old pod to go away; the delete event requeues us
+		stagingPod.LocalStatus = "pending"
+		stagingPod.LocalMessage = "waiting for previous pod to terminate"
+
+	case actual.Status.Phase == v1.PodFailed:
+		// Naked pods are never restarted by Kubernetes, so replace the failed pod
+		stagingPod.LocalStatus = "failed"
+		stagingPod.LocalMessage = actual.Status.Message
+		if err := lsa.deleteLocalPod(namespace, actual.Name); err != nil {
+			return err
+		}
+
+	default:
+		replaced, err := c.rolloutSpecChange(stagingPod, actual)
+		if err != nil {
+			return err
+		}
+		if replaced {
+			stagingPod.LocalStatus = "pending"
+			stagingPod.LocalMessage = "replacing pod to roll out spec change"
+			break
+		}
+		stagingPod.LocalStatus, stagingPod.LocalMessage = localStatusFromPod(actual)
+		stagingPod.LocalIP = actual.Status.PodIP
+
+		// Routing restored from disk may still point at the IP of a previous pod
+		if stagingPod.LocalStatus == "running" && lsa.needsRouting(stagingPod, stagingPod.LocalIP) {
+			lsa.watchPodReadiness(stagingPod)
+		}
+	}
+
+	lsa.updateStagingPod(stagingPod)
+	return nil
+}
+
+// rolloutSpecChange re-applies a pod whose desired spec changed in the control plane.
+// Mutable fields such as the image are updated in place; if Kubernetes rejects the
+// change as immutable the pod is deleted and re-created by a later reconcile.
+func (c *StagingPodController) rolloutSpecChange(stagingPod StagingPodInfo, actual *v1.Pod) (bool, error) {
+	lsa := c.agent
+
+	desiredHash, err := stagingPodSpecHash(stagingPod)
+	if err != nil {
+		return false, err
+	}
+	if actual.Annotations[ownership.SpecHashAnnotation] == desiredHash {
+		return false, nil
+	}
+
+	lsa.logger.Info("Rolling out staging pod spec change",
+		"pod", actual.Name,
+		"from_hash", actual.Annotations[ownership.SpecHashAnnotation],
+		"to_hash", desiredHash)
+
+	err = lsa.applyStagingPodLocally(stagingPod)
+	if err == nil {
+		return false, nil
+	}
+	if !apierrors.IsInvalid(err) {
+		return false, err
+	}
+
+	if err := lsa.deleteLocalPod(actual.Namespace, actual.Name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// findPodNameByID looks up a managed pod by its staging pod ID annotation
+func (c *StagingPodController) findPodNameByID(id string) string {
+	pods, err := c.podLister.Pods(c.agent.localNamespace()).List(labels.Everything())
+	if err != nil {
+		return ""
+	}
+	for _, pod := range pods {
+		if pod.Annotations[ownership.StagingPodIDAnnotation] == id && ownership.IsOwnedBy(pod.Annotations, c.agent.agentID) {
+			return pod.Name
+		}
+	}
+	return ""
+}
+
+// localStatusFromPod derives the staging LocalStatus from a pod's phase and conditions
+func localStatusFromPod(pod *v1.Pod) (string, string) {
+	// Containers stuck pulling or crashing never leave Pending/Running on their own
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil {
+			switch waiting.Reason {
+			case "ImagePullBackOff", "ErrImagePull", "InvalidImageName",
+				"CrashLoopBackOff", "CreateContainerConfigError", "CreateContainerError":
+				return "failed", fmt.Sprintf("%s: %s", waiting.Reason, waiting.Message)
+			}
+		}
+	}
+
+	switch pod.Status.Phase {
+	case v1.PodRunning:
+		if isPodReady(pod) {
+			return "running", ""
+		}
+		return "pending", "containers not ready"
+	case v1.PodSucceeded:
+		return "completed", ""
+	case v1.PodFailed:
+		return "failed", pod.Status.Message
+	default:
+		return "pending", pod.Status.Message
+	}
+}
+
+// deleteLocalPod deletes a pod from the local cluster, ignoring pods that are already gone
+func (lsa *LocalStagingAgent) deleteLocalPod(namespace, name string) error {
+	err := lsa.k8sClient.CoreV1().Pods(namespace).Delete(context.Background(), name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete pod %s: %w", name, err)
+	}
+
+	lsa.logger.Info("Deleted local staging pod", "pod", name, "namespace", namespace)
+	return nil
+}
+
+// updateStagingPod records the latest view of a staging pod
+func (lsa *LocalStagingAgent) updateStagingPod(pod StagingPodInfo) {
+	lsa.mutex.Lock()
+	defer lsa.mutex.Unlock()
+
+	if existing, exists := lsa.stagingPods[pod.ID]; exists && existing.LocalStatus != pod.LocalStatus {
+		lsa.logger.Info("Staging pod status changed",
+			"pod", pod.Name,
+			"from", existing.LocalStatus,
+			"to", pod.LocalStatus)
+	}
+
+	pod.UpdatedAt = time.Now()
+	lsa.stagingPods[pod.ID] = pod
+}
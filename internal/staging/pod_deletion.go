@@ -0,0 +1,126 @@
+package staging
+
+import (
+	"time"
+)
+
+// DeletionResult reports the outcome of tearing down a staging pod removed by the control plane
+type DeletionResult struct {
+	StagingPodID       string    `json:"staging_pod_id"`
+	PodName            string    `json:"pod_name"`
+	Success            bool      `json:"success"`
+	PodDeleted         bool      `json:"pod_deleted"`
+	ProxyRemoved       bool      `json:"proxy_removed"`
+	RedirectionRemoved bool      `json:"redirection_removed"`
+	Errors             []string  `json:"errors,omitempty"`
+	DeletedAt          time.Time `json:"deleted_at"`
+}
+
+// teardownStagingPod deletes the local pod, HTTP proxy and IP redirection for a staging pod.
+// Partial failures are recorded in the result so they can be reported to the control plane.
+func (lsa *LocalStagingAgent) teardownStagingPod(id, namespace, podName string) DeletionResult {
+	result := DeletionResult{
+		StagingPodID: id,
+		PodName:      podName,
+		DeletedAt:    time.Now(),
+	}
+
+	lsa.cancelReadinessWatch(id)
+
+	if podName != "" && lsa.k8sClient != nil {
+		if err := lsa.deleteLocalPod(namespace, podName); err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		} else {
+			result.PodDeleted = true
+		}
+	}
+
+	if lsa.httpProxy != nil {
+		if _, exists := lsa.httpProxy.GetProxies()[id]; exists {
+			if err := lsa.httpProxy.RemoveProxy(id); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			} else {
+				result.ProxyRemoved = true
+			}
+		}
+	}
+
+	if lsa.ipRedirection != nil {
+		if _, exists := lsa.ipRedirection.GetRedirections()[id]; exists {
+			if err := lsa.ipRedirection.RemoveRedirection(id); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			} else {
+				result.RedirectionRemoved = true
+			}
+		}
+	}
+
+	result.Success = len(result.Errors) == 0
+
+	lsa.mutex.Lock()
+	result = lsa.recordDeletion(result)
+	lsa.mutex.Unlock()
+
+	lsa.logger.Info("Staging pod teardown completed",
+		"staging_pod_id", id,
+		"pod", podName,
+		"pod_deleted", result.PodDeleted,
+		"proxy_removed", result.ProxyRemoved,
+		"redirection_removed", result.RedirectionRemoved,
+		"success", result.Success)
+
+	return result
+}
+
+// recordDeletion stores a teardown result, replacing any unreported result for the same staging
+// pod so a teardown retried by the controller is reported once. Steps completed by earlier
+// attempts are carried over. The caller must hold lsa.mutex.
+func (lsa *LocalStagingAgent) recordDeletion(result DeletionResult) DeletionResult {
+	for i, previous := range lsa.pendingDeletions {
+		if previous.StagingPodID != result.StagingPodID {
+			continue
+		}
+		result.PodDeleted = result.PodDeleted || previous.PodDeleted
+		result.ProxyRemoved = result.ProxyRemoved || previous.ProxyRemoved
+		result.RedirectionRemoved = result.RedirectionRemoved || previous.RedirectionRemoved
+		lsa.pendingDeletions[i] = result
+		return result
+	}
+	lsa.pendingDeletions = append(lsa.pendingDeletions, result)
+	return result
+}
+
+// getPendingDeletions returns deletion results not yet reported to the control plane
+func (lsa *LocalStagingAgent) getPendingDeletions() []DeletionResult {
+	lsa.mutex.RLock()
+	defer lsa.mutex.RUnlock()
+
+	result := make([]DeletionResult, len(lsa.pendingDeletions))
+	copy(result, lsa.pendingDeletions)
+	return result
+}
+
+// clearReportedDeletions drops the reported deletion results once the control plane accepted them.
+// A result replaced by a later retry since the report was taken is kept.
+func (lsa *LocalStagingAgent) clearReportedDeletions(reported []DeletionResult) {
+	lsa.mutex.Lock()
+	defer lsa.mutex.Unlock()
+
+	remaining := lsa.pendingDeletions[:0]
+	for _, pending := range lsa.pendingDeletions {
+		if !containsDeletion(reported, pending) {
+			remaining = append(remaining, pending)
+		}
+	}
+	lsa.pendingDeletions = remaining
+}
+
+// containsDeletion reports whether results holds exactly this teardown attempt
+func containsDeletion(results []DeletionResult, result DeletionResult) bool {
+	for _, r := range results {
+		if r.StagingPodID == result.StagingPodID && r.DeletedAt.Equal(result.DeletedAt) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package staging
+
+import (
+	"context"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	podReadyTimeout      = 5 * time.Minute
+	podReadyPollInterval = 2 * time.Second
+)
+
+// readinessWatch tracks a background wait for a local pod to become ready
+type readinessWatch struct {
+	cancel context.CancelFunc
+}
+
+// watchPodReadiness waits in the background for the local copy of a staging pod to become
+// Ready with an IP, then points its HTTP proxy and IP redirection at that IP. Any watch
+// already running for the pod is replaced, so a re-created pod is always re-pointed.
+func (lsa *LocalStagingAgent) watchPodReadiness(pod StagingPodInfo) {
+	ctx, cancel := context.WithTimeout(context.Background(), podReadyTimeout)
+	watch := &readinessWatch{cancel: cancel}
+
+	lsa.mutex.Lock()
+	if existing, exists := lsa.readinessWatches[pod.ID]; exists {
+		existing.cancel()
+	}
+	lsa.readinessWatches[pod.ID] = watch
+	lsa.mutex.Unlock()
+
+	go func() {
+		defer lsa.finishReadinessWatch(pod.ID, watch)
+
+		// Stop waiting when the agent shuts down
+		go func() {
+			select {
+			case <-lsa.stopCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		localIP, err := lsa.waitForPodIP(ctx, lsa.localNamespace(), pod.Name)
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				lsa.logger.Warn("Timed out waiting for local pod to become ready",
+					"pod", pod.Name,
+					"timeout", podReadyTimeout)
+			}
+			return
+		}
+
+		lsa.routeStagingPod(pod, localIP)
+	}()
+}
+
+// waitForPodIP polls a pod until it is Ready and has been assigned an IP
+func (lsa *LocalStagingAgent) waitForPodIP(ctx context.Context, namespace, name string) (string, error) {
+	var localIP string
+	err := wait.PollUntilContextCancel(ctx, podReadyPollInterval, true, func(ctx context.Context) (bool, error) {
+		pod, err := lsa.k8sClient.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			// The pod may not exist yet while it is being re-created
+			if apierrors.IsNotFound(err) {
+				return false, nil
+			}
+			lsa.logger.Debug("Failed to read local pod while waiting for readiness",
+				"pod", name,
+				"error", err)
+			return false, nil
+		}
+
+		if pod.DeletionTimestamp != nil || pod.Status.PodIP == "" || !isPodReady(pod) {
+			return false, nil
+		}
+		localIP = pod.Status.PodIP
+		return true, nil
+	})
+	return localIP, err
+}
+
+// routeStagingPod points the HTTP proxy and IP redirection for a staging pod at its local IP
+func (lsa *LocalStagingAgent) routeStagingPod(pod StagingPodInfo, localIP string) {
+	if lsa.httpProxy != nil {
+		proxy, err := lsa.httpProxy.SetupProxy(pod, localIP)
+		if err != nil {
+			lsa.logger.Error("Failed to setup HTTP proxy",
+				"pod", pod.Name,
+				"staging_ip", pod.IP,
+				"local_ip", localIP,
+				"error", err)
+		} else {
+			lsa.logger.Info("HTTP proxy setup successful",
+				"pod", pod.Name,
+				"staging_ip", proxy.StagingPodIP,
+				"local_ip", proxy.LocalPodIP,
+				"proxy_url", proxy.ProxyURL)
+		}
+	}
+
+	if lsa.ipRedirection != nil {
+		if _, err := lsa.ipRedirection.SetupRedirection(pod, localIP); err != nil {
+			lsa.logger.Error("Failed to setup IP redirection",
+				"pod", pod.Name,
+				"staging_ip", pod.IP,
+				"local_ip", localIP,
+				"error", err)
+		}
+	}
+}
+
+// needsRouting reports whether a ready staging pod's proxy or redirection is missing or
+// still points at an old IP, e.g. after the agent restarted or the pod was re-created
+func (lsa *LocalStagingAgent) needsRouting(pod StagingPodInfo, localIP string) bool {
+	if pod.IP == "" || localIP == "" {
+		return false
+	}
+
+	lsa.mutex.RLock()
+	_, watching := lsa.readinessWatches[pod.ID]
+	lsa.mutex.RUnlock()
+	if watching {
+		return false
+	}
+
+	if lsa.httpProxy != nil {
+		if proxy, exists := lsa.httpProxy.GetProxies()[pod.ID]; !exists || proxy.LocalPodIP != localIP {
+			return true
+		}
+	}
+	if lsa.ipRedirection != nil {
+		if redirection, exists := lsa.ipRedirection.GetRedirections()[pod.ID]; !exists || redirection.LocalPodIP != localIP {
+			return true
+		}
+	}
+	return false
+}
+
+// cancelReadinessWatch stops any pending readiness wait for a staging pod
+func (lsa *LocalStagingAgent) cancelReadinessWatch(id string) {
+	lsa.mutex.Lock()
+	defer lsa.mutex.Unlock()
+
+	if watch, exists := lsa.readinessWatches[id]; exists {
+		watch.cancel()
+		delete(lsa.readinessWatches, id)
+	}
+}
+
+// finishReadinessWatch releases a readiness watch unless it has already been replaced
+func (lsa *LocalStagingAgent) finishReadinessWatch(id string, watch *readinessWatch) {
+	watch.cancel()
+
+	lsa.mutex.Lock()
+	defer lsa.mutex.Unlock()
+
+	if lsa.readinessWatches[id] == watch {
+		delete(lsa.readinessWatches, id)
+	}
+}
+
+// isPodReady reports whether a pod's Ready condition is true
+func isPodReady(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// stagingPodPort returns the port traffic for a staging pod should be sent to
+func stagingPodPort(pod StagingPodInfo) int {
+	if len(pod.Ports) > 0 && pod.Ports[0].ContainerPort > 0 {
+		return int(pod.Ports[0].ContainerPort)
+	}
+	if pod.Spec != nil {
+		for _, container := range pod.Spec.Containers {
+			if len(container.Ports) > 0 {
+				return int(container.Ports[0].ContainerPort)
+			}
+		}
+	}
+	return 80
+}
@@ -0,0 +1,274 @@
+package staging
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastConnections = "least-connections"
+	BalanceConsistentHash   = "consistent-hash"
+
+	// balanceAnnotation selects the strategy for the pod's group; hashHeaderAnnotation
+	// names the request header hashed by the consistent-hash strategy
+	balanceAnnotation    = "k3s-local-agent/proxy-balance"
+	hashHeaderAnnotation = "k3s-local-agent/proxy-hash-header"
+
+	// groupRoutePrefix keeps group routes apart from per-pod routes in the routing table
+	groupRoutePrefix = "group:"
+)
+
+// ProxyGroup describes a route that balances requests across every pod sharing a group label value
+type ProxyGroup struct {
+	Name            string   `json:"name"`
+	LocalPath       string   `json:"local_path"`
+	Hosts           []string `json:"hosts,omitempty"`
+	ProxyURL        string   `json:"proxy_url"`
+	Strategy        string   `json:"strategy"`
+	HashHeader      string   `json:"hash_header,omitempty"`
+	Backends        []string `json:"backends"` // Pod names
+	HealthyBackends int      `json:"healthy_backends"`
+}
+
+// loadBalancer picks a backend pod for each request to a group route
+type loadBalancer struct {
+	strategy   string
+	hashHeader string
+	next       uint64
+	inflight   map[string]int
+	mutex      sync.Mutex
+}
+
+func newLoadBalancer(strategy, hashHeader string) *loadBalancer {
+	return &loadBalancer{
+		strategy:   strategy,
+		hashHeader: hashHeader,
+		inflight:   make(map[string]int),
+	}
+}
+
+// pick chooses a backend pod ID from a non-empty, sorted list
+func (lb *loadBalancer) pick(r *http.Request, backends []string) string {
+	switch lb.strategy {
+	case BalanceLeastConnections:
+		// Start at a rotating offset so ties are spread evenly
+		offset := int(atomic.AddUint64(&lb.next, 1) - 1)
+
+		lb.mutex.Lock()
+		defer lb.mutex.Unlock()
+
+		best := backends[offset%len(backends)]
+		for i := 1; i < len(backends); i++ {
+			candidate := backends[(offset+i)%len(backends)]
+			if lb.inflight[candidate] < lb.inflight[best] {
+				best = candidate
+			}
+		}
+		return best
+
+	case BalanceConsistentHash:
+		// Rendezvous hashing only remaps the keys of backends that come or go
+		key := r.Header.Get(lb.hashHeader)
+		if key == "" {
+			key = clientIP(r)
+		}
+
+		var best string
+		var bestScore uint64
+		for _, backend := range backends {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte{0})
+			h.Write([]byte(backend))
+			if score := h.Sum64(); best == "" || score > bestScore {
+				best, bestScore = backend, score
+			}
+		}
+		return best
+
+	default:
+		i := atomic.AddUint64(&lb.next, 1) - 1
+		return backends[i%uint64(len(backends))]
+	}
+}
+
+// acquire counts a request against a backend until the returned func is called
+func (lb *loadBalancer) acquire(backend string) func() {
+	lb.mutex.Lock()
+	lb.inflight[backend]++
+	lb.mutex.Unlock()
+
+	return func() {
+		lb.mutex.Lock()
+		defer lb.mutex.Unlock()
+		if lb.inflight[backend]--; lb.inflight[backend] <= 0 {
+			delete(lb.inflight, backend)
+		}
+	}
+}
+
+// syncGroupRoute registers, updates or removes the balanced route for a group.
+// Must be called with hpm.mutex held.
+func (hpm *HTTPProxyManager) syncGroupRoute(group string) {
+	if group == "" {
+		return
+	}
+
+	key := groupRoutePrefix + group
+	members := hpm.groupMembersLocked(group, false)
+	if len(members) == 0 {
+		hpm.router.Remove(key)
+		delete(hpm.balancers, group)
+		hpm.logger.Info("HTTP proxy group removed", "group", group)
+		return
+	}
+
+	// The first member by pod ID decides the strategy so every replica agrees
+	first := hpm.proxies[members[0]]
+	strategy := balanceStrategy(first.Balance)
+
+	lb, exists := hpm.balancers[group]
+	if !exists || lb.strategy != strategy || lb.hashHeader != first.HashHeader {
+		lb = newLoadBalancer(strategy, first.HashHeader)
+		hpm.balancers[group] = lb
+	}
+
+	hpm.router.Set(&proxyRoute{
+		podID:       key,
+		prefix:      groupPath(group),
+		hosts:       hpm.groupHosts(group),
+		stripPrefix: true,
+		handler:     hpm.groupHandler(group, lb),
+	})
+
+	if !exists {
+		hpm.logger.Info("HTTP proxy group created",
+			"group", group,
+			"strategy", strategy,
+			"local_path", groupPath(group))
+	}
+}
+
+// groupHandler balances requests across the healthy members of a group
+func (hpm *HTTPProxyManager) groupHandler(group string, lb *loadBalancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hpm.mutex.RLock()
+		backends := hpm.groupMembersLocked(group, true)
+		hpm.mutex.RUnlock()
+
+		var route *proxyRoute
+		if len(backends) > 0 {
+			route, _ = hpm.router.Get(lb.pick(r, backends))
+		}
+		if route == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": "no healthy backends",
+				"group": group,
+			})
+			return
+		}
+
+		release := lb.acquire(route.podID)
+		defer release()
+		route.handler.ServeHTTP(w, r)
+	})
+}
+
+// groupMembersLocked returns the sorted pod IDs of a group's proxies. With healthyOnly,
+// failed proxies are left out and degraded ones are only used when nothing is active.
+// Must be called with hpm.mutex held.
+func (hpm *HTTPProxyManager) groupMembersLocked(group string, healthyOnly bool) []string {
+	var all, active, degraded []string
+	for podID, proxy := range hpm.proxies {
+		if proxy.Group != group {
+			continue
+		}
+		all = append(all, podID)
+		switch proxy.Status {
+		case "active":
+			active = append(active, podID)
+		case "degraded":
+			degraded = append(degraded, podID)
+		}
+	}
+
+	members := all
+	if healthyOnly {
+		members = active
+		if len(members) == 0 {
+			members = degraded
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// groupStatusLocked summarises every proxy group. Must be called with hpm.mutex held.
+func (hpm *HTTPProxyManager) groupStatusLocked() map[string]ProxyGroup {
+	groups := make(map[string]ProxyGroup, len(hpm.balancers))
+	for name, lb := range hpm.balancers {
+		group := ProxyGroup{
+			Name:            name,
+			LocalPath:       groupPath(name),
+			Hosts:           hpm.groupHosts(name),
+			ProxyURL:        fmt.Sprintf("%s://localhost:%d%s", hpm.scheme(), hpm.proxyPort, groupPath(name)),
+			Strategy:        lb.strategy,
+			HashHeader:      lb.hashHeader,
+			HealthyBackends: len(hpm.groupMembersLocked(name, true)),
+		}
+		for _, podID := range hpm.groupMembersLocked(name, false) {
+			group.Backends = append(group.Backends, hpm.proxies[podID].PodName)
+		}
+		groups[name] = group
+	}
+	return groups
+}
+
+// groupPath returns the local path a group is served under. Groups live under /groups so a
+// pod named after its group label keeps its own /<pod> route.
+func groupPath(group string) string {
+	return "/groups/" + group
+}
+
+// groupHosts returns the Host names a group is served under: <group>.group.<agent-id>.localhost
+// and, when a tunnel is configured, <group>.group.<tunnel-hostname>. Pod names become a single
+// DNS label, so these never collide with the hosts of a pod.
+func (hpm *HTTPProxyManager) groupHosts(group string) []string {
+	name := dnsLabel(group)
+	if name == "" {
+		return nil
+	}
+
+	hosts := []string{fmt.Sprintf("%s.group.%s.localhost", name, dnsLabel(hpm.agentID))}
+	if hpm.tunnelHostname != "" {
+		hosts = append(hosts, fmt.Sprintf("%s.group.%s", name, normalizeHost(hpm.tunnelHostname)))
+	}
+	return hosts
+}
+
+// balanceStrategy validates a strategy name, defaulting to round-robin
+func balanceStrategy(strategy string) string {
+	switch strategy {
+	case BalanceLeastConnections, BalanceConsistentHash:
+		return strategy
+	default:
+		return BalanceRoundRobin
+	}
+}
+
+// clientIP returns the remote address of a request without its port
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
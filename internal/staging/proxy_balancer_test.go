@@ -0,0 +1,158 @@
+package staging
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestBalanceStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		{"", BalanceRoundRobin},
+		{"round-robin", BalanceRoundRobin},
+		{"least-connections", BalanceLeastConnections},
+		{"consistent-hash", BalanceConsistentHash},
+		{"random", BalanceRoundRobin},
+	}
+	for _, tt := range tests {
+		if got := balanceStrategy(tt.strategy); got != tt.want {
+			t.Errorf("balanceStrategy(%q) = %q, want %q", tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestRoundRobinPick(t *testing.T) {
+	lb := newLoadBalancer(BalanceRoundRobin, "")
+	backends := []string{"a", "b", "c"}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	var picks []string
+	for i := 0; i < 7; i++ {
+		picks = append(picks, lb.pick(r, backends))
+	}
+	if want := []string{"a", "b", "c", "a", "b", "c", "a"}; !reflect.DeepEqual(picks, want) {
+		t.Errorf("picks = %v, want %v", picks, want)
+	}
+}
+
+func TestLeastConnectionsPick(t *testing.T) {
+	tests := []struct {
+		name     string
+		inflight map[string]int
+		want     []string // Acceptable picks
+	}{
+		{"fewest in flight", map[string]int{"a": 3, "b": 1, "c": 2}, []string{"b"}},
+		{"idle backend", map[string]int{"a": 1, "c": 1}, []string{"b"}},
+		{"tie", map[string]int{"a": 2, "b": 1, "c": 1}, []string{"b", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newLoadBalancer(BalanceLeastConnections, "")
+			for backend, n := range tt.inflight {
+				for i := 0; i < n; i++ {
+					lb.acquire(backend)
+				}
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			for i := 0; i < 6; i++ {
+				got := lb.pick(r, []string{"a", "b", "c"})
+				if !slices.Contains(tt.want, got) {
+					t.Fatalf("pick %d = %q, want one of %v", i, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLeastConnectionsSpreadsTies(t *testing.T) {
+	lb := newLoadBalancer(BalanceLeastConnections, "")
+	r := httptest.NewRequest("GET", "/", nil)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		seen[lb.pick(r, []string{"a", "b", "c"})] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("idle backends picked = %v, want all three", seen)
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	lb := newLoadBalancer(BalanceLeastConnections, "")
+	release := lb.acquire("a")
+	lb.acquire("a")
+	if lb.inflight["a"] != 2 {
+		t.Fatalf("inflight = %d, want 2", lb.inflight["a"])
+	}
+	release()
+	if lb.inflight["a"] != 1 {
+		t.Errorf("inflight after release = %d, want 1", lb.inflight["a"])
+	}
+
+	lb.acquire("b")()
+	if _, exists := lb.inflight["b"]; exists {
+		t.Error("idle backend is still tracked")
+	}
+}
+
+func TestConsistentHashPick(t *testing.T) {
+	lb := newLoadBalancer(BalanceConsistentHash, "X-Session")
+	backends := []string{"a", "b", "c", "d"}
+
+	request := func(session, remoteAddr string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		if session != "" {
+			r.Header.Set("X-Session", session)
+		}
+		return lb.pick(r, backends)
+	}
+
+	// The same key always lands on the same backend, whatever the client address
+	first := request("user-1", "10.0.0.1:1234")
+	for i := 0; i < 5; i++ {
+		if got := request("user-1", fmt.Sprintf("10.0.0.%d:80", i+2)); got != first {
+			t.Fatalf("pick = %q, want %q for the same session", got, first)
+		}
+	}
+
+	// Without the header the client IP is the key, ignoring the port
+	if request("", "10.1.1.1:1000") != request("", "10.1.1.1:2000") {
+		t.Error("same client IP picked different backends")
+	}
+
+	// Keys spread across backends
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		seen[request(fmt.Sprintf("user-%d", i), "10.0.0.1:1")] = true
+	}
+	if len(seen) != len(backends) {
+		t.Errorf("backends used = %d, want %d", len(seen), len(backends))
+	}
+}
+
+func TestConsistentHashRemapsOnlyRemovedBackend(t *testing.T) {
+	lb := newLoadBalancer(BalanceConsistentHash, "X-Session")
+	before := []string{"a", "b", "c", "d"}
+	after := []string{"a", "b", "d"}
+
+	for i := 0; i < 200; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Session", fmt.Sprintf("user-%d", i))
+
+		old, now := lb.pick(r, before), lb.pick(r, after)
+		if old != "c" && old != now {
+			t.Errorf("key %d moved from %q to %q although %q is still a backend", i, old, now, old)
+		}
+		if now == "c" {
+			t.Errorf("key %d picked removed backend", i)
+		}
+	}
+}
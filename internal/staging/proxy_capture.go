@@ -0,0 +1,497 @@
+package staging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// defaultCaptureBodyLimit bounds how much of each request and response body is kept
+const defaultCaptureBodyLimit = 64 * 1024
+
+// redactedValue replaces credential header values in captured exchanges
+const redactedValue = "[REDACTED]"
+
+// credentialHeaders are never stored by capture, and so never appear in listings, HAR
+// exports or replays
+var credentialHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// CapturedExchange is a request/response pair recorded by the proxy
+type CapturedExchange struct {
+	ID        uint64           `json:"id"`
+	PodID     string           `json:"pod_id"`
+	ProxyID   string           `json:"proxy_id"`
+	StartedAt time.Time        `json:"started_at"`
+	Duration  time.Duration    `json:"duration"`
+	Request   CapturedRequest  `json:"request"`
+	Response  CapturedResponse `json:"response"`
+	Upgraded  bool             `json:"upgraded,omitempty"` // Bodies of upgraded connections are not captured
+}
+
+// CapturedRequest holds the metadata and (truncated) body of a proxied request as the proxy
+// received it: after route prefix stripping, but before the pod's header policy and credential
+// injection are applied
+type CapturedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"` // Request URI after prefix stripping
+	Host   string      `json:"host"`
+	Proto  string      `json:"proto"`
+	Header http.Header `json:"header"`
+	CapturedBody
+}
+
+// CapturedResponse holds the metadata and (truncated) body of an upstream response
+type CapturedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	CapturedBody
+}
+
+// CapturedBody is a size-limited copy of a message body
+type CapturedBody struct {
+	Body          string `json:"body,omitempty"`
+	BodyEncoding  string `json:"body_encoding,omitempty"` // "base64" for non-UTF-8 bodies
+	BodySize      int64  `json:"body_size"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+}
+
+// setBody stores data as text, or base64 when it is not valid UTF-8
+func (b *CapturedBody) setBody(data []byte, size int64, truncated bool) {
+	b.BodySize = size
+	b.BodyTruncated = truncated
+	if utf8.Valid(data) {
+		b.Body = string(data)
+		return
+	}
+	b.Body = base64.StdEncoding.EncodeToString(data)
+	b.BodyEncoding = "base64"
+}
+
+// bytes returns the decoded body
+func (b *CapturedBody) bytes() ([]byte, error) {
+	if b.BodyEncoding == "base64" {
+		return base64.StdEncoding.DecodeString(b.Body)
+	}
+	return []byte(b.Body), nil
+}
+
+// captureStore keeps a fixed-size ring of recent exchanges per proxy
+type captureStore struct {
+	size      int
+	bodyLimit int64
+	nextID    uint64
+	rings     map[string]*captureRing
+	mutex     sync.RWMutex
+}
+
+type captureRing struct {
+	entries []CapturedExchange
+	start   int
+}
+
+func newCaptureStore(size int, bodyLimit int64) *captureStore {
+	if bodyLimit <= 0 {
+		bodyLimit = defaultCaptureBodyLimit
+	}
+	return &captureStore{
+		size:      size,
+		bodyLimit: bodyLimit,
+		rings:     make(map[string]*captureRing),
+	}
+}
+
+// add records an exchange, evicting the oldest once the ring is full
+func (cs *captureStore) add(podID string, exchange CapturedExchange) {
+	exchange.ID = atomic.AddUint64(&cs.nextID, 1)
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	ring, exists := cs.rings[podID]
+	if !exists {
+		ring = &captureRing{}
+		cs.rings[podID] = ring
+	}
+
+	if len(ring.entries) < cs.size {
+		ring.entries = append(ring.entries, exchange)
+		return
+	}
+	ring.entries[ring.start] = exchange
+	ring.start = (ring.start + 1) % cs.size
+}
+
+// list returns a proxy's exchanges from oldest to newest
+func (cs *captureStore) list(podID string) []CapturedExchange {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	ring, exists := cs.rings[podID]
+	if !exists {
+		return []CapturedExchange{}
+	}
+
+	result := make([]CapturedExchange, 0, len(ring.entries))
+	result = append(result, ring.entries[ring.start:]...)
+	result = append(result, ring.entries[:ring.start]...)
+	return result
+}
+
+// get returns a single captured exchange
+func (cs *captureStore) get(podID string, id uint64) (CapturedExchange, bool) {
+	for _, exchange := range cs.list(podID) {
+		if exchange.ID == id {
+			return exchange, true
+		}
+	}
+	return CapturedExchange{}, false
+}
+
+// clear drops everything captured for a proxy
+func (cs *captureStore) clear(podID string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.rings, podID)
+}
+
+// captureHandler records every exchange passing through next when capture is enabled
+func (hpm *HTTPProxyManager) captureHandler(podID, proxyID string, next http.Handler) http.Handler {
+	if hpm.capture == nil {
+		return next
+	}
+
+	limit := hpm.capture.bodyLimit
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchange := CapturedExchange{
+			PodID:     podID,
+			ProxyID:   proxyID,
+			StartedAt: time.Now(),
+			Upgraded:  isUpgradeRequest(r),
+			Request: CapturedRequest{
+				Method: r.Method,
+				URL:    r.URL.RequestURI(),
+				Host:   r.Host,
+				Proto:  r.Proto,
+				Header: redactCredentials(r.Header),
+			},
+		}
+
+		// Read up to the limit and hand the upstream the full, untouched body
+		if r.Body != nil && r.Body != http.NoBody && !exchange.Upgraded {
+			data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+			if err == nil {
+				truncated := int64(len(data)) > limit
+				size := r.ContentLength
+				if size < 0 {
+					size = int64(len(data))
+				}
+				r.Body = readCloser{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+				if truncated {
+					data = data[:limit]
+				}
+				exchange.Request.setBody(data, size, truncated)
+			}
+		}
+
+		cw := &captureWriter{ResponseWriter: w, limit: limit, status: http.StatusOK}
+		if exchange.Upgraded {
+			cw.limit = 0
+		}
+		next.ServeHTTP(cw, r)
+
+		exchange.Duration = time.Since(exchange.StartedAt)
+		exchange.Response = CapturedResponse{
+			Status: cw.status,
+			Header: redactCredentials(w.Header()),
+		}
+		exchange.Response.setBody(cw.body.Bytes(), cw.written, cw.written > int64(cw.body.Len()))
+
+		hpm.capture.add(podID, exchange)
+	})
+}
+
+// redactCredentials copies a header, masking the values of credential headers
+func redactCredentials(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range credentialHeaders {
+		if values := redacted.Values(name); len(values) > 0 {
+			masked := make([]string, len(values))
+			for i := range masked {
+				masked[i] = redactedValue
+			}
+			redacted[http.CanonicalHeaderKey(name)] = masked
+		}
+	}
+	return redacted
+}
+
+// readCloser pairs a replacement body reader with the original body's Close
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// captureWriter copies the status and the first bytes of a response while passing
+// everything through, including flushes for streams and hijacks for upgrades
+type captureWriter struct {
+	http.ResponseWriter
+	limit       int64
+	status      int
+	wroteHeader bool
+	written     int64
+	body        bytes.Buffer
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.status = status
+		cw.wroteHeader = true
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	n, err := cw.ResponseWriter.Write(b)
+	cw.written += int64(n)
+	if remaining := cw.limit - int64(cw.body.Len()); remaining > 0 {
+		cw.body.Write(b[:min(int64(n), remaining)])
+	}
+	return n, err
+}
+
+func (cw *captureWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	cw.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// replayRecorder collects the response to a replayed request in memory
+type replayRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newReplayRecorder() *replayRecorder {
+	return &replayRecorder{header: make(http.Header)}
+}
+
+func (rr *replayRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *replayRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+}
+
+func (rr *replayRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	return rr.body.Write(b)
+}
+
+// replay sends a captured request through the proxy's current route again
+func (hpm *HTTPProxyManager) replay(podID string, exchange CapturedExchange) (response *CapturedResponse, err error) {
+	if exchange.Upgraded {
+		return nil, errors.New("upgraded connections cannot be replayed")
+	}
+	if exchange.Request.BodyTruncated {
+		return nil, errors.New("request body was truncated during capture")
+	}
+
+	route, exists := hpm.router.Get(podID)
+	if !exists {
+		return nil, errors.New("proxy has no active route")
+	}
+
+	body, err := exchange.Request.bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(exchange.Request.Method, exchange.Request.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Host = exchange.Request.Host
+	req.Header = exchange.Request.Header.Clone()
+	for _, name := range credentialHeaders {
+		// Credentials were redacted at capture; the route's header policy can still inject its own
+		req.Header.Del(name)
+	}
+	req.Header.Set("X-Proxy-Replay-Of", exchange.Request.Method+" "+exchange.Request.URL)
+	req.RemoteAddr = "127.0.0.1:0"
+
+	// An abort fault rule panics to drop the connection; report it as a failed replay
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if recovered != http.ErrAbortHandler {
+				panic(recovered)
+			}
+			response, err = nil, errors.New("connection aborted by fault rule")
+		}
+	}()
+
+	recorder := newReplayRecorder()
+	route.handler.ServeHTTP(recorder, req)
+
+	response = &CapturedResponse{
+		Status: recorder.status,
+		Header: recorder.header,
+	}
+	data := recorder.body.Bytes()
+	size := int64(len(data))
+	truncated := size > hpm.capture.bodyLimit
+	if truncated {
+		data = data[:hpm.capture.bodyLimit]
+	}
+	response.setBody(data, size, truncated)
+	return response, nil
+}
+
+// registerTrafficAPI adds the traffic capture endpoints to the proxy server
+func (hpm *HTTPProxyManager) registerTrafficAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/proxies/{id}/traffic", hpm.requireAPIAccess(func(w http.ResponseWriter, r *http.Request) {
+		podID, ok := hpm.trafficProxy(w, r)
+		if !ok {
+			return
+		}
+		writeProxyJSON(w, http.StatusOK, map[string]interface{}{
+			"pod_id":    podID,
+			"exchanges": hpm.capture.list(podID),
+			"timestamp": time.Now(),
+		})
+	}))
+
+	mux.HandleFunc("DELETE /api/proxies/{id}/traffic", hpm.requireAPIAccess(func(w http.ResponseWriter, r *http.Request) {
+		podID, ok := hpm.trafficProxy(w, r)
+		if !ok {
+			return
+		}
+		hpm.capture.clear(podID)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("GET /api/proxies/{id}/traffic/har", hpm.requireAPIAccess(func(w http.ResponseWriter, r *http.Request) {
+		podID, ok := hpm.trafficProxy(w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", podID+".har"))
+		writeProxyJSON(w, http.StatusOK, buildHAR(hpm.capture.list(podID)))
+	}))
+
+	mux.HandleFunc("POST /api/proxies/{id}/traffic/{entry}/replay", hpm.requireAPIAccess(func(w http.ResponseWriter, r *http.Request) {
+		podID, ok := hpm.trafficProxy(w, r)
+		if !ok {
+			return
+		}
+
+		entryID, err := strconv.ParseUint(r.PathValue("entry"), 10, 64)
+		if err != nil {
+			writeProxyJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid exchange id"})
+			return
+		}
+		exchange, exists := hpm.capture.get(podID, entryID)
+		if !exists {
+			writeProxyJSON(w, http.StatusNotFound, map[string]string{"error": "exchange not found"})
+			return
+		}
+
+		response, err := hpm.replay(podID, exchange)
+		if err != nil {
+			writeProxyJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+
+		hpm.logger.Info("Replayed captured request",
+			"pod_id", podID,
+			"exchange_id", entryID,
+			"method", exchange.Request.Method,
+			"url", exchange.Request.URL,
+			"status", response.Status)
+
+		writeProxyJSON(w, http.StatusOK, map[string]interface{}{
+			"replayed": exchange.ID,
+			"request":  exchange.Request,
+			"response": response,
+		})
+	}))
+}
+
+// trafficProxy resolves the {id} path value to a proxy, writing an error response when
+// capture is disabled or the proxy is unknown
+func (hpm *HTTPProxyManager) trafficProxy(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if hpm.capture == nil {
+		writeProxyJSON(w, http.StatusNotFound, map[string]string{"error": "traffic capture is disabled"})
+		return "", false
+	}
+
+	podID, exists := hpm.resolveProxyID(r.PathValue("id"))
+	if !exists {
+		writeProxyJSON(w, http.StatusNotFound, map[string]string{"error": "proxy not found"})
+		return "", false
+	}
+	return podID, true
+}
+
+// resolveProxyID accepts a staging pod ID, proxy ID or pod name and returns the staging pod ID
+func (hpm *HTTPProxyManager) resolveProxyID(id string) (string, bool) {
+	hpm.mutex.RLock()
+	defer hpm.mutex.RUnlock()
+
+	if _, exists := hpm.proxies[id]; exists {
+		return id, true
+	}
+	for podID, proxy := range hpm.proxies {
+		if proxy.ProxyID == id || proxy.PodName == id {
+			return podID, true
+		}
+	}
+	return "", false
+}
+
+// writeProxyJSON writes a JSON response with the given status
+func writeProxyJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,133 @@
+package staging
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k3s-local-agent/pkg/logger"
+)
+
+func TestRedactCredentials(t *testing.T) {
+	header := http.Header{
+		"Authorization":       {"Bearer abc123"},
+		"Proxy-Authorization": {"Basic dXNlcjpwYXNz"},
+		"Cookie":              {"session=abc", "theme=dark"},
+		"X-Api-Key":           {"key"},
+		"X-Auth-Token":        {"token"},
+		"Accept":              {"application/json"},
+	}
+
+	redacted := redactCredentials(header)
+
+	want := http.Header{
+		"Authorization":       {redactedValue},
+		"Proxy-Authorization": {redactedValue},
+		"Cookie":              {redactedValue, redactedValue},
+		"X-Api-Key":           {redactedValue},
+		"X-Auth-Token":        {redactedValue},
+		"Accept":              {"application/json"},
+	}
+	if !reflect.DeepEqual(redacted, want) {
+		t.Errorf("redacted = %v, want %v", redacted, want)
+	}
+	// The live header is left for the upstream
+	if header.Get("Authorization") != "Bearer abc123" {
+		t.Error("redaction modified the original header")
+	}
+}
+
+func TestCaptureHandlerRedactsCredentials(t *testing.T) {
+	hpm := NewHTTPProxyManager(&ProxyConfig{AgentID: "agent-1", CaptureSize: 10}, logger.New())
+
+	var upstreamAuth, upstreamBody string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamAuth = r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		upstreamBody = string(body)
+		w.Header().Set("Set-Cookie", "session=secret; HttpOnly")
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "ok")
+	})
+
+	r := httptest.NewRequest("POST", "/items", strings.NewReader(`{"name":"a"}`))
+	r.Header.Set("Authorization", "Bearer abc123")
+	r.Header.Set("Cookie", "session=secret")
+	w := httptest.NewRecorder()
+	hpm.captureHandler("pod-1", "proxy-1", next).ServeHTTP(w, r)
+
+	// The upstream and the client see the real values
+	if upstreamAuth != "Bearer abc123" || upstreamBody != `{"name":"a"}` {
+		t.Errorf("upstream saw auth %q and body %q", upstreamAuth, upstreamBody)
+	}
+	if w.Header().Get("Set-Cookie") != "session=secret; HttpOnly" {
+		t.Errorf("client Set-Cookie = %q", w.Header().Get("Set-Cookie"))
+	}
+
+	exchanges := hpm.capture.list("pod-1")
+	if len(exchanges) != 1 {
+		t.Fatalf("captured %d exchanges, want 1", len(exchanges))
+	}
+	exchange := exchanges[0]
+	for _, value := range []string{
+		exchange.Request.Header.Get("Authorization"),
+		exchange.Request.Header.Get("Cookie"),
+		exchange.Response.Header.Get("Set-Cookie"),
+	} {
+		if value != redactedValue {
+			t.Errorf("captured credential = %q, want %q", value, redactedValue)
+		}
+	}
+	if exchange.Request.Body != `{"name":"a"}` || exchange.Response.Body != "ok" || exchange.Response.Status != http.StatusOK {
+		t.Errorf("captured request body %q, response %d %q", exchange.Request.Body, exchange.Response.Status, exchange.Response.Body)
+	}
+}
+
+func TestCaptureStoreRing(t *testing.T) {
+	cs := newCaptureStore(3, 0)
+	for _, url := range []string{"/1", "/2", "/3", "/4", "/5"} {
+		cs.add("pod-1", CapturedExchange{Request: CapturedRequest{URL: url}})
+	}
+	cs.add("pod-2", CapturedExchange{Request: CapturedRequest{URL: "/other"}})
+
+	var urls []string
+	for _, exchange := range cs.list("pod-1") {
+		urls = append(urls, exchange.Request.URL)
+	}
+	if want := []string{"/3", "/4", "/5"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("urls = %v, want %v", urls, want)
+	}
+
+	cs.clear("pod-1")
+	if len(cs.list("pod-1")) != 0 || len(cs.list("pod-2")) != 1 {
+		t.Error("clear removed the wrong proxy's exchanges")
+	}
+}
+
+func TestCaptureBodyLimit(t *testing.T) {
+	hpm := NewHTTPProxyManager(&ProxyConfig{AgentID: "agent-1", CaptureSize: 10, CaptureBody: 4}, logger.New())
+
+	var upstream string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstream = string(body)
+		io.WriteString(w, "response body")
+	})
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader("request body"))
+	hpm.captureHandler("pod-1", "proxy-1", next).ServeHTTP(httptest.NewRecorder(), r)
+
+	if upstream != "request body" {
+		t.Errorf("upstream body = %q, want the full body", upstream)
+	}
+	exchange := hpm.capture.list("pod-1")[0]
+	if exchange.Request.Body != "requ" || !exchange.Request.BodyTruncated || exchange.Request.BodySize != 12 {
+		t.Errorf("request body = %q (truncated %t, size %d)", exchange.Request.Body, exchange.Request.BodyTruncated, exchange.Request.BodySize)
+	}
+	if exchange.Response.Body != "resp" || !exchange.Response.BodyTruncated || exchange.Response.BodySize != 13 {
+		t.Errorf("response body = %q (truncated %t, size %d)", exchange.Response.Body, exchange.Response.BodyTruncated, exchange.Response.BodySize)
+	}
+}
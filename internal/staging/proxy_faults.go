@@ -0,0 +1,544 @@
+package staging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LatencyFixed   = "fixed"
+	LatencyUniform = "uniform"
+	LatencyNormal  = "normal"
+
+	// throttleChunksPerSecond controls how finely throttled bodies are paced
+	throttleChunksPerSecond = 10
+)
+
+// FaultRule injects failures into proxied requests that match it. Rules are evaluated
+// in order and only the first matching rule applies to a request.
+type FaultRule struct {
+	ID        string         `json:"id"`
+	Proxy     string         `json:"proxy,omitempty"` // Pod name, pod ID or proxy ID; empty matches every proxy
+	Match     FaultMatch     `json:"match"`
+	Latency   *LatencyFault  `json:"latency,omitempty"`
+	Error     *ErrorFault    `json:"error,omitempty"`
+	Abort     *AbortFault    `json:"abort,omitempty"`
+	Throttle  *ThrottleFault `json:"throttle,omitempty"`
+	Hits      uint64         `json:"hits"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// FaultMatch selects the requests a rule applies to; empty fields match everything
+type FaultMatch struct {
+	PathPrefix string            `json:"path_prefix,omitempty"` // Matched against the path forwarded to the pod
+	Methods    []string          `json:"methods,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"` // An empty value only requires the header to be present
+}
+
+// LatencyFault delays requests before they are forwarded
+type LatencyFault struct {
+	Distribution string        `json:"distribution,omitempty"` // "fixed" (default), "uniform" or "normal"
+	Delay        FaultDuration `json:"delay,omitempty"`        // fixed
+	Min          FaultDuration `json:"min,omitempty"`          // uniform
+	Max          FaultDuration `json:"max,omitempty"`          // uniform
+	Mean         FaultDuration `json:"mean,omitempty"`         // normal
+	StdDev       FaultDuration `json:"stddev,omitempty"`       // normal
+	Percentage   *float64      `json:"percentage,omitempty"`   // Share of matching requests affected; omitted means all
+}
+
+// ErrorFault answers requests with an error status instead of forwarding them
+type ErrorFault struct {
+	Status     int      `json:"status"`
+	Body       string   `json:"body,omitempty"`
+	Percentage *float64 `json:"percentage,omitempty"`
+}
+
+// AbortFault drops the client connection without sending a response
+type AbortFault struct {
+	Percentage *float64 `json:"percentage,omitempty"`
+}
+
+// ThrottleFault limits the bandwidth of request and response bodies
+type ThrottleFault struct {
+	BytesPerSecond int64    `json:"bytes_per_second"`
+	Percentage     *float64 `json:"percentage,omitempty"`
+}
+
+// FaultDuration is a time.Duration that reads and writes JSON as a Go duration string
+type FaultDuration time.Duration
+
+func (d FaultDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *FaultDuration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		var nanos int64
+		if err := json.Unmarshal(data, &nanos); err != nil {
+			return fmt.Errorf("duration must be a string like \"250ms\": %w", err)
+		}
+		*d = FaultDuration(nanos)
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = FaultDuration(parsed)
+	return nil
+}
+
+// validate checks a rule and fills in defaults
+func (rule *FaultRule) validate() error {
+	if rule.Latency == nil && rule.Error == nil && rule.Abort == nil && rule.Throttle == nil {
+		return errors.New("rule must configure at least one of latency, error, abort or throttle")
+	}
+
+	if latency := rule.Latency; latency != nil {
+		if latency.Distribution == "" {
+			latency.Distribution = LatencyFixed
+		}
+		switch latency.Distribution {
+		case LatencyFixed:
+			if latency.Delay <= 0 {
+				return errors.New("fixed latency requires a positive delay")
+			}
+		case LatencyUniform:
+			if latency.Min < 0 || latency.Max <= latency.Min {
+				return errors.New("uniform latency requires 0 <= min < max")
+			}
+		case LatencyNormal:
+			if latency.Mean <= 0 || latency.StdDev < 0 {
+				return errors.New("normal latency requires a positive mean and non-negative stddev")
+			}
+		default:
+			return fmt.Errorf("unknown latency distribution %q", latency.Distribution)
+		}
+		if err := validPercentage(latency.Percentage); err != nil {
+			return err
+		}
+	}
+
+	if rule.Error != nil {
+		if rule.Error.Status < 100 || rule.Error.Status > 599 {
+			return fmt.Errorf("invalid error status %d", rule.Error.Status)
+		}
+		if err := validPercentage(rule.Error.Percentage); err != nil {
+			return err
+		}
+	}
+
+	if rule.Abort != nil {
+		if err := validPercentage(rule.Abort.Percentage); err != nil {
+			return err
+		}
+	}
+
+	if rule.Throttle != nil {
+		if rule.Throttle.BytesPerSecond <= 0 {
+			return errors.New("throttle requires a positive bytes_per_second")
+		}
+		if err := validPercentage(rule.Throttle.Percentage); err != nil {
+			return err
+		}
+	}
+
+	rule.Match.PathPrefix = strings.TrimSpace(rule.Match.PathPrefix)
+	if rule.Match.PathPrefix != "" && !strings.HasPrefix(rule.Match.PathPrefix, "/") {
+		rule.Match.PathPrefix = "/" + rule.Match.PathPrefix
+	}
+	for i, method := range rule.Match.Methods {
+		rule.Match.Methods[i] = strings.ToUpper(method)
+	}
+	return nil
+}
+
+func validPercentage(percentage *float64) error {
+	if percentage != nil && (*percentage < 0 || *percentage > 100) {
+		return fmt.Errorf("percentage %v must be between 0 and 100", *percentage)
+	}
+	return nil
+}
+
+// roll reports whether a fault with the given percentage fires. An omitted percentage means
+// always and zero means never, so a rule can be disabled without removing it.
+func roll(percentage *float64) bool {
+	return percentage == nil || rand.Float64()*100 < *percentage
+}
+
+// matches reports whether the rule applies to a request for the given proxy
+func (rule *FaultRule) matches(r *http.Request, podID, proxyID, podName string) bool {
+	if rule.Proxy != "" && rule.Proxy != podID && rule.Proxy != proxyID && rule.Proxy != podName {
+		return false
+	}
+	if rule.Match.PathPrefix != "" && !matchesPrefix(r.URL.Path, rule.Match.PathPrefix) {
+		return false
+	}
+	if len(rule.Match.Methods) > 0 {
+		found := false
+		for _, method := range rule.Match.Methods {
+			if method == r.Method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, value := range rule.Match.Headers {
+		values, exists := r.Header[http.CanonicalHeaderKey(name)]
+		if !exists {
+			return false
+		}
+		if value != "" && !containsString(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// delay samples a delay from the latency distribution
+func (latency *LatencyFault) delay() time.Duration {
+	switch latency.Distribution {
+	case LatencyUniform:
+		spread := int64(latency.Max - latency.Min)
+		return time.Duration(latency.Min) + time.Duration(rand.Int64N(spread))
+	case LatencyNormal:
+		sample := float64(latency.Mean) + rand.NormFloat64()*float64(latency.StdDev)
+		return time.Duration(max(sample, 0))
+	default:
+		return time.Duration(latency.Delay)
+	}
+}
+
+// faultStore holds the fault rules shared by every proxy
+type faultStore struct {
+	rules  []*FaultRule
+	nextID int
+	mutex  sync.RWMutex
+}
+
+func newFaultStore() *faultStore {
+	return &faultStore{}
+}
+
+// add appends a validated rule and assigns its ID
+func (fs *faultStore) add(rule FaultRule) FaultRule {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fs.nextID++
+	rule.ID = fmt.Sprintf("fault-%d", fs.nextID)
+	rule.Hits = 0
+	rule.CreatedAt = time.Now()
+	fs.rules = append(fs.rules, &rule)
+	return rule
+}
+
+// replace swaps the rule with the given ID in place, keeping its position
+func (fs *faultStore) replace(id string, rule FaultRule) (FaultRule, bool) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for i, existing := range fs.rules {
+		if existing.ID == id {
+			rule.ID = id
+			rule.Hits = 0
+			rule.CreatedAt = existing.CreatedAt
+			fs.rules[i] = &rule
+			return rule, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+// remove deletes the rule with the given ID
+func (fs *faultStore) remove(id string) bool {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for i, rule := range fs.rules {
+		if rule.ID == id {
+			fs.rules = append(fs.rules[:i], fs.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// clear deletes every rule and returns how many there were
+func (fs *faultStore) clear() int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	n := len(fs.rules)
+	fs.rules = nil
+	return n
+}
+
+// get returns a copy of the rule with the given ID
+func (fs *faultStore) get(id string) (FaultRule, bool) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	for _, rule := range fs.rules {
+		if rule.ID == id {
+			return *rule, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+// list returns copies of every rule in evaluation order
+func (fs *faultStore) list() []FaultRule {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	result := make([]FaultRule, 0, len(fs.rules))
+	for _, rule := range fs.rules {
+		result = append(result, *rule)
+	}
+	return result
+}
+
+// match returns a copy of the first rule matching the request and counts the hit
+func (fs *faultStore) match(r *http.Request, podID, proxyID, podName string) (FaultRule, bool) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for _, rule := range fs.rules {
+		if rule.matches(r, podID, proxyID, podName) {
+			rule.Hits++
+			return *rule, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+// faultHandler applies the first matching fault rule before handing the request to next
+func (hpm *HTTPProxyManager) faultHandler(podID, proxyID, podName string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, exists := hpm.faults.match(r, podID, proxyID, podName)
+		if !exists {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if rule.Latency != nil && roll(rule.Latency.Percentage) {
+			delay := rule.Latency.delay()
+			hpm.logger.Debug("Injecting proxy latency", "rule", rule.ID, "pod", podName, "delay", delay)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		if rule.Abort != nil && roll(rule.Abort.Percentage) {
+			hpm.logger.Debug("Injecting proxy abort", "rule", rule.ID, "pod", podName, "path", r.URL.Path)
+			// The server closes the connection without writing a response
+			panic(http.ErrAbortHandler)
+		}
+
+		if rule.Error != nil && roll(rule.Error.Percentage) {
+			hpm.logger.Debug("Injecting proxy error", "rule", rule.ID, "pod", podName, "status", rule.Error.Status)
+			w.Header().Set("X-Proxy-Fault", rule.ID)
+			if rule.Error.Body != "" {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(rule.Error.Status)
+				io.WriteString(w, rule.Error.Body)
+				return
+			}
+			writeProxyJSON(w, rule.Error.Status, map[string]interface{}{
+				"error": "injected fault",
+				"rule":  rule.ID,
+			})
+			return
+		}
+
+		// Upgraded connections are hijacked, so only plain bodies are throttled
+		if rule.Throttle != nil && !isUpgradeRequest(r) && roll(rule.Throttle.Percentage) {
+			rate := rule.Throttle.BytesPerSecond
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = &throttledReader{ReadCloser: r.Body, ctx: r.Context(), rate: rate}
+			}
+			w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), rate: rate}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// throttle sleeps long enough for n bytes to pass at rate bytes per second
+func throttle(ctx context.Context, n int, rate int64) error {
+	timer := time.NewTimer(time.Duration(int64(n) * int64(time.Second) / rate))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttleChunk returns how many bytes are paced at a time for a rate
+func throttleChunk(rate int64) int {
+	return int(max(rate/throttleChunksPerSecond, 1))
+}
+
+// throttledReader limits how fast a request body is read
+type throttledReader struct {
+	io.ReadCloser
+	ctx  context.Context
+	rate int64
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if chunk := throttleChunk(tr.rate); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := tr.ReadCloser.Read(p)
+	if n > 0 {
+		if throttleErr := throttle(tr.ctx, n, tr.rate); throttleErr != nil {
+			return n, throttleErr
+		}
+	}
+	return n, err
+}
+
+// throttledWriter limits how fast a response body is written, flushing each chunk
+// so the client sees the reduced bandwidth
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx  context.Context
+	rate int64
+}
+
+func (tw *throttledWriter) Write(b []byte) (int, error) {
+	chunk := throttleChunk(tw.rate)
+	written := 0
+	for written < len(b) {
+		end := min(written+chunk, len(b))
+		n, err := tw.ResponseWriter.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		tw.Flush()
+		if err := throttle(tw.ctx, n, tw.rate); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Flush() {
+	if flusher, ok := tw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// registerFaultAPI adds the fault rule endpoints to the proxy server
+func (hpm *HTTPProxyManager) registerFaultAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/faults", hpm.requireAPIAccess(func(w http.ResponseWriter, r *http.Request) {
+		writeProxyJSON(w, http.StatusOK, map[string]interface{}{
+			"rules":     hpm.faults.list(),
+			"timestamp": time.Now(),
+		})
+	}))
+
+	mux.HandleFunc("POST /api/faults", hpm.requireAPIAccess(func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := decodeFaultRule(w, r)
+		if !ok {
+			return
+		}
+		rule = hpm.faults.add(rule)
+
+		hpm.logger.Info("Fault rule added", "rule", rule.ID, "proxy", rule.Proxy, "path_prefix", rule.Match.PathPrefix)
+		writeProxyJSON(w, http.StatusCreated, rule)
+	}))
+
+	mux.HandleFunc("DELETE /api/faults", hpm.requireAPIAccess(func(w http.ResponseWriter, r *http.Request) {
+		removed := hpm.faults.clear()
+		hpm.logger.Info("Fault rules cleared", "count", removed)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("GET /api/faults/{id}", hpm.requireAPIAccess(func(w http.ResponseWriter, r *http.Request) {
+		rule, exists := hpm.faults.get(r.PathValue("id"))
+		if !exists {
+			writeProxyJSON(w, http.StatusNotFound, map[string]string{"error": "fault rule not found"})
+			return
+		}
+		writeProxyJSON(w, http.StatusOK, rule)
+	}))
+
+	mux.HandleFunc("PUT /api/faults/{id}", hpm.requireAPIAccess(func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := decodeFaultRule(w, r)
+		if !ok {
+			return
+		}
+		rule, exists := hpm.faults.replace(r.PathValue("id"), rule)
+		if !exists {
+			writeProxyJSON(w, http.StatusNotFound, map[string]string{"error": "fault rule not found"})
+			return
+		}
+
+		hpm.logger.Info("Fault rule updated", "rule", rule.ID, "proxy", rule.Proxy, "path_prefix", rule.Match.PathPrefix)
+		writeProxyJSON(w, http.StatusOK, rule)
+	}))
+
+	mux.HandleFunc("DELETE /api/faults/{id}", hpm.requireAPIAccess(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !hpm.faults.remove(id) {
+			writeProxyJSON(w, http.StatusNotFound, map[string]string{"error": "fault rule not found"})
+			return
+		}
+
+		hpm.logger.Info("Fault rule removed", "rule", id)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// decodeFaultRule reads and validates a rule from a request body, writing a 400 on failure
+func decodeFaultRule(w http.ResponseWriter, r *http.Request) (FaultRule, bool) {
+	var rule FaultRule
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rule); err != nil {
+		writeProxyJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid fault rule: " + err.Error()})
+		return FaultRule{}, false
+	}
+	if err := rule.validate(); err != nil {
+		writeProxyJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return FaultRule{}, false
+	}
+	return rule, true
+}
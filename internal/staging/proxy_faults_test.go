@@ -0,0 +1,323 @@
+package staging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k3s-local-agent/pkg/logger"
+)
+
+func TestFaultRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr string
+	}{
+		{"no fault", `{"match": {"path_prefix": "/api"}}`, "at least one of"},
+		{"fixed latency", `{"latency": {"delay": "250ms"}}`, ""},
+		{"fixed latency without delay", `{"latency": {}}`, "positive delay"},
+		{"uniform latency", `{"latency": {"distribution": "uniform", "min": "10ms", "max": "50ms"}}`, ""},
+		{"uniform latency max not above min", `{"latency": {"distribution": "uniform", "min": "50ms", "max": "50ms"}}`, "0 <= min < max"},
+		{"normal latency", `{"latency": {"distribution": "normal", "mean": "100ms", "stddev": "20ms"}}`, ""},
+		{"normal latency without mean", `{"latency": {"distribution": "normal", "stddev": "20ms"}}`, "positive mean"},
+		{"unknown distribution", `{"latency": {"distribution": "poisson", "delay": "1s"}}`, "unknown latency distribution"},
+		{"error", `{"error": {"status": 503}}`, ""},
+		{"error status too low", `{"error": {"status": 42}}`, "invalid error status"},
+		{"error status too high", `{"error": {"status": 600}}`, "invalid error status"},
+		{"abort", `{"abort": {}}`, ""},
+		{"disabled abort", `{"abort": {"percentage": 0}}`, ""},
+		{"percentage above 100", `{"abort": {"percentage": 101}}`, "between 0 and 100"},
+		{"negative percentage", `{"error": {"status": 500, "percentage": -1}}`, "between 0 and 100"},
+		{"throttle", `{"throttle": {"bytes_per_second": 1024}}`, ""},
+		{"throttle without rate", `{"throttle": {}}`, "positive bytes_per_second"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rule FaultRule
+			if err := json.Unmarshal([]byte(tt.rule), &rule); err != nil {
+				t.Fatal(err)
+			}
+			err := rule.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFaultRuleValidateNormalizes(t *testing.T) {
+	rule := FaultRule{
+		Latency: &LatencyFault{Delay: FaultDuration(time.Second)},
+		Match:   FaultMatch{PathPrefix: " api/items ", Methods: []string{"get", "Post"}},
+	}
+	if err := rule.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if rule.Latency.Distribution != LatencyFixed {
+		t.Errorf("distribution = %q, want %q", rule.Latency.Distribution, LatencyFixed)
+	}
+	if rule.Match.PathPrefix != "/api/items" {
+		t.Errorf("path prefix = %q, want /api/items", rule.Match.PathPrefix)
+	}
+	if strings.Join(rule.Match.Methods, ",") != "GET,POST" {
+		t.Errorf("methods = %v, want [GET POST]", rule.Match.Methods)
+	}
+}
+
+func TestFaultRuleMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   FaultRule
+		method string
+		path   string
+		header http.Header
+		want   bool
+	}{
+		{"empty match", FaultRule{}, "GET", "/", nil, true},
+		{"proxy by pod name", FaultRule{Proxy: "web"}, "GET", "/", nil, true},
+		{"proxy by pod ID", FaultRule{Proxy: "pod-1"}, "GET", "/", nil, true},
+		{"proxy by proxy ID", FaultRule{Proxy: "proxy-1"}, "GET", "/", nil, true},
+		{"other proxy", FaultRule{Proxy: "db"}, "GET", "/", nil, false},
+		{"path prefix", FaultRule{Match: FaultMatch{PathPrefix: "/api"}}, "GET", "/api/items", nil, true},
+		{"exact path", FaultRule{Match: FaultMatch{PathPrefix: "/api"}}, "GET", "/api", nil, true},
+		{"prefix is not a path segment", FaultRule{Match: FaultMatch{PathPrefix: "/api"}}, "GET", "/apiary", nil, false},
+		{"method", FaultRule{Match: FaultMatch{Methods: []string{"POST", "PUT"}}}, "PUT", "/", nil, true},
+		{"other method", FaultRule{Match: FaultMatch{Methods: []string{"POST"}}}, "GET", "/", nil, false},
+		{"header present", FaultRule{Match: FaultMatch{Headers: map[string]string{"x-canary": ""}}}, "GET", "/", http.Header{"X-Canary": {"1"}}, true},
+		{"header missing", FaultRule{Match: FaultMatch{Headers: map[string]string{"X-Canary": ""}}}, "GET", "/", nil, false},
+		{"header value", FaultRule{Match: FaultMatch{Headers: map[string]string{"X-Env": "test"}}}, "GET", "/", http.Header{"X-Env": {"prod", "test"}}, true},
+		{"other header value", FaultRule{Match: FaultMatch{Headers: map[string]string{"X-Env": "test"}}}, "GET", "/", http.Header{"X-Env": {"prod"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			if got := tt.rule.matches(r, "pod-1", "proxy-1", "web"); got != tt.want {
+				t.Errorf("matches = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoll(t *testing.T) {
+	tests := []struct {
+		name       string
+		percentage *float64
+		want       int // Of 100 rolls; -1 for somewhere in between
+	}{
+		{"omitted", nil, 100},
+		{"always", percentage(100), 100},
+		{"disabled", percentage(0), 0},
+		{"half", percentage(50), -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fired := 0
+			for i := 0; i < 100; i++ {
+				if roll(tt.percentage) {
+					fired++
+				}
+			}
+			switch {
+			case tt.want >= 0 && fired != tt.want:
+				t.Errorf("fired %d of 100, want %d", fired, tt.want)
+			case tt.want < 0 && (fired == 0 || fired == 100):
+				t.Errorf("fired %d of 100, want some but not all", fired)
+			}
+		})
+	}
+}
+
+func TestLatencyDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		latency  LatencyFault
+		min, max time.Duration
+	}{
+		{"fixed", LatencyFault{Distribution: LatencyFixed, Delay: FaultDuration(200 * time.Millisecond)}, 200 * time.Millisecond, 200 * time.Millisecond},
+		{"uniform", LatencyFault{Distribution: LatencyUniform, Min: FaultDuration(10 * time.Millisecond), Max: FaultDuration(20 * time.Millisecond)}, 10 * time.Millisecond, 20 * time.Millisecond},
+		{"normal never negative", LatencyFault{Distribution: LatencyNormal, Mean: FaultDuration(time.Millisecond), StdDev: FaultDuration(time.Second)}, 0, time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if d := tt.latency.delay(); d < tt.min || d > tt.max {
+					t.Fatalf("delay = %v, want between %v and %v", d, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestFaultDurationJSON(t *testing.T) {
+	var latency LatencyFault
+	if err := json.Unmarshal([]byte(`{"delay": "1.5s", "min": 1000}`), &latency); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(latency.Delay) != 1500*time.Millisecond || time.Duration(latency.Min) != time.Microsecond {
+		t.Errorf("delay = %v, min = %v", time.Duration(latency.Delay), time.Duration(latency.Min))
+	}
+	if err := json.Unmarshal([]byte(`{"delay": "soon"}`), &latency); err == nil {
+		t.Error("invalid duration was accepted")
+	}
+
+	data, _ := json.Marshal(FaultDuration(250 * time.Millisecond))
+	if string(data) != `"250ms"` {
+		t.Errorf("marshal = %s, want \"250ms\"", data)
+	}
+}
+
+func TestFaultStoreFirstMatchWins(t *testing.T) {
+	fs := newFaultStore()
+	api := fs.add(FaultRule{Match: FaultMatch{PathPrefix: "/api"}, Error: &ErrorFault{Status: 503}})
+	all := fs.add(FaultRule{Abort: &AbortFault{}})
+
+	rule, ok := fs.match(httptest.NewRequest("GET", "/api/items", nil), "pod-1", "proxy-1", "web")
+	if !ok || rule.ID != api.ID {
+		t.Errorf("match = %q, want %q", rule.ID, api.ID)
+	}
+	rule, ok = fs.match(httptest.NewRequest("GET", "/", nil), "pod-1", "proxy-1", "web")
+	if !ok || rule.ID != all.ID {
+		t.Errorf("match = %q, want %q", rule.ID, all.ID)
+	}
+
+	if got, _ := fs.get(api.ID); got.Hits != 1 {
+		t.Errorf("hits = %d, want 1", got.Hits)
+	}
+
+	// Replacing a rule keeps its position and resets its hits
+	replaced, ok := fs.replace(api.ID, FaultRule{Match: FaultMatch{PathPrefix: "/api"}, Abort: &AbortFault{}})
+	if !ok || replaced.Hits != 0 || fs.list()[0].ID != api.ID {
+		t.Errorf("replace = %+v, %t; want the first rule with no hits", replaced, ok)
+	}
+
+	if !fs.remove(api.ID) || fs.remove(api.ID) {
+		t.Error("remove did not delete the rule exactly once")
+	}
+	if n := fs.clear(); n != 1 {
+		t.Errorf("clear = %d, want 1", n)
+	}
+}
+
+func TestFaultHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		rule       *FaultRule
+		wantStatus int
+		wantBody   string
+		forwarded  bool
+	}{
+		{"no rule", nil, http.StatusOK, "upstream", true},
+		{"error", &FaultRule{Error: &ErrorFault{Status: 503, Body: "down"}}, 503, "down", false},
+		{"disabled error", &FaultRule{Error: &ErrorFault{Status: 503, Percentage: percentage(0)}}, http.StatusOK, "upstream", true},
+		{"latency then forward", &FaultRule{Latency: &LatencyFault{Distribution: LatencyFixed, Delay: FaultDuration(time.Millisecond)}}, http.StatusOK, "upstream", true},
+		{"other proxy", &FaultRule{Proxy: "db", Error: &ErrorFault{Status: 500}}, http.StatusOK, "upstream", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hpm := NewHTTPProxyManager(&ProxyConfig{AgentID: "agent-1"}, logger.New())
+			if tt.rule != nil {
+				hpm.faults.add(*tt.rule)
+			}
+
+			forwarded := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded = true
+				io.WriteString(w, "upstream")
+			})
+
+			w := httptest.NewRecorder()
+			hpm.faultHandler("pod-1", "proxy-1", "web", next).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			if w.Code != tt.wantStatus || w.Body.String() != tt.wantBody || forwarded != tt.forwarded {
+				t.Errorf("status = %d, body = %q, forwarded = %t; want %d, %q, %t",
+					w.Code, w.Body.String(), forwarded, tt.wantStatus, tt.wantBody, tt.forwarded)
+			}
+		})
+	}
+}
+
+func TestFaultHandlerAbort(t *testing.T) {
+	hpm := NewHTTPProxyManager(&ProxyConfig{AgentID: "agent-1"}, logger.New())
+	hpm.faults.add(FaultRule{Abort: &AbortFault{}})
+
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", recovered)
+		}
+	}()
+	hpm.faultHandler("pod-1", "proxy-1", "web", http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestThrottledWriter(t *testing.T) {
+	w := httptest.NewRecorder()
+	tw := &throttledWriter{ResponseWriter: w, ctx: context.Background(), rate: 1000}
+
+	start := time.Now()
+	n, err := tw.Write(make([]byte, 300))
+	elapsed := time.Since(start)
+
+	if n != 300 || err != nil {
+		t.Fatalf("write = %d, %v", n, err)
+	}
+	// 300 bytes at 1000 bytes per second take 300ms
+	if elapsed < 250*time.Millisecond {
+		t.Errorf("write took %v, want about 300ms", elapsed)
+	}
+	if w.Body.Len() != 300 || !w.Flushed {
+		t.Errorf("body = %d bytes, flushed = %t", w.Body.Len(), w.Flushed)
+	}
+}
+
+func TestThrottledReaderStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := &throttledReader{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("x", 100))), ctx: ctx, rate: 1}
+
+	cancel()
+	buf := make([]byte, 100)
+	n, err := tr.Read(buf)
+	// A one byte per second rate paces the body a byte at a time
+	if n != 1 || !errors.Is(err, context.Canceled) {
+		t.Errorf("read = %d, %v; want one byte and context.Canceled", n, err)
+	}
+}
+
+func TestThrottleChunk(t *testing.T) {
+	tests := []struct {
+		rate int64
+		want int
+	}{
+		{1, 1},
+		{10, 1},
+		{1000, 100},
+		{1 << 20, 1 << 20 / throttleChunksPerSecond},
+	}
+	for _, tt := range tests {
+		if got := throttleChunk(tt.rate); got != tt.want {
+			t.Errorf("throttleChunk(%d) = %d, want %d", tt.rate, got, tt.want)
+		}
+	}
+}
+
+func percentage(p float64) *float64 {
+	return &p
+}
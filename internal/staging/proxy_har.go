@@ -0,0 +1,175 @@
+package staging
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// harLog is the root of an HTTP Archive 1.2 document
+type harLog struct {
+	Log harContent `json:"log"`
+}
+
+type harContent struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harBody        `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harBody struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// buildHAR converts captured exchanges into an HTTP Archive
+func buildHAR(exchanges []CapturedExchange) harLog {
+	entries := make([]harEntry, 0, len(exchanges))
+	for _, exchange := range exchanges {
+		entries = append(entries, harEntryFor(exchange))
+	}
+
+	return harLog{Log: harContent{
+		Version: "1.2",
+		Creator: harCreator{Name: "k3s-local-agent", Version: "1.0"},
+		Entries: entries,
+	}}
+}
+
+func harEntryFor(exchange CapturedExchange) harEntry {
+	req := exchange.Request
+	resp := exchange.Response
+	millis := float64(exchange.Duration) / float64(time.Millisecond)
+
+	fullURL := url.URL{Scheme: "http", Host: req.Host}
+	if parsed, err := url.ParseRequestURI(req.URL); err == nil {
+		fullURL.Path = parsed.Path
+		fullURL.RawPath = parsed.RawPath
+		fullURL.RawQuery = parsed.RawQuery
+	}
+
+	entry := harEntry{
+		StartedDateTime: exchange.StartedAt.Format(time.RFC3339Nano),
+		Time:            millis,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         fullURL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: harQuery(fullURL.Query()),
+			HeadersSize: -1,
+			BodySize:    req.BodySize,
+		},
+		Response: harResponse{
+			Status:      resp.Status,
+			StatusText:  http.StatusText(resp.Status),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(resp.Header),
+			Content: harBody{
+				Size:     resp.BodySize,
+				MimeType: resp.Header.Get("Content-Type"),
+				Text:     resp.Body,
+				Encoding: resp.BodyEncoding,
+			},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    resp.BodySize,
+		},
+		Timings: harTimings{Wait: millis},
+	}
+
+	if req.Body != "" {
+		// HAR has no encoding field for request bodies, so binary bodies stay base64 text
+		entry.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     req.Body,
+		}
+	}
+	if req.BodyTruncated || resp.BodyTruncated {
+		entry.Comment = "bodies truncated by capture limit"
+	}
+
+	return entry
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	result := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			result = append(result, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func harQuery(query url.Values) []harNameValue {
+	result := []harNameValue{}
+	for name, values := range query {
+		for _, value := range values {
+			result = append(result, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
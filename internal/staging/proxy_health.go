@@ -0,0 +1,245 @@
+package staging
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// healthCheckTick is how often the checker looks for proxies that are due a probe
+	healthCheckTick = time.Second
+
+	// maxHealthTransitions bounds the status history kept per proxy
+	maxHealthTransitions = 10
+
+	// Per-pod health check overrides
+	healthPathAnnotation               = "k3s-local-agent/proxy-health-path"
+	healthIntervalAnnotation           = "k3s-local-agent/proxy-health-interval"
+	healthTimeoutAnnotation            = "k3s-local-agent/proxy-health-timeout"
+	healthHealthyThresholdAnnotation   = "k3s-local-agent/proxy-healthy-threshold"
+	healthUnhealthyThresholdAnnotation = "k3s-local-agent/proxy-unhealthy-threshold"
+)
+
+// HealthCheckConfig configures active health probes for a proxy
+type HealthCheckConfig struct {
+	Path               string        `json:"path"`
+	Interval           time.Duration `json:"interval"` // Zero disables active probes
+	Timeout            time.Duration `json:"timeout"`
+	HealthyThreshold   int           `json:"healthy_threshold"`   // Consecutive successes to become active again
+	UnhealthyThreshold int           `json:"unhealthy_threshold"` // Consecutive failures to be marked failed
+}
+
+// ProxyHealth records the health check state of a proxy
+type ProxyHealth struct {
+	ConsecutiveSuccesses int                `json:"consecutive_successes"`
+	ConsecutiveFailures  int                `json:"consecutive_failures"`
+	LastCheck            time.Time          `json:"last_check"`
+	LastFailure          time.Time          `json:"last_failure,omitempty"`
+	LastError            string             `json:"last_error,omitempty"`
+	Transitions          []StatusTransition `json:"transitions,omitempty"`
+}
+
+// StatusTransition records a proxy status change
+type StatusTransition struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// DefaultHealthCheckConfig returns the health check settings used when none are configured
+func DefaultHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Path:               "/",
+		Interval:           10 * time.Second,
+		Timeout:            2 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+}
+
+// healthCheckConfigFor merges a staging pod's health check annotations over the manager defaults
+func (hpm *HTTPProxyManager) healthCheckConfigFor(stagingPod StagingPodInfo) HealthCheckConfig {
+	config := hpm.healthCheck
+	if path, exists := stagingPod.Annotations[healthPathAnnotation]; exists && path != "" {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		config.Path = path
+	}
+	config.Interval = hpm.annotationDuration(stagingPod, healthIntervalAnnotation, config.Interval)
+	config.Timeout = hpm.annotationDuration(stagingPod, healthTimeoutAnnotation, config.Timeout)
+	config.HealthyThreshold = hpm.annotationInt(stagingPod, healthHealthyThresholdAnnotation, config.HealthyThreshold)
+	config.UnhealthyThreshold = hpm.annotationInt(stagingPod, healthUnhealthyThresholdAnnotation, config.UnhealthyThreshold)
+	return config
+}
+
+// RunHealthChecks probes every proxy on its configured interval until stopCh is closed
+func (hpm *HTTPProxyManager) RunHealthChecks(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(healthCheckTick)
+	defer ticker.Stop()
+
+	hpm.logger.Info("HTTP proxy health checker started")
+
+	for {
+		select {
+		case <-ticker.C:
+			hpm.runHealthChecks(false)
+		case <-stopCh:
+			hpm.logger.Info("HTTP proxy health checker stopped")
+			return
+		}
+	}
+}
+
+// runHealthChecks probes all proxies that are due, or all proxies when force is set,
+// and waits for the probes to finish so rounds never overlap
+func (hpm *HTTPProxyManager) runHealthChecks(force bool) {
+	now := time.Now()
+	due := make(map[string]HTTPProxy)
+
+	hpm.mutex.RLock()
+	for podID, proxy := range hpm.proxies {
+		interval := proxy.HealthCheck.Interval
+		if !force && (interval <= 0 || now.Sub(proxy.Health.LastCheck) < interval) {
+			continue
+		}
+		due[podID] = proxy
+	}
+	hpm.mutex.RUnlock()
+
+	var wg sync.WaitGroup
+	for podID, proxy := range due {
+		wg.Add(1)
+		go func(podID string, proxy HTTPProxy) {
+			defer wg.Done()
+			hpm.recordHealthResult(podID, hpm.probe(proxy), "active probe")
+		}(podID, proxy)
+	}
+	wg.Wait()
+}
+
+// probe sends a single health check request to a proxy's upstream
+func (hpm *HTTPProxyManager) probe(proxy HTTPProxy) error {
+	targetURL, err := proxyTargetURL(&proxy)
+	if err != nil {
+		return err
+	}
+
+	timeout := proxy.HealthCheck.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckConfig().Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	path := proxy.HealthCheck.Path
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL.String()+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "k3s-local-agent-health-check")
+
+	resp, err := hpm.healthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordHealthResult updates a proxy's health counters and status after an active
+// probe or a passively observed upstream failure
+func (hpm *HTTPProxyManager) recordHealthResult(podID string, result error, source string) {
+	hpm.mutex.Lock()
+	defer hpm.mutex.Unlock()
+
+	proxy, exists := hpm.proxies[podID]
+	if !exists {
+		return
+	}
+
+	now := time.Now()
+	health := &proxy.Health
+	if source == "active probe" {
+		health.LastCheck = now
+	}
+
+	config := proxy.HealthCheck
+	next := proxy.Status
+	reason := source
+
+	if result == nil {
+		health.ConsecutiveFailures = 0
+		health.ConsecutiveSuccesses++
+		health.LastError = ""
+		if proxy.Status != "active" && health.ConsecutiveSuccesses >= max(config.HealthyThreshold, 1) {
+			next = "active"
+			reason = fmt.Sprintf("%s: %d consecutive successes", source, health.ConsecutiveSuccesses)
+		}
+	} else {
+		health.ConsecutiveSuccesses = 0
+		health.ConsecutiveFailures++
+		health.LastError = result.Error()
+		health.LastFailure = now
+		if health.ConsecutiveFailures >= max(config.UnhealthyThreshold, 1) {
+			next = "failed"
+		} else {
+			next = "degraded"
+		}
+		reason = fmt.Sprintf("%s: %s", source, result.Error())
+	}
+
+	if next != proxy.Status {
+		health.Transitions = append(health.Transitions, StatusTransition{
+			From:   proxy.Status,
+			To:     next,
+			Reason: reason,
+			At:     now,
+		})
+		if len(health.Transitions) > maxHealthTransitions {
+			health.Transitions = health.Transitions[len(health.Transitions)-maxHealthTransitions:]
+		}
+
+		hpm.logger.Info("HTTP proxy health status changed",
+			"pod", proxy.PodName,
+			"from", proxy.Status,
+			"to", next,
+			"reason", reason)
+
+		proxy.Status = next
+		proxy.UpdatedAt = now
+	}
+
+	hpm.proxies[podID] = proxy
+}
+
+// annotationInt reads a positive integer annotation from a staging pod, falling back on absence or error
+func (hpm *HTTPProxyManager) annotationInt(stagingPod StagingPodInfo, key string, fallback int) int {
+	value, exists := stagingPod.Annotations[key]
+	if !exists {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		hpm.logger.Warn("Ignoring invalid proxy annotation",
+			"pod", stagingPod.Name,
+			"annotation", key,
+			"value", value)
+		return fallback
+	}
+	return n
+}
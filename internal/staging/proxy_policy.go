@@ -0,0 +1,301 @@
+package staging
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// policyAnnotation holds a staging pod's HeaderPolicy as JSON
+	policyAnnotation = "k3s-local-agent/proxy-policy"
+
+	AuthBearer = "bearer"
+	AuthBasic  = "basic"
+)
+
+// HeaderPolicy rewrites the requests and responses passing through a proxy route
+type HeaderPolicy struct {
+	Request          HeaderRules    `json:"request,omitempty"`
+	Response         HeaderRules    `json:"response,omitempty"`
+	Auth             *AuthInjection `json:"auth,omitempty"`
+	Cookies          *CookieRewrite `json:"cookies,omitempty"`
+	PreserveLocation bool           `json:"preserve_location,omitempty"` // Pass upstream Location headers through unchanged
+}
+
+// HeaderRules are applied in order: rename, remove, then add
+type HeaderRules struct {
+	Rename map[string]string `json:"rename,omitempty"` // old name -> new name
+	Remove []string          `json:"remove,omitempty"`
+	Add    map[string]string `json:"add,omitempty"` // Replaces any existing values
+}
+
+// AuthInjection adds credentials read from the proxy's secrets directory to every upstream request
+type AuthInjection struct {
+	Type   string `json:"type"`             // "bearer" (secret holds the token) or "basic" (secret holds user:password)
+	Secret string `json:"secret"`           // File name in the secrets directory; re-read whenever it changes on disk
+	Header string `json:"header,omitempty"` // Defaults to Authorization
+}
+
+// CookieRewrite adjusts Set-Cookie headers so cookies apply to the proxy rather than the pod
+type CookieRewrite struct {
+	Domain     string `json:"domain,omitempty"`      // Replacement domain; empty makes cookies host-only
+	PathPrefix bool   `json:"path_prefix,omitempty"` // Prepend the stripped route prefix to cookie paths
+}
+
+// policyFor parses a staging pod's policy annotation, ignoring it when invalid
+func (hpm *HTTPProxyManager) policyFor(stagingPod StagingPodInfo) *HeaderPolicy {
+	value, exists := stagingPod.Annotations[policyAnnotation]
+	if !exists || strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	var policy HeaderPolicy
+	err := json.Unmarshal([]byte(value), &policy)
+	if err == nil {
+		err = policy.validate(hpm.secretsDir)
+	}
+	if err != nil {
+		hpm.logger.Warn("Ignoring invalid proxy annotation",
+			"pod", stagingPod.Name,
+			"annotation", policyAnnotation,
+			"error", err)
+		return nil
+	}
+	return &policy
+}
+
+// validate checks a policy and fills in defaults. Policies arrive from the control plane, so auth
+// secrets are limited to bare names in the operator's secrets directory.
+func (policy *HeaderPolicy) validate(secretsDir string) error {
+	if auth := policy.Auth; auth != nil {
+		auth.Type = strings.ToLower(auth.Type)
+		if auth.Type != AuthBearer && auth.Type != AuthBasic {
+			return fmt.Errorf("unknown auth type %q", auth.Type)
+		}
+		if secretsDir == "" {
+			return errors.New("auth requires the agent to be started with -proxy-secrets-dir")
+		}
+		if !validSecretName(auth.Secret) {
+			return fmt.Errorf("auth secret %q must be a file name in the secrets directory", auth.Secret)
+		}
+		if auth.Header == "" {
+			auth.Header = "Authorization"
+		}
+	}
+	return nil
+}
+
+// apply rewrites a header set according to the rules
+func (rules HeaderRules) apply(header http.Header) {
+	for from, to := range rules.Rename {
+		if values := header.Values(from); len(values) > 0 {
+			header.Del(from)
+			header[http.CanonicalHeaderKey(to)] = values
+		}
+	}
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+	for name, value := range rules.Add {
+		header.Set(name, value)
+	}
+}
+
+// validSecretName reports whether name is a plain file name, with no directory or parent reference
+func validSecretName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, `/\`) && filepath.Base(name) == name
+}
+
+// secretSource caches a file from the secrets directory, reloading it when its modification time changes
+type secretSource struct {
+	dir     string
+	name    string
+	modTime time.Time
+	value   string
+	mutex   sync.Mutex
+}
+
+func newSecretSource(dir, name string) *secretSource {
+	return &secretSource{dir: dir, name: name}
+}
+
+// Get returns the trimmed file contents. The file is opened through os.Root, so a symlink
+// leading outside the secrets directory is refused.
+func (ss *secretSource) Get() (string, error) {
+	root, err := os.OpenRoot(ss.dir)
+	if err != nil {
+		return "", err
+	}
+	defer root.Close()
+
+	info, err := root.Stat(ss.name)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("secret %s is not a regular file", ss.name)
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if ss.value != "" && info.ModTime().Equal(ss.modTime) {
+		return ss.value, nil
+	}
+
+	file, err := root.Open(ss.name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("secret %s is empty", ss.name)
+	}
+
+	ss.value = value
+	ss.modTime = info.ModTime()
+	return value, nil
+}
+
+// credentials formats the secret for the auth header
+func (auth *AuthInjection) credentials(secret string) (string, error) {
+	if auth.Type == AuthBasic {
+		if !strings.Contains(secret, ":") {
+			return "", errors.New("basic auth secret must be in user:password form")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(secret)), nil
+	}
+	return "Bearer " + secret, nil
+}
+
+// rewriteRequest applies a policy to a request about to be sent upstream
+func (hpm *HTTPProxyManager) rewriteRequest(req *http.Request, podName string, policy *HeaderPolicy, secret *secretSource) {
+	if policy == nil {
+		return
+	}
+	policy.Request.apply(req.Header)
+
+	if policy.Auth == nil || secret == nil {
+		return
+	}
+	value, err := secret.Get()
+	if err == nil {
+		value, err = policy.Auth.credentials(value)
+	}
+	if err != nil {
+		// Forward without credentials so the pod answers with its own auth error
+		hpm.logger.Error("Failed to inject proxy credentials",
+			"pod", podName,
+			"secret", policy.Auth.Secret,
+			"error", err)
+		req.Header.Del(policy.Auth.Header)
+		return
+	}
+	req.Header.Set(policy.Auth.Header, value)
+}
+
+// rewriteResponse applies a policy to an upstream response and keeps redirects on the proxy.
+// scheme is the listener's scheme, used for replayed requests that never reached the router.
+func rewriteResponse(resp *http.Response, target *url.URL, policy *HeaderPolicy, scheme string) {
+	info, routed := requestRoute(resp.Request.Context())
+	if !routed {
+		// Replayed requests bypass the router, so fall back to what the director recorded
+		info.host = resp.Request.Header.Get("X-Original-Host")
+		info.scheme = scheme
+	}
+
+	if policy == nil || !policy.PreserveLocation {
+		if location := resp.Header.Get("Location"); location != "" {
+			resp.Header.Set("Location", rewriteLocation(location, target, info))
+		}
+	}
+
+	if policy == nil {
+		return
+	}
+	if policy.Cookies != nil {
+		rewriteCookies(resp.Header, policy.Cookies, info.prefix)
+	}
+	policy.Response.apply(resp.Header)
+}
+
+// rewriteLocation maps a redirect aimed at the pod, or at a path the route prefix was
+// stripped from, back onto the address and scheme the client used
+func rewriteLocation(location string, target *url.URL, info routeInfo) string {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	if parsed.IsAbs() {
+		// Redirects to other sites are left alone
+		if info.host == "" || (!strings.EqualFold(parsed.Host, target.Host) && !strings.EqualFold(parsed.Host, info.host)) {
+			return location
+		}
+		parsed.Scheme = info.scheme
+		if parsed.Scheme == "" {
+			parsed.Scheme = "http"
+		}
+		parsed.Host = info.host
+	} else if !strings.HasPrefix(parsed.Path, "/") {
+		// Relative redirects already resolve under the prefix
+		return location
+	}
+
+	if info.prefix != "" && !matchesPrefix(parsed.Path, info.prefix) {
+		parsed.Path = info.prefix + parsed.Path
+		if parsed.RawPath != "" {
+			parsed.RawPath = info.prefix + parsed.RawPath
+		}
+	}
+	return parsed.String()
+}
+
+// rewriteCookies adjusts the Domain and Path attributes of Set-Cookie headers
+func rewriteCookies(header http.Header, rewrite *CookieRewrite, prefix string) {
+	values := header.Values("Set-Cookie")
+	if len(values) == 0 {
+		return
+	}
+
+	rewritten := make([]string, 0, len(values))
+	for _, value := range values {
+		cookie, err := http.ParseSetCookie(value)
+		if err != nil {
+			rewritten = append(rewritten, value)
+			continue
+		}
+
+		cookie.Domain = rewrite.Domain
+		if rewrite.PathPrefix && prefix != "" {
+			path := cookie.Path
+			if path == "" || path == "/" {
+				path = ""
+			}
+			cookie.Path = prefix + path
+		}
+		rewritten = append(rewritten, cookie.String())
+	}
+
+	header.Del("Set-Cookie")
+	for _, value := range rewritten {
+		header.Add("Set-Cookie", value)
+	}
+}
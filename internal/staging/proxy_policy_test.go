@@ -0,0 +1,314 @@
+package staging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewriteLocation(t *testing.T) {
+	target := &url.URL{Scheme: "http", Host: "10.244.0.7:8080"}
+
+	tests := []struct {
+		name     string
+		location string
+		info     routeInfo
+		want     string
+	}{
+		{"absolute to pod", "http://10.244.0.7:8080/login?next=%2F", routeInfo{host: "localhost:8080", scheme: "http"}, "http://localhost:8080/login?next=%2F"},
+		{"absolute to pod over TLS", "http://10.244.0.7:8080/login", routeInfo{prefix: "/web", host: "localhost:8443", scheme: "https"}, "https://localhost:8443/web/login"},
+		{"https to client host over TLS", "https://web.agent-1.localhost:8443/home", routeInfo{host: "web.agent-1.localhost:8443", scheme: "https"}, "https://web.agent-1.localhost:8443/home"},
+		{"https to pod over plain listener", "https://10.244.0.7:8080/home", routeInfo{host: "localhost:8080", scheme: "http"}, "http://localhost:8080/home"},
+		{"absolute to pod under prefix", "http://10.244.0.7:8080/login", routeInfo{prefix: "/web", host: "localhost:8080"}, "http://localhost:8080/web/login"},
+		{"absolute to client host", "http://LOCALHOST:8080/home", routeInfo{prefix: "/web", host: "localhost:8080"}, "http://localhost:8080/web/home"},
+		{"other site", "https://accounts.example.com/login", routeInfo{prefix: "/web", host: "localhost:8080"}, "https://accounts.example.com/login"},
+		{"absolute without client host", "http://10.244.0.7:8080/login", routeInfo{}, "http://10.244.0.7:8080/login"},
+		{"root relative", "/login", routeInfo{prefix: "/web", host: "localhost:8080"}, "/web/login"},
+		{"root relative already prefixed", "/web/login", routeInfo{prefix: "/web", host: "localhost:8080"}, "/web/login"},
+		{"root relative without prefix", "/login", routeInfo{host: "web.agent-1.localhost:8080"}, "/login"},
+		{"relative", "login", routeInfo{prefix: "/web", host: "localhost:8080"}, "login"},
+		{"escaped path", "/files/a%2Fb", routeInfo{prefix: "/web", host: "localhost:8080"}, "/web/files/a%2Fb"},
+		{"unparseable", "http://[::1", routeInfo{prefix: "/web", host: "localhost:8080"}, "http://[::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteLocation(tt.location, target, tt.info); got != tt.want {
+				t.Errorf("rewriteLocation(%q) = %q, want %q", tt.location, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteResponseLocationScheme(t *testing.T) {
+	target := &url.URL{Scheme: "http", Host: "10.244.0.7:8080"}
+
+	tests := []struct {
+		name     string
+		request  func() *http.Request
+		listener string
+		want     string
+	}{
+		{
+			name: "routed over TLS",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "https://localhost:8443/web/", nil)
+				return withRouteInfo(r, "/web")
+			},
+			listener: "https",
+			want:     "https://localhost:8443/web/login",
+		},
+		{
+			name: "routed over plain HTTP",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "http://localhost:8080/web/", nil)
+				return withRouteInfo(r, "/web")
+			},
+			listener: "http",
+			want:     "http://localhost:8080/web/login",
+		},
+		{
+			name: "client forwarded proto is ignored",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "http://localhost:8080/web/", nil)
+				r.Header.Set("X-Forwarded-Proto", "gopher")
+				return withRouteInfo(r, "/web")
+			},
+			listener: "http",
+			want:     "http://localhost:8080/web/login",
+		},
+		{
+			name: "replay uses the listener scheme",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "http://10.244.0.7:8080/", nil)
+				r.Header.Set("X-Original-Host", "localhost:8443")
+				return r
+			},
+			listener: "https",
+			want:     "https://localhost:8443/login",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header:  http.Header{"Location": {"http://10.244.0.7:8080/login"}},
+				Request: tt.request(),
+			}
+			rewriteResponse(resp, target, nil, tt.listener)
+			if got := resp.Header.Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteCookies(t *testing.T) {
+	tests := []struct {
+		name    string
+		cookies []string
+		rewrite CookieRewrite
+		prefix  string
+		want    []string
+	}{
+		{
+			name:    "host only",
+			cookies: []string{"session=abc; Domain=pod.internal; Path=/; HttpOnly"},
+			want:    []string{"session=abc; Path=/; HttpOnly"},
+		},
+		{
+			name:    "replacement domain",
+			cookies: []string{"session=abc; Domain=pod.internal"},
+			rewrite: CookieRewrite{Domain: "example.test"},
+			want:    []string{"session=abc; Domain=example.test"},
+		},
+		{
+			name:    "root path under prefix",
+			cookies: []string{"session=abc; Path=/"},
+			rewrite: CookieRewrite{PathPrefix: true},
+			prefix:  "/web",
+			want:    []string{"session=abc; Path=/web"},
+		},
+		{
+			name:    "nested path under prefix",
+			cookies: []string{"theme=dark; Path=/settings", "id=1"},
+			rewrite: CookieRewrite{PathPrefix: true},
+			prefix:  "/web",
+			want:    []string{"theme=dark; Path=/web/settings", "id=1; Path=/web"},
+		},
+		{
+			name:    "path prefix without stripped prefix",
+			cookies: []string{"session=abc; Path=/app"},
+			rewrite: CookieRewrite{PathPrefix: true},
+			want:    []string{"session=abc; Path=/app"},
+		},
+		{
+			name:    "unparseable cookie kept",
+			cookies: []string{"=broken", "ok=1; Domain=pod.internal"},
+			want:    []string{"=broken", "ok=1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Set-Cookie": tt.cookies}
+			rewriteCookies(header, &tt.rewrite, tt.prefix)
+			if got := header.Values("Set-Cookie"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Set-Cookie = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderRulesApply(t *testing.T) {
+	header := http.Header{
+		"X-Old":     {"1", "2"},
+		"X-Debug":   {"on"},
+		"X-Replace": {"old"},
+	}
+	HeaderRules{
+		Rename: map[string]string{"x-old": "x-new"},
+		Remove: []string{"X-Debug"},
+		Add:    map[string]string{"X-Replace": "new"},
+	}.apply(header)
+
+	want := http.Header{"X-New": {"1", "2"}, "X-Replace": {"new"}}
+	if !reflect.DeepEqual(header, want) {
+		t.Errorf("header = %v, want %v", header, want)
+	}
+}
+
+func TestHeaderPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		auth       *AuthInjection
+		secretsDir string
+		wantErr    string
+	}{
+		{"no auth", nil, "", ""},
+		{"bearer", &AuthInjection{Type: "Bearer", Secret: "api-token"}, "/run/secrets", ""},
+		{"basic", &AuthInjection{Type: "basic", Secret: "credentials.txt"}, "/run/secrets", ""},
+		{"unknown type", &AuthInjection{Type: "digest", Secret: "token"}, "/run/secrets", "unknown auth type"},
+		{"no secrets dir", &AuthInjection{Type: "bearer", Secret: "token"}, "", "-proxy-secrets-dir"},
+		{"absolute path", &AuthInjection{Type: "bearer", Secret: "/etc/shadow"}, "/run/secrets", "must be a file name"},
+		{"parent reference", &AuthInjection{Type: "bearer", Secret: "../token"}, "/run/secrets", "must be a file name"},
+		{"subdirectory", &AuthInjection{Type: "bearer", Secret: "team/token"}, "/run/secrets", "must be a file name"},
+		{"backslash", &AuthInjection{Type: "bearer", Secret: `..\token`}, "/run/secrets", "must be a file name"},
+		{"dot dot", &AuthInjection{Type: "bearer", Secret: ".."}, "/run/secrets", "must be a file name"},
+		{"empty", &AuthInjection{Type: "bearer"}, "/run/secrets", "must be a file name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := HeaderPolicy{Auth: tt.auth}
+			err := policy.validate(tt.secretsDir)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate = %v, want nil", err)
+				}
+				if tt.auth != nil && policy.Auth.Header != "Authorization" {
+					t.Errorf("header = %q, want Authorization", policy.Auth.Header)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSecretSource(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	writeSecret(t, filepath.Join(dir, "token"), " abc123\n")
+	writeSecret(t, filepath.Join(dir, "blank"), "\n")
+	writeSecret(t, filepath.Join(outside, "private"), "leaked")
+	if err := os.Symlink(filepath.Join(outside, "private"), filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("token", filepath.Join(dir, "alias")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "folder"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"token", "abc123", false},
+		{"alias", "abc123", false},
+		{"escape", "", true},
+		{"folder", "", true},
+		{"blank", "", true},
+		{"missing", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newSecretSource(dir, tt.name).Get()
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("Get = %q, %v; want %q, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSecretSourceReloads(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	writeSecret(t, path, "first")
+
+	source := newSecretSource(dir, "token")
+	if got, _ := source.Get(); got != "first" {
+		t.Fatalf("Get = %q, want first", got)
+	}
+
+	writeSecret(t, path, "second")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := source.Get(); got != "second" {
+		t.Errorf("Get after rotation = %q, want second", got)
+	}
+}
+
+func TestAuthCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    AuthInjection
+		secret  string
+		want    string
+		wantErr bool
+	}{
+		{"bearer", AuthInjection{Type: AuthBearer}, "abc123", "Bearer abc123", false},
+		{"basic", AuthInjection{Type: AuthBasic}, "user:pass", "Basic dXNlcjpwYXNz", false},
+		{"basic without password", AuthInjection{Type: AuthBasic}, "user", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.auth.credentials(tt.secret)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("credentials = %q, %v; want %q, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func writeSecret(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,254 @@
+package staging
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// proxyRouter is a concurrency-safe routing table mapping Host headers and path prefixes
+// to proxy handlers. Routes can be added, replaced and removed while the server is running.
+type proxyRouter struct {
+	routes map[string]*proxyRoute // keyed by staging pod ID
+	mutex  sync.RWMutex
+}
+
+// proxyRoute is a single entry in the routing table
+type proxyRoute struct {
+	podID       string
+	prefix      string   // Empty when the proxy is not reachable by path
+	hosts       []string // Empty when the proxy is not reachable by Host header
+	stripPrefix bool
+	handler     http.Handler
+	transport   *streamingTransport
+}
+
+func newProxyRouter() *proxyRouter {
+	return &proxyRouter{
+		routes: make(map[string]*proxyRoute),
+	}
+}
+
+// Set adds a route, replacing and returning any route already registered for the same pod
+func (pr *proxyRouter) Set(route *proxyRoute) *proxyRoute {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	previous := pr.routes[route.podID]
+	pr.routes[route.podID] = route
+	return previous
+}
+
+// Remove deletes and returns the route registered for podID
+func (pr *proxyRouter) Remove(podID string) *proxyRoute {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	previous := pr.routes[podID]
+	delete(pr.routes, podID)
+	return previous
+}
+
+// Get returns the route registered for podID
+func (pr *proxyRouter) Get(podID string) (*proxyRoute, bool) {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	route, exists := pr.routes[podID]
+	return route, exists
+}
+
+// close releases the upstream connections held by a route
+func (route *proxyRoute) close() {
+	if route != nil && route.transport != nil {
+		route.transport.CloseIdleConnections()
+	}
+}
+
+// MatchHost returns the route serving a Host header value
+func (pr *proxyRouter) MatchHost(host string) (*proxyRoute, bool) {
+	host = normalizeHost(host)
+
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	for _, route := range pr.routes {
+		for _, h := range route.hosts {
+			if h == host {
+				return route, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Match returns the route with the longest prefix matching path on a segment boundary
+func (pr *proxyRouter) Match(path string) (*proxyRoute, bool) {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	var best *proxyRoute
+	for _, route := range pr.routes {
+		if route.prefix == "" || !matchesPrefix(path, route.prefix) {
+			continue
+		}
+		if best == nil || len(route.prefix) > len(best.prefix) {
+			best = route
+		}
+	}
+	return best, best != nil
+}
+
+// Paths returns the registered route prefixes in sorted order
+func (pr *proxyRouter) Paths() []string {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	paths := make([]string, 0, len(pr.routes))
+	for _, route := range pr.routes {
+		if route.prefix != "" {
+			paths = append(paths, route.prefix)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Hosts returns the registered virtual hosts in sorted order
+func (pr *proxyRouter) Hosts() []string {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	var hosts []string
+	for _, route := range pr.routes {
+		hosts = append(hosts, route.hosts...)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// ServeHTTP dispatches a request by Host header first and path prefix second,
+// or responds 404 with the known routes
+func (pr *proxyRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Virtual hosts serve the app at / so its paths are forwarded unchanged
+	if route, exists := pr.MatchHost(r.Host); exists {
+		route.handler.ServeHTTP(w, withRouteInfo(r, ""))
+		return
+	}
+
+	route, exists := pr.Match(r.URL.Path)
+	if !exists {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "no proxy route for path",
+			"host":   r.Host,
+			"path":   r.URL.Path,
+			"routes": pr.Paths(),
+			"hosts":  pr.Hosts(),
+		})
+		return
+	}
+
+	prefix := ""
+	if route.stripPrefix {
+		r = stripRoutePrefix(r, route.prefix)
+		prefix = strings.TrimSuffix(route.prefix, "/")
+	}
+	route.handler.ServeHTTP(w, withRouteInfo(r, prefix))
+}
+
+type routeInfoKey struct{}
+
+// routeInfo records how the client addressed a proxied request
+type routeInfo struct {
+	prefix string // Path prefix stripped before forwarding; empty when nothing was stripped
+	host   string // Host header sent by the client
+	scheme string // "https" when the client connected over TLS, otherwise "http"
+}
+
+// withRouteInfo attaches the client's host, scheme and the stripped prefix to a request
+func withRouteInfo(r *http.Request, prefix string) *http.Request {
+	info := routeInfo{prefix: prefix, host: r.Host, scheme: "http"}
+	if r.TLS != nil {
+		info.scheme = "https"
+	}
+	return r.WithContext(context.WithValue(r.Context(), routeInfoKey{}, info))
+}
+
+// requestRoute returns the route information attached by the router, if any
+func requestRoute(ctx context.Context) (routeInfo, bool) {
+	info, ok := ctx.Value(routeInfoKey{}).(routeInfo)
+	return info, ok
+}
+
+// matchesPrefix reports whether path is prefix itself or lies below it
+func matchesPrefix(path, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// stripRoutePrefix returns a shallow copy of r with prefix removed from its path
+func stripRoutePrefix(r *http.Request, prefix string) *http.Request {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return r
+	}
+
+	stripped := new(http.Request)
+	*stripped = *r
+	stripped.URL = new(url.URL)
+	*stripped.URL = *r.URL
+	stripped.Header = r.Header.Clone()
+
+	stripped.URL.Path = trimPathPrefix(r.URL.Path, prefix)
+	if r.URL.RawPath != "" {
+		stripped.URL.RawPath = trimPathPrefix(r.URL.RawPath, prefix)
+	}
+
+	// Let upstreams build absolute links back through the proxy
+	stripped.Header.Set("X-Forwarded-Prefix", prefix)
+	return stripped
+}
+
+func trimPathPrefix(path, prefix string) string {
+	trimmed := strings.TrimPrefix(path, prefix)
+	if trimmed == "" {
+		return "/"
+	}
+	return trimmed
+}
+
+// normalizeHost lowercases a Host header and strips its port and trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// dnsLabel turns an arbitrary name into a valid lowercase DNS label
+func dnsLabel(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+
+	label := strings.Trim(b.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimRight(label[:63], "-")
+	}
+	return label
+}
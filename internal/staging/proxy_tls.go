@@ -0,0 +1,316 @@
+package staging
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFileName = "ca.crt"
+	caKeyFileName  = "ca.key"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 90 * 24 * time.Hour
+
+	// leafRenewBefore re-issues cached leaf certificates this long before they expire
+	leafRenewBefore = 7 * 24 * time.Hour
+
+	// defaultTLSHost is served when the client sends no SNI or an unknown name
+	defaultTLSHost = "localhost"
+)
+
+// localCA is a development certificate authority that issues leaf certificates on demand
+type localCA struct {
+	cert     *x509.Certificate
+	key      crypto.Signer
+	certPEM  []byte
+	certFile string // Empty when the CA only lives in memory
+	leaves   map[string]*tls.Certificate
+	mutex    sync.Mutex
+}
+
+// loadOrCreateCA loads the CA from dir, generating and persisting a new one when none exists.
+// An empty dir keeps the CA in memory only.
+func loadOrCreateCA(dir, agentID string) (*localCA, bool, error) {
+	if dir != "" {
+		certPEM, certErr := os.ReadFile(filepath.Join(dir, caCertFileName))
+		keyPEM, keyErr := os.ReadFile(filepath.Join(dir, caKeyFileName))
+		if certErr == nil && keyErr == nil {
+			ca, err := parseCA(certPEM, keyPEM)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to load local CA from %s: %w", dir, err)
+			}
+			ca.certFile = filepath.Join(dir, caCertFileName)
+			return ca, false, nil
+		}
+		if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+			// Never replace a CA that clients may already trust
+			return nil, false, fmt.Errorf("incomplete local CA in %s (remove %s and %s to regenerate): %w",
+				dir, caCertFileName, caKeyFileName, errors.Join(certErr, keyErr))
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, false, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"k3s-local-agent"},
+			CommonName:   fmt.Sprintf("k3s-local-agent development CA (%s)", agentID),
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, false, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	ca, err := parseCA(certPEM, keyPEM)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, false, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, caKeyFileName), keyPEM, 0600); err != nil {
+			return nil, false, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, caCertFileName), certPEM, 0644); err != nil {
+			return nil, false, err
+		}
+		ca.certFile = filepath.Join(dir, caCertFileName)
+	}
+	return ca, true, nil
+}
+
+// parseCA decodes a PEM certificate and private key into a localCA
+func parseCA(certPEM, keyPEM []byte) (*localCA, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, errors.New("certificate is not a CA")
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported CA key type")
+	}
+
+	return &localCA{
+		cert:    cert,
+		key:     signer,
+		certPEM: certPEM,
+		leaves:  make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// leaf returns a cached certificate for host, issuing a new one when missing or near expiry
+func (ca *localCA) leaf(host string) (*tls.Certificate, error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if cert, exists := ca.leaves[host]; exists && time.Until(cert.Leaf.NotAfter) > leafRenewBefore {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"k3s-local-agent"}, CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	if host == defaultTLSHost {
+		template.IPAddresses = append(template.IPAddresses, net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	ca.leaves[host] = cert
+	return cert, nil
+}
+
+// issuedHosts returns the hostnames that currently have a leaf certificate
+func (ca *localCA) issuedHosts() []string {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	hosts := make([]string, 0, len(ca.leaves))
+	for host := range ca.leaves {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// setupTLS prepares the listener's TLS configuration from a supplied certificate or the local CA
+func (hpm *HTTPProxyManager) setupTLS(config *ProxyConfig) error {
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load proxy certificate: %w", err)
+		}
+		hpm.tlsConfig = &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		}
+		hpm.logger.Info("HTTP proxy TLS enabled with supplied certificate", "cert_file", config.CertFile)
+		return nil
+	}
+
+	ca, created, err := loadOrCreateCA(config.CertDir, hpm.agentID)
+	if err != nil {
+		return err
+	}
+	hpm.ca = ca
+	hpm.tlsConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: hpm.getCertificate,
+	}
+
+	if ca.certFile == "" {
+		hpm.logger.Warn("Local CA is not persisted; clients must trust it again after a restart")
+	}
+	hpm.logger.Info("HTTP proxy TLS enabled with local CA",
+		"ca_file", ca.certFile,
+		"created", created)
+	return nil
+}
+
+// getCertificate issues a leaf certificate for the SNI name when it is a proxy hostname
+func (hpm *HTTPProxyManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := normalizeHost(hello.ServerName)
+	if !hpm.tlsHostAllowed(host) {
+		host = defaultTLSHost
+	}
+
+	cert, err := hpm.ca.leaf(host)
+	if err != nil {
+		hpm.logger.Error("Failed to issue proxy certificate", "host", host, "error", err)
+		return nil, err
+	}
+	return cert, nil
+}
+
+// tlsHostAllowed limits on-demand issuance to names the proxy currently routes, localhost and
+// the tunnel host, so arbitrary SNI values cannot mint certificates or grow the cache. Pod and
+// group hosts are only served once their route exists.
+func (hpm *HTTPProxyManager) tlsHostAllowed(host string) bool {
+	if host == "" {
+		return false
+	}
+	if host == defaultTLSHost {
+		return true
+	}
+	if _, exists := hpm.router.MatchHost(host); exists {
+		return true
+	}
+	return hpm.tunnelHostname != "" && host == normalizeHost(hpm.tunnelHostname)
+}
+
+// serveCACertificate lets browsers and curl download the local CA certificate
+func (hpm *HTTPProxyManager) serveCACertificate(w http.ResponseWriter, r *http.Request) {
+	if hpm.ca == nil {
+		writeProxyJSON(w, http.StatusNotFound, map[string]string{"error": "local CA is not in use"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="k3s-local-agent-ca.crt"`)
+	w.Write(hpm.ca.certPEM)
+}
+
+// tlsStatus describes the listener's TLS setup for GetProxyStatus
+func (hpm *HTTPProxyManager) tlsStatus() map[string]interface{} {
+	status := map[string]interface{}{
+		"enabled": hpm.tlsConfig != nil,
+	}
+	if hpm.ca != nil {
+		status["mode"] = "local-ca"
+		status["ca_file"] = hpm.ca.certFile
+		status["ca_expires"] = hpm.ca.cert.NotAfter
+		status["issued_hosts"] = hpm.ca.issuedHosts()
+	} else if hpm.tlsConfig != nil {
+		status["mode"] = "certificate"
+	}
+	return status
+}
+
+// scheme returns the URL scheme clients use to reach the proxy
+func (hpm *HTTPProxyManager) scheme() string {
+	if hpm.tlsConfig != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,89 @@
+package staging
+
+import (
+	"crypto/tls"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"k3s-local-agent/pkg/logger"
+)
+
+func TestTLSHostAllowed(t *testing.T) {
+	hpm := NewHTTPProxyManager(&ProxyConfig{AgentID: "agent-1", TunnelHostname: "staging.example.com"}, logger.New())
+	hpm.router.Set(&proxyRoute{podID: "pod-1", prefix: "/web", hosts: []string{"web.agent-1.localhost"}, handler: http.NotFoundHandler()})
+	hpm.router.Set(&proxyRoute{podID: groupRoutePrefix + "api", prefix: groupPath("api"), hosts: hpm.groupHosts("api"), handler: http.NotFoundHandler()})
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"localhost", true},
+		{"staging.example.com", true},
+		{"web.agent-1.localhost", true},
+		{"api.group.agent-1.localhost", true},
+		{"api.group.staging.example.com", true},
+		{"unknown.agent-1.localhost", false},
+		{"random-1234.agent-1.localhost", false},
+		{"example.org", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := hpm.tlsHostAllowed(tt.host); got != tt.want {
+			t.Errorf("tlsHostAllowed(%q) = %t, want %t", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestGetCertificateOnlyIssuesServedHosts(t *testing.T) {
+	hpm := NewHTTPProxyManager(&ProxyConfig{AgentID: "agent-1", EnableSSL: true}, logger.New())
+	if hpm.ca == nil {
+		t.Fatal("local CA was not set up")
+	}
+	hpm.router.Set(&proxyRoute{podID: "pod-1", prefix: "/web", hosts: []string{"web.agent-1.localhost"}, handler: http.NotFoundHandler()})
+
+	tests := []struct {
+		serverName string
+		wantName   string
+	}{
+		{"web.agent-1.localhost", "web.agent-1.localhost"},
+		{"WEB.agent-1.localhost.", "web.agent-1.localhost"},
+		{"attacker-1.agent-1.localhost", "localhost"},
+		{"attacker-2.agent-1.localhost", "localhost"},
+		{"", "localhost"},
+	}
+
+	for _, tt := range tests {
+		cert, err := hpm.getCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if err != nil {
+			t.Fatalf("getCertificate(%q): %v", tt.serverName, err)
+		}
+		if cert.Leaf.Subject.CommonName != tt.wantName {
+			t.Errorf("getCertificate(%q) issued %q, want %q", tt.serverName, cert.Leaf.Subject.CommonName, tt.wantName)
+		}
+	}
+
+	if hosts := hpm.ca.issuedHosts(); !reflect.DeepEqual(hosts, []string{"localhost", "web.agent-1.localhost"}) {
+		t.Errorf("issued hosts = %v, want only localhost and the routed host", hosts)
+	}
+}
+
+func TestLeafCertificateCached(t *testing.T) {
+	ca, _, err := loadOrCreateCA("", "agent-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := ca.leaf("web.agent-1.localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := ca.leaf("web.agent-1.localhost")
+	if first != second {
+		t.Error("leaf certificate was issued again while still valid")
+	}
+	if err := first.Leaf.VerifyHostname("web.agent-1.localhost"); err != nil {
+		t.Error(err)
+	}
+}
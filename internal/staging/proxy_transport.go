@@ -0,0 +1,133 @@
+package staging
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamingTransport sends proxied requests to a pod, optionally over h2c. Upgrade
+// requests (WebSocket) always use HTTP/1.1 because they cannot be carried over HTTP/2.
+type streamingTransport struct {
+	http1 *http.Transport
+	h2c   *http.Transport
+}
+
+// newStreamingTransport creates a transport whose upstream connections are closed after
+// idleTimeout without traffic in either direction; zero disables the idle timeout
+func newStreamingTransport(idleTimeout time.Duration, h2c bool) *streamingTransport {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil || idleTimeout <= 0 {
+			return conn, err
+		}
+		return newIdleTimeoutConn(conn, idleTimeout), nil
+	}
+
+	t := &streamingTransport{
+		http1: &http.Transport{
+			Proxy:                 nil, // Pods are always reached directly
+			DialContext:           dial,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+
+	if h2c {
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		t.h2c = &http.Transport{
+			DialContext:     dial,
+			Protocols:       protocols,
+			IdleConnTimeout: 90 * time.Second,
+		}
+	}
+
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *streamingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.h2c != nil && !isUpgradeRequest(req) {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.http1.RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle upstream connections, used when a route is replaced
+func (t *streamingTransport) CloseIdleConnections() {
+	t.http1.CloseIdleConnections()
+	if t.h2c != nil {
+		t.h2c.CloseIdleConnections()
+	}
+}
+
+// isUpgradeRequest reports whether a request asks to switch protocols, e.g. to WebSocket
+func isUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isStreamingResponse reports whether a response is a long-lived stream such as server-sent events
+func isStreamingResponse(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusSwitchingProtocols ||
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// idleTimeoutConn closes a connection once no data has moved in either direction for timeout.
+// This bounds idle WebSocket and SSE streams, which otherwise never end on their own.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+	mutex   sync.Mutex
+	last    time.Time
+}
+
+func newIdleTimeoutConn(conn net.Conn, timeout time.Duration) *idleTimeoutConn {
+	c := &idleTimeoutConn{Conn: conn, timeout: timeout}
+	c.extend()
+	return c
+}
+
+// extend pushes the deadline out, at most once a second to keep syscalls down
+func (c *idleTimeoutConn) extend() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.last) < time.Second {
+		return
+	}
+	c.last = now
+	c.Conn.SetDeadline(now.Add(c.timeout))
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.extend()
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,122 @@
+package staging
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k3s-local-agent/internal/controlplane"
+)
+
+// StateStore persists staging agent state across restarts
+type StateStore interface {
+	Load() (*AgentState, error)
+	Save(state *AgentState) error
+}
+
+// AgentState represents the persisted state of a local staging agent
+type AgentState struct {
+	AgentID          string                            `json:"agent_id"`
+	StagingPods      map[string]StagingPodInfo         `json:"staging_pods"`
+	ReceivedPods     map[string]controlplane.PodInfo   `json:"received_pods"`
+	StagingApps      map[string]StagingAppInfo         `json:"staging_apps"`
+	ReceivedApps     map[string]controlplane.AppBundle `json:"received_apps"`
+	Proxies          map[string]HTTPProxy              `json:"proxies"`
+	Redirections     map[string]PodRedirection         `json:"redirections"`
+	Tunnels          map[string]CloudflareTunnel       `json:"tunnels,omitempty"`
+	PendingDeletions []DeletionResult                  `json:"pending_deletions,omitempty"` // Not yet reported to the control plane
+	SavedAt          time.Time                         `json:"saved_at"`
+}
+
+// FileStateStore stores agent state as a JSON file in a local data directory
+type FileStateStore struct {
+	path  string
+	mutex sync.Mutex
+}
+
+const stateFileName = "staging_state.json"
+
+// NewFileStateStore creates a file-backed state store under dataDir
+func NewFileStateStore(dataDir string) (*FileStateStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	return &FileStateStore{
+		path: filepath.Join(dataDir, stateFileName),
+	}, nil
+}
+
+// Load reads the persisted state, returning an empty state if none exists yet
+func (fs *FileStateStore) Load() (*AgentState, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	data, err := os.ReadFile(fs.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newAgentState(""), nil
+		}
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	state := newAgentState("")
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to decode state file: %w", err)
+	}
+
+	return state, nil
+}
+
+// Save atomically writes the state to disk
+func (fs *FileStateStore) Save(state *AgentState) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	state.SavedAt = time.Now()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	// Write to a temp file first so a crash never leaves a truncated state file
+	tmpPath := fs.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmpPath, fs.path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+
+	return nil
+}
+
+// LoadPersistedAgentID returns the agent ID recorded in dataDir, if any
+func LoadPersistedAgentID(dataDir string) string {
+	store, err := NewFileStateStore(dataDir)
+	if err != nil {
+		return ""
+	}
+	state, err := store.Load()
+	if err != nil {
+		return ""
+	}
+	return state.AgentID
+}
+
+// newAgentState returns an empty state with all maps initialised
+func newAgentState(agentID string) *AgentState {
+	return &AgentState{
+		AgentID:      agentID,
+		StagingPods:  make(map[string]StagingPodInfo),
+		ReceivedPods: make(map[string]controlplane.PodInfo),
+		StagingApps:  make(map[string]StagingAppInfo),
+		ReceivedApps: make(map[string]controlplane.AppBundle),
+		Proxies:      make(map[string]HTTPProxy),
+		Redirections: make(map[string]PodRedirection),
+		Tunnels:      make(map[string]CloudflareTunnel),
+	}
+}
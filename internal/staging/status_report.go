@@ -0,0 +1,100 @@
+package staging
+
+import (
+	"k3s-local-agent/internal/controlplane"
+)
+
+// report converts the status to the payload posted to the control plane
+func (s *StagingStatus) report() *controlplane.StagingStatusReport {
+	report := &controlplane.StagingStatusReport{
+		AgentID:           s.AgentID,
+		Status:            s.Status,
+		TotalPods:         s.TotalPods,
+		RunningPods:       s.RunningPods,
+		FailedPods:        s.FailedPods,
+		StagingPods:       make(map[string]controlplane.StagingPodSummary, len(s.StagingPods)),
+		KindClusterStatus: s.KindClusterStatus,
+		LastSync:          s.LastSync,
+		Timestamp:         s.Timestamp,
+	}
+	for id, pod := range s.StagingPods {
+		report.StagingPods[id] = pod.summary()
+	}
+	if len(s.StagingApps) > 0 {
+		report.StagingApps = make(map[string]controlplane.StagingAppSummary, len(s.StagingApps))
+		for id, app := range s.StagingApps {
+			report.StagingApps[id] = app.summary()
+		}
+	}
+	for _, deletion := range s.Deletions {
+		report.Deletions = append(report.Deletions, deletion.report())
+	}
+	if s.LastGC != nil {
+		report.LastGC = s.LastGC.report()
+	}
+	return report
+}
+
+// summary describes the pod for status reports and registration
+func (p StagingPodInfo) summary() controlplane.StagingPodSummary {
+	return controlplane.StagingPodSummary{
+		ID:            p.ID,
+		Name:          p.Name,
+		Namespace:     p.Namespace,
+		Image:         p.Image,
+		Status:        p.Status,
+		CPURequest:    p.CPURequest,
+		MemoryRequest: p.MemoryRequest,
+		LocalStatus:   p.LocalStatus,
+		LocalMessage:  p.LocalMessage,
+		LocalIP:       p.LocalIP,
+		CreatedAt:     p.CreatedAt,
+		UpdatedAt:     p.UpdatedAt,
+	}
+}
+
+func (a StagingAppInfo) summary() controlplane.StagingAppSummary {
+	summary := controlplane.StagingAppSummary{
+		ID:             a.ID,
+		Name:           a.Name,
+		Namespace:      a.Namespace,
+		Resources:      make([]controlplane.StagingAppResource, 0, len(a.Resources)),
+		Services:       a.Services,
+		MissingSecrets: a.MissingSecrets,
+		LocalStatus:    a.LocalStatus,
+		LocalMessage:   a.LocalMessage,
+		AppliedAt:      a.AppliedAt,
+		UpdatedAt:      a.UpdatedAt,
+	}
+	for _, resource := range a.Resources {
+		summary.Resources = append(summary.Resources, controlplane.StagingAppResource{Kind: resource.Kind, Name: resource.Name})
+	}
+	return summary
+}
+
+func (d DeletionResult) report() controlplane.StagingDeletion {
+	return controlplane.StagingDeletion{
+		StagingPodID:       d.StagingPodID,
+		PodName:            d.PodName,
+		Success:            d.Success,
+		PodDeleted:         d.PodDeleted,
+		ProxyRemoved:       d.ProxyRemoved,
+		RedirectionRemoved: d.RedirectionRemoved,
+		Errors:             d.Errors,
+		DeletedAt:          d.DeletedAt,
+	}
+}
+
+func (r *GCReport) report() *controlplane.StagingGCReport {
+	return &controlplane.StagingGCReport{
+		Trigger:      r.Trigger,
+		DryRun:       r.DryRun,
+		Pods:         r.Pods,
+		AppResources: r.AppResources,
+		Proxies:      r.Proxies,
+		Redirections: r.Redirections,
+		Processes:    r.Processes,
+		Errors:       r.Errors,
+		Timestamp:    r.Timestamp,
+	}
+}
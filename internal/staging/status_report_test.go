@@ -0,0 +1,140 @@
+package staging
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"k3s-local-agent/internal/controlplane"
+	"k3s-local-agent/pkg/logger"
+)
+
+func newStatusTestAgent(t *testing.T) *LocalStagingAgent {
+	t.Helper()
+	client, err := controlplane.NewControlPlaneClient(&controlplane.ControlPlaneConfig{
+		BaseURL: "http://127.0.0.1:1",
+		AgentID: "agent-1",
+	}, logger.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &LocalStagingAgent{
+		agentID:      "agent-1",
+		controlPlane: client,
+		stagingPods:  make(map[string]StagingPodInfo),
+		stagingApps:  make(map[string]StagingAppInfo),
+	}
+}
+
+func TestStagingStatusIsACopy(t *testing.T) {
+	lsa := newStatusTestAgent(t)
+	lsa.stagingPods["pod-1"] = StagingPodInfo{ID: "pod-1", LocalStatus: "running"}
+	lsa.stagingApps["app-1"] = StagingAppInfo{ID: "app-1", Resources: []AppResource{{Kind: "Service", Name: "web"}}, Services: []string{"web.default.svc.cluster.local"}}
+
+	status := lsa.GetStagingStatus()
+
+	lsa.mutex.Lock()
+	lsa.stagingPods["pod-2"] = StagingPodInfo{ID: "pod-2"}
+	app := lsa.stagingApps["app-1"]
+	app.Resources[0].Name = "changed"
+	app.Services[0] = "changed"
+	lsa.mutex.Unlock()
+
+	if len(status.StagingPods) != 1 {
+		t.Errorf("status pods = %d, want the 1 present when it was taken", len(status.StagingPods))
+	}
+	if got := status.StagingApps["app-1"]; got.Resources[0].Name != "web" || got.Services[0] != "web.default.svc.cluster.local" {
+		t.Errorf("status app = %+v, want the values present when it was taken", got)
+	}
+}
+
+func TestStagingStatusConcurrentUpdates(t *testing.T) {
+	lsa := newStatusTestAgent(t)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := fmt.Sprintf("pod-%d", i%20)
+			lsa.mutex.Lock()
+			lsa.stagingPods[id] = StagingPodInfo{ID: id, LocalStatus: "running"}
+			lsa.stagingApps[id] = StagingAppInfo{ID: id, Resources: []AppResource{{Kind: "Deployment", Name: id}}}
+			if i%3 == 0 {
+				delete(lsa.stagingPods, id)
+			}
+			lsa.mutex.Unlock()
+		}
+	}()
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		status := lsa.GetStagingStatus()
+		if _, err := json.Marshal(status.report()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := json.Marshal(status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestStagingStatusReport(t *testing.T) {
+	deletedAt := time.Date(2025, 7, 25, 2, 12, 40, 0, time.UTC)
+	status := &StagingStatus{
+		AgentID:     "agent-1",
+		Status:      "healthy",
+		TotalPods:   1,
+		RunningPods: 1,
+		StagingPods: map[string]StagingPodInfo{
+			"pod-1": {ID: "pod-1", Name: "web", CPURequest: "100m", LocalStatus: "running", LocalIP: "10.244.0.7", Labels: map[string]string{"app": "web"}},
+		},
+		StagingApps: map[string]StagingAppInfo{
+			"app-1": {ID: "app-1", Resources: []AppResource{{Kind: "Service", Name: "web"}}, LocalStatus: "pending"},
+		},
+		Deletions: []DeletionResult{{StagingPodID: "pod-0", PodDeleted: true, DeletedAt: deletedAt}},
+		LastGC:    &GCReport{Trigger: "startup", Pods: []string{"stale"}},
+	}
+
+	report := status.report()
+
+	pod := report.StagingPods["pod-1"]
+	if pod.Name != "web" || pod.CPURequest != "100m" || pod.LocalIP != "10.244.0.7" {
+		t.Errorf("pod summary = %+v", pod)
+	}
+	app := report.StagingApps["app-1"]
+	if len(app.Resources) != 1 || app.Resources[0] != (controlplane.StagingAppResource{Kind: "Service", Name: "web"}) {
+		t.Errorf("app resources = %+v", app.Resources)
+	}
+	if len(report.Deletions) != 1 || !report.Deletions[0].DeletedAt.Equal(deletedAt) || !report.Deletions[0].PodDeleted {
+		t.Errorf("deletions = %+v", report.Deletions)
+	}
+	if report.LastGC == nil || report.LastGC.Trigger != "startup" || len(report.LastGC.Pods) != 1 {
+		t.Errorf("last GC = %+v", report.LastGC)
+	}
+
+	// The summary leaves out pod details such as labels
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		StagingPods map[string]map[string]interface{} `json:"staging_pods"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := decoded.StagingPods["pod-1"]["labels"]; exists {
+		t.Error("pod summary includes labels")
+	}
+}